@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package agent
+
+import (
+	"errors"
+	"net"
+)
+
+// The agent is meant for NixOS hosts; other systems can't tell who connected
+func peerUid(conn *net.UnixConn) (int, error) {
+	return 0, errors.New("The morph agent is only supported on Linux")
+}
@@ -0,0 +1,42 @@
+package agent
+
+// The morph agent runs as root on a target host, and accepts commands on a unix socket, which morph connects to
+// through its SSH connection. A single connection carries all commands of a deployment, avoiding a new SSH session
+// and sudo invocation for each of them.
+//
+// The protocol is one JSON object per line: morph sends a Request, and the agent answers with Responses carrying
+// the output of the command as it is written, followed by one with Done set.
+
+const DefaultSocket = "/run/morph-agent/agent.sock"
+
+type Request struct {
+	// "ping", "run" or "status"
+	Command string `json:"command"`
+	// Arguments of "run", joined and interpreted by sh like commands run over SSH
+	Args []string `json:"args,omitempty"`
+	// Run as root, instead of as the user connecting to the agent
+	Sudo bool `json:"sudo,omitempty"`
+}
+
+type Response struct {
+	Stdout   []byte  `json:"stdout,omitempty"`
+	Stderr   []byte  `json:"stderr,omitempty"`
+	Done     bool    `json:"done,omitempty"`
+	ExitCode int     `json:"exitCode,omitempty"`
+	Error    string  `json:"error,omitempty"`
+	Status   *Status `json:"status,omitempty"`
+	// Answering "ping": whether the user connecting may run commands as root
+	SudoAllowed bool `json:"sudoAllowed,omitempty"`
+}
+
+// The state of a host as reported by its agent
+type Status struct {
+	Hostname      string   `json:"hostname"`
+	AgentVersion  string   `json:"agentVersion"`
+	CurrentSystem string   `json:"currentSystem"`
+	BootedSystem  string   `json:"bootedSystem"`
+	BootId        string   `json:"bootId"`
+	Uptime        float64  `json:"uptime"`
+	SystemState   string   `json:"systemState"`
+	FailedUnits   []string `json:"failedUnits"`
+}
@@ -0,0 +1,294 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dbcdk/morph/logging"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Commands are run with the environment of a login on NixOS, not the one of the service
+const commandPath = "/run/wrappers/bin:/run/current-system/sw/bin:/nix/var/nix/profiles/default/bin:/usr/bin:/bin"
+
+type server struct {
+	version      string
+	allowedUsers []string
+	sudoUsers    []string
+}
+
+// Accept commands on the socket from the allowed users, until morph is stopped. Only members of group may connect to
+// the socket, and only root and the sudoUsers may run commands as root.
+func Serve(socket string, group string, allowedUsers []string, sudoUsers []string, version string) error {
+	if err := os.MkdirAll(filepath.Dir(socket), 0755); err != nil {
+		return err
+	}
+	os.Remove(socket)
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	// the group limits who may connect, and only the allowed users among them are served
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return err
+		}
+		gid, err := strconv.Atoi(g.Gid)
+		if err != nil {
+			return err
+		}
+		if err := os.Chown(socket, -1, gid); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(socket, 0660); err != nil {
+		return err
+	}
+
+	s := &server{version: version, allowedUsers: allowedUsers, sudoUsers: sudoUsers}
+	logging.Infof("Listening on %s for %s\n", socket, strings.Join(allowedUsers, ", "))
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serve(conn.(*net.UnixConn))
+	}
+}
+
+func (s *server) serve(conn *net.UnixConn) {
+	defer conn.Close()
+
+	peer, err := s.authenticate(conn)
+	if err != nil {
+		logging.Warnf("Rejected connection: %s\n", err.Error())
+		json.NewEncoder(conn).Encode(Response{Done: true, Error: err.Error()})
+		return
+	}
+
+	// cancel a running command when morph goes away
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	requests := make(chan Request)
+	go func() {
+		defer cancel()
+		defer close(requests)
+		scanner := bufio.NewScanner(conn)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var request Request
+			if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+				return
+			}
+			select {
+			case requests <- request:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	out := &responseWriter{encoder: json.NewEncoder(conn)}
+	for request := range requests {
+		switch request.Command {
+		case "ping":
+			out.send(Response{Done: true, SudoAllowed: s.maySudo(peer)})
+		case "run":
+			s.run(ctx, peer, request, out)
+		case "status":
+			out.send(Response{Done: true, Status: s.status()})
+		default:
+			out.send(Response{Done: true, Error: "Unknown command: " + request.Command})
+		}
+	}
+}
+
+// Only the users morph deploys as may use the agent; the SSH connection authenticates them
+func (s *server) authenticate(conn *net.UnixConn) (*user.User, error) {
+	uid, err := peerUid(conn)
+	if err != nil {
+		return nil, err
+	}
+	peer, err := user.LookupId(strconv.Itoa(uid))
+	if err != nil {
+		return nil, err
+	}
+	for _, allowed := range s.allowedUsers {
+		if allowed == peer.Username {
+			return peer, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("%s is not allowed to use the morph agent", peer.Username))
+}
+
+// The agent doesn't ask for passwords like sudo would, so running commands as root has to be allowed explicitly
+func (s *server) maySudo(peer *user.User) bool {
+	if peer.Uid == "0" {
+		return true
+	}
+	for _, sudoUser := range s.sudoUsers {
+		if sudoUser == peer.Username {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *server) run(ctx context.Context, peer *user.User, request Request, out *responseWriter) {
+	if len(request.Args) == 0 {
+		out.send(Response{Done: true, Error: "No command specified"})
+		return
+	}
+
+	runAs := peer
+	if request.Sudo {
+		if !s.maySudo(peer) {
+			out.send(Response{Done: true, Error: fmt.Sprintf("%s may not run commands as root through the morph agent", peer.Username)})
+			return
+		}
+		root, err := user.LookupId("0")
+		if err != nil {
+			out.send(Response{Done: true, Error: err.Error()})
+			return
+		}
+		runAs = root
+	}
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", strings.Join(request.Args, " "))
+	cmd.Dir = runAs.HomeDir
+	cmd.Env = []string{
+		"PATH=" + commandPath,
+		"HOME=" + runAs.HomeDir,
+		"USER=" + runAs.Username,
+		"LOGNAME=" + runAs.Username,
+	}
+	if _, err := os.Stat(runAs.HomeDir); err != nil {
+		cmd.Dir = "/"
+	}
+	if runAs.Uid != "0" {
+		credential, err := credentialOf(runAs)
+		if err != nil {
+			out.send(Response{Done: true, Error: err.Error()})
+			return
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: credential}
+	}
+	cmd.Stdout = streamWriter{out, false}
+	cmd.Stderr = streamWriter{out, true}
+
+	logging.Verbosef("Running as %s: %s\n", runAs.Username, strings.Join(request.Args, " "))
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		out.send(Response{Done: true, ExitCode: exitErr.ExitCode()})
+		return
+	}
+	if err != nil {
+		out.send(Response{Done: true, Error: err.Error()})
+		return
+	}
+	out.send(Response{Done: true})
+}
+
+func credentialOf(u *user.User) (*syscall.Credential, error) {
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	credential := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	if groupIds, err := u.GroupIds(); err == nil {
+		for _, groupId := range groupIds {
+			if id, err := strconv.ParseUint(groupId, 10, 32); err == nil {
+				credential.Groups = append(credential.Groups, uint32(id))
+			}
+		}
+	}
+	return credential, nil
+}
+
+func (s *server) status() *Status {
+	status := &Status{AgentVersion: s.version, FailedUnits: make([]string, 0)}
+
+	status.Hostname, _ = os.Hostname()
+	status.CurrentSystem, _ = os.Readlink("/run/current-system")
+	status.BootedSystem, _ = os.Readlink("/run/booted-system")
+	if data, err := ioutil.ReadFile("/proc/sys/kernel/random/boot_id"); err == nil {
+		status.BootId = strings.TrimSpace(string(data))
+	}
+	if data, err := ioutil.ReadFile("/proc/uptime"); err == nil {
+		if fields := strings.Fields(string(data)); len(fields) > 0 {
+			status.Uptime, _ = strconv.ParseFloat(fields[0], 64)
+		}
+	}
+
+	// "degraded" (some units failed) makes is-system-running exit non-zero
+	var state bytes.Buffer
+	cmd := exec.Command("systemctl", "is-system-running")
+	cmd.Env = []string{"PATH=" + commandPath}
+	cmd.Stdout = &state
+	cmd.Run()
+	status.SystemState = strings.TrimSpace(state.String())
+
+	var failed bytes.Buffer
+	cmd = exec.Command("systemctl", "list-units", "--state=failed", "--plain", "--no-legend", "--no-pager")
+	cmd.Env = []string{"PATH=" + commandPath}
+	cmd.Stdout = &failed
+	cmd.Run()
+	for _, line := range strings.Split(failed.String(), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			status.FailedUnits = append(status.FailedUnits, fields[0])
+		}
+	}
+
+	return status
+}
+
+// Responses are written by the command's stdout and stderr concurrently
+type responseWriter struct {
+	mutex   sync.Mutex
+	encoder *json.Encoder
+}
+
+func (w *responseWriter) send(response Response) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.encoder.Encode(response)
+}
+
+type streamWriter struct {
+	out    *responseWriter
+	stderr bool
+}
+
+func (w streamWriter) Write(p []byte) (int, error) {
+	// p is reused by the caller
+	data := append([]byte{}, p...)
+	response := Response{Stdout: data}
+	if w.stderr {
+		response = Response{Stderr: data}
+	}
+	if err := w.out.send(response); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
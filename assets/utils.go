@@ -20,35 +20,30 @@ func Setup() (assetRoot string, err error) {
 		return "", err
 	}
 
-	evalMachinesData, err := Asset("data/eval-machines.nix")
-	if err != nil {
-		return "", err
-	}
+	// write every bundled file from data/ next to each other, since they import each other by relative path
+	for _, name := range AssetNames() {
+		data, err := Asset(name)
+		if err != nil {
+			return "", err
+		}
 
-	optionsData, err := Asset("data/options.nix")
-	if err != nil {
-		return "", err
+		err = ioutil.WriteFile(filepath.Join(assetFriendlyRoot, filepath.Base(name)), data, 0644)
+		if err != nil {
+			return "", err
+		}
 	}
 
-	evalMachinesPath := filepath.Join(assetFriendlyRoot, "eval-machines.nix")
-	optionsPath := filepath.Join(assetFriendlyRoot, "options.nix")
-	ioutil.WriteFile(evalMachinesPath, evalMachinesData, 0644)
-	ioutil.WriteFile(optionsPath, optionsData, 0644)
-
 	return
 }
 
 func Teardown(assetRoot string) (err error) {
 	assetFriendlyRoot := filepath.Join(assetRoot, Friendly)
 
-	err = os.Remove(filepath.Join(assetFriendlyRoot, "eval-machines.nix"))
-	if err != nil {
-		return err
-	}
-
-	err = os.Remove(filepath.Join(assetFriendlyRoot, "options.nix"))
-	if err != nil {
-		return err
+	for _, name := range AssetNames() {
+		err = os.Remove(filepath.Join(assetFriendlyRoot, filepath.Base(name)))
+		if err != nil {
+			return err
+		}
 	}
 
 	err = os.Remove(assetFriendlyRoot)
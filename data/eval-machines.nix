@@ -4,9 +4,23 @@
 let
   network      = import networkExpr;
   nwPkgs       = network.network.pkgs or {};
-  lib          = network.network.lib or nwPkgs.lib or (import <nixpkgs/lib>);
-  evalConfig   = network.network.evalConfig or "${nwPkgs.path or <nixpkgs>}/nixos/lib/eval-config.nix";
-  runCommand   = network.network.runCommand or nwPkgs.runCommand or ((import <nixpkgs> {}).runCommand);
+  nixpkgsPath  = pinnedNixpkgs (network.network.nixpkgs or null);
+  lib          = network.network.lib or nwPkgs.lib or (import (nixpkgsPath + "/lib"));
+  evalConfig   = network.network.evalConfig or "${nwPkgs.path or nixpkgsPath}/nixos/lib/eval-config.nix";
+  runCommand   = network.network.runCommand or nwPkgs.runCommand or ((import nixpkgsPath {}).runCommand);
+  roles        = network.network.roles or {};
+
+  # network.nixpkgs pins the nixpkgs used instead of <nixpkgs>: a path, a
+  # tarball URL (or { url; sha256; }), a flake reference, or a flake input.
+  pinnedNixpkgs = pin:
+    if pin == null then <nixpkgs>
+    else if builtins.isPath pin then pin
+    else if builtins.isAttrs pin && pin ? url then
+      builtins.fetchTarball ({ inherit (pin) url; } // (if pin ? sha256 then { inherit (pin) sha256; } else {}))
+    else if builtins.isAttrs pin then pin.outPath
+    else if builtins.substring 0 1 pin == "/" then pin
+    else if builtins.match "https?://.*" pin != null then builtins.fetchTarball pin
+    else (builtins.getFlake pin).outPath;
 in
   with lib;
 
@@ -24,6 +38,7 @@ rec {
         value = import evalConfig {
           modules =
             modules ++
+            (mapAttrsToList roleModule roles) ++
             [ ({ config, lib, options, ... }: {
                 key = "deploy-stuff";
                 imports = [ ./options.nix ];
@@ -45,6 +60,83 @@ rec {
     ) (attrNames (removeAttrs network [ "network" "defaults" "resources" "require" "_file" ])));
 
 
+  # Turn a role from `network.roles` into a module, which only applies to
+  # machines listing the role in `deployment.roles`. Imports can't depend on
+  # config, so the role module is applied by hand and its config wrapped in
+  # mkIf; for the same reason it may not declare imports or options.
+  roleModule = roleName: role:
+    let
+      module = role.module or {};
+      wrapper = args:
+        let
+          m = if isFunction module then module args else module;
+          cfg = if m ? config then m.config else removeAttrs m [ "_file" "key" "imports" ];
+        in
+          if (m.imports or []) != [] || m ? options
+          then throw "role '${roleName}': role modules can't declare imports or options"
+          else {
+            config = mkIf (elem roleName args.config.deployment.roles) (mkMerge [
+              cfg
+              {
+                deployment.secrets = role.secrets or {};
+                deployment.healthChecks = role.healthChecks or {};
+              }
+            ]);
+          };
+    in
+      setFunctionArgs wrapper ((if isFunction module then functionArgs module else {}) // { config = false; });
+
+  # Unknown attributes under `deployment` are rejected by the module system,
+  # but `network` and the roles in it are plain attribute sets: warn about
+  # attributes morph doesn't know about, since typos would be silently ignored.
+  knownNetworkAttrs = [
+    "pkgs" "lib" "evalConfig" "runCommand" "description" "ordering"
+    "nixConfig" "buildShell" "roles" "trustedPublicKeys" "jumpHostSessions"
+    "steps" "customSteps" "builders" "maxJobs" "cores"
+    "nixpkgs" "preDeploy" "postDeploy" "notifyWebhook"
+  ];
+  knownRoleAttrs = [ "module" "secrets" "healthChecks" ];
+
+  unknownAttrWarnings = prefix: known: attrs:
+    map (n: "unknown attribute '${prefix}.${n}' is ignored by morph")
+      (filter (n: !(elem n known)) (attrNames attrs));
+
+  warnings =
+    unknownAttrWarnings "network" knownNetworkAttrs (network.network or {})
+    ++ unknownAttrWarnings "network.ordering" [ "tags" ] (network.network.ordering or {})
+    ++ concatLists (mapAttrsToList (roleName: role:
+         unknownAttrWarnings "network.roles.${roleName}" knownRoleAttrs role) roles);
+
+  # network.builders is given to nix as --builders: either in nix' own format
+  # (a string, or a machines file as a path), or as a list of builders.
+  renderBuilder = b:
+    let
+      orDash = v: if v == null || v == [] || v == "" then "-" else if isList v then concatStringsSep "," v else toString v;
+      uri = if builtins.match ".*://.*" b.hostName != null then b.hostName
+            else "ssh://${optionalString (b ? sshUser) "${b.sshUser}@"}${b.hostName}";
+    in concatStringsSep " " [
+      uri
+      (orDash (b.systems or b.system or null))
+      (orDash (b.sshKey or null))
+      (toString (b.maxJobs or 1))
+      (toString (b.speedFactor or 1))
+      (orDash (b.supportedFeatures or []))
+      (orDash (b.mandatoryFeatures or []))
+      (orDash (b.publicHostKey or null))
+    ];
+
+  builders =
+    let b = network.network.builders or null; in
+    if b == null then ""
+    else if isString b then b
+    else if builtins.isPath b then "@${toString b}"
+    else concatMapStringsSep " ; " renderBuilder b;
+
+  checkRoles = machineName: machineRoles:
+    let unknown = filter (r: !(roles ? ${r})) machineRoles; in
+    if unknown == [] then machineRoles
+    else throw "machine '${machineName}' references undefined role(s): ${concatStringsSep ", " unknown}";
+
   deploymentInfoModule = {
     deployment = {
       name = deploymentName;
@@ -62,8 +154,10 @@ rec {
 
     machines =
       flip mapAttrs nodes (n: v': let v = scrubOptionValue v'; in
-        { inherit (v.config.deployment) targetHost targetUser secrets healthChecks buildOnly substituteOnDestination tags;
+        { inherit (v.config.deployment) targetHost targetUser targetPort jumpHost secrets healthChecks buildOnly substituteOnDestination tags environment activationPolicy preConnectCommand sshPasswordAuth temporaryNixSettings privilegeEscalation skipHealthChecks skipSecrets sudoPasswordFile deployAfter hostKey knownHostsFile identityFile agentForwarding connectTimeout commandTimeout sshOptions addressFamily preActivation postActivation;
           name = n;
+          agent = { inherit (v.config.deployment.agent) enable socket; };
+          roles = checkRoles n v.config.deployment.roles;
           nixosRelease = v.config.system.nixos.release or (removeSuffix v.config.system.nixos.version.suffix v.config.system.nixos.version);
           nixConfig = mapAttrs
             (n: v: if builtins.isString v then v else throw "nix option '${n}' must have a string typed value")
@@ -78,6 +172,16 @@ rec {
       meta = {
         description = network.description or "";
         ordering = network.ordering or {};
+        trustedPublicKeys = network.trustedPublicKeys or [];
+        jumpHostSessions = network.jumpHostSessions or {};
+        steps = network.steps or null;
+        customSteps = network.customSteps or {};
+        preDeploy = network.preDeploy or [];
+        postDeploy = network.postDeploy or [];
+        notifyWebhook = network.notifyWebhook or "";
+        maxJobs = toString (network.maxJobs or "");
+        cores = toString (network.cores or "");
+        inherit builders warnings;
       };
     };
 
@@ -0,0 +1,19 @@
+# Evaluate the deployment options declared in options.nix, for documentation purposes
+{ nixpkgs ? <nixpkgs> }:
+
+let
+  lib = import (nixpkgs + "/lib");
+  eval = import (nixpkgs + "/nixos/lib/eval-config.nix") {
+    modules = [ ./options.nix ];
+  };
+
+  # defaults and descriptions may be wrapped, e.g. in literalExample or mdDoc
+  unwrap = v: if builtins.isAttrs v && v ? _type && v ? text then v.text else v;
+in
+  with lib;
+
+  map (option: {
+    inherit (option) name type;
+    description = unwrap (option.description or "");
+    default = unwrap (option.default or null);
+  }) (filter (option: option.visible != false && !option.internal) (optionAttrSetToDocList eval.options.deployment))
@@ -29,8 +29,74 @@ keyOptionsType = submodule ({ ... }: {
     };
 
     source = mkOption {
-      type = str;
-      description = "Local path";
+      type = nullOr str;
+      default = null;
+      description = "Local path. Exactly one of source, sopsFile, vaultPath, fromEnv and fromCommand must be set.";
+    };
+
+    ageIdentity = mkOption {
+      type = nullOr str;
+      default = null;
+      example = "~/.ssh/id_ed25519";
+      description = ''
+        Path of an age identity (or SSH private key) to decrypt the age-encrypted source with,
+        like agenix does. The plaintext is only kept in memory, and streamed to the host.
+      '';
+    };
+
+    sopsFile = mkOption {
+      type = nullOr str;
+      default = null;
+      example = "secrets/production.yaml";
+      description = ''
+        Local path of a sops-encrypted file, which is decrypted locally with the sops binary
+        when uploading the secret. The plaintext is kept in a temporary file only accessible by
+        the current user (on /dev/shm if available), and removed once uploaded.
+      '';
+    };
+
+    vaultPath = mkOption {
+      type = nullOr str;
+      default = null;
+      example = "kv/data/myapp#password";
+      description = ''
+        Read the secret from Vault at deploy time, given as the API path of the secret and
+        optionally a field, like <literal>kv/data/myapp#password</literal> (without a field, the
+        whole secret is uploaded as JSON). Vault is accessed with $VAULT_ADDR and $VAULT_TOKEN
+        (or ~/.vault-token). The value is only kept in memory, and streamed to the host.
+      '';
+    };
+
+    fromEnv = mkOption {
+      type = nullOr str;
+      default = null;
+      example = "PGPASSWORD";
+      description = ''
+        Name of an environment variable of the morph process holding the secret, e.g. injected by
+        a CI system. Its value is written to a temporary file only accessible by the current user
+        for uploading, and redacted in the output of morph.
+      '';
+    };
+
+    fromCommand = mkOption {
+      type = nullOr (listOf str);
+      default = null;
+      example = [ "op" "read" "op://infra/postgres/password" ];
+      description = ''
+        Command run on the deploying machine (in the directory of the deployment file), whose output
+        is the content of the secret, e.g. to read it from a password manager or a cloud secret store.
+        The output is only kept in memory, and streamed to the host.
+      '';
+    };
+
+    sopsExtract = mkOption {
+      type = nullOr str;
+      default = null;
+      example = ''["database"]["password"]'';
+      description = ''
+        Only upload a single value of the sops file, given as an expression for
+        <literal>sops --decrypt --extract</literal>.
+      '';
     };
 
     owner = mkOption {
@@ -50,7 +116,20 @@ keyOptionsType = submodule ({ ... }: {
     action = mkOption {
       default = [];
       type = listOf str;
-      description = "Action to perform on remote host after uploading secret.";
+      example = [ "sudo" "systemctl" "restart" "nginx.service" ];
+      description = ''
+        Action to perform on remote host after uploading secret, e.g. reloading the service using it.
+        It isn't run if the secret was unchanged on the host, and actions shared by several secrets run once.
+      '';
+    };
+
+    ephemeral = mkOption {
+      default = false;
+      type = bool;
+      description = ''
+        Whether the secret is expected to live on a tmpfs (e.g. below /run), so it never persists on disk.
+        `morph audit-secrets` reports ephemeral secrets whose destination is on a persistent filesystem.
+      '';
     };
 
     mkDirs = mkOption {
@@ -77,10 +156,69 @@ healthCheckType = submodule ({ ... }: {
       default = [];
       description = "List of HTTP health checks";
     };
+    port = mkOption {
+      type = listOf portHealthCheckType;
+      default = [];
+      description = "List of TCP port health checks";
+    };
+    dns = mkOption {
+      type = listOf dnsHealthCheckType;
+      default = [];
+      description = "List of DNS resolution health checks";
+    };
+    systemd = mkOption {
+      type = listOf systemdHealthCheckType;
+      default = [];
+      description = "List of systemd unit health checks";
+    };
   };
 });
 
+# Options shared by all types of health checks
+healthCheckOptions = { ... }: {
+  imports = [ (mkAliasOptionModule [ "interval" ] [ "period" ]) ];
+
+  options = {
+    period = mkOption {
+      type = int;
+      description = "Seconds between checks";
+      default = 2;
+    };
+    retries = mkOption {
+      type = nullOr int;
+      description = ''
+        How often to retry the check after it failed, before considering it failed.
+        By default, the check is retried until the health check timeout of morph is reached.
+      '';
+      default = null;
+    };
+    initialDelay = mkOption {
+      type = int;
+      description = "Seconds to wait before running the check for the first time, e.g. for slow-starting services";
+      default = 0;
+    };
+    severity = mkOption {
+      type = enum [ "error" "warning" ];
+      description = ''
+        Whether a failure of the check fails the deployment (error), or is only reported (warning),
+        e.g. for nice-to-have probes.
+      '';
+      default = "error";
+    };
+    after = mkOption {
+      type = listOf str;
+      description = ''
+        Descriptions of other health checks of the host which must pass before this check is run,
+        e.g. to only check that a service responds once its unit is active.
+      '';
+      default = [];
+    };
+  };
+};
+
 httpHealthCheckType = types.submodule ({ ... }: {
+  imports = [ healthCheckOptions ];
+
   options = {
     description = mkOption {
         type = str;
@@ -111,11 +249,6 @@ httpHealthCheckType = types.submodule ({ ... }: {
       description = "HTTP request headers";
       default = {};
     };
-    period = mkOption {
-      type = int;
-      description = "Seconds between checks";
-      default = 2;
-    };
     timeout = mkOption {
       type = int;
       description = "Timeout in seconds";
@@ -130,6 +263,8 @@ httpHealthCheckType = types.submodule ({ ... }: {
 });
 
 cmdHealthCheckType = types.submodule ({ ... }: {
+  imports = [ healthCheckOptions ];
+
   options = {
     description = mkOption {
         type = str;
@@ -140,10 +275,98 @@ cmdHealthCheckType = types.submodule ({ ... }: {
         description = "Command to run as list";
         default = null;
     };
-    period = mkOption {
+    timeout = mkOption {
       type = int;
-      description = "Seconds between checks";
-      default = 2;
+      description = "Timeout in seconds";
+      default = 5;
+    };
+  };
+});
+
+portHealthCheckType = types.submodule ({ ... }: {
+  imports = [ healthCheckOptions ];
+
+  options = {
+    description = mkOption {
+        type = str;
+        description = "Health check description";
+    };
+    host = mkOption {
+      type = nullOr str;
+      description = "Host name";
+      default = null;
+    };
+    port = mkOption {
+      type = port;
+      description = "TCP port that must accept connections";
+    };
+    timeout = mkOption {
+      type = int;
+      description = "Connect timeout in seconds";
+      default = 5;
+    };
+  };
+});
+
+dnsHealthCheckType = types.submodule ({ ... }: {
+  imports = [ healthCheckOptions ];
+
+  options = {
+    description = mkOption {
+        type = str;
+        description = "Health check description";
+    };
+    name = mkOption {
+      type = str;
+      description = "Name to resolve";
+    };
+    type = mkOption {
+      type = enum [ "A" "AAAA" "CNAME" "MX" "NS" "TXT" ];
+      description = "Record type to look up";
+      default = "A";
+    };
+    server = mkOption {
+      type = nullOr str;
+      description = "Resolver to query, as host or host:port. Defaults to the resolver of the deploying machine.";
+      default = null;
+    };
+    queryTarget = mkOption {
+      type = bool;
+      description = "Query the DNS server running on the target host itself, instead of <literal>server</literal>.";
+      default = false;
+    };
+    expect = mkOption {
+      type = listOf str;
+      description = "Records that must be part of the answer. If empty, any non-empty answer succeeds.";
+      default = [];
+      example = [ "192.0.2.10" ];
+    };
+    timeout = mkOption {
+      type = int;
+      description = "Timeout in seconds";
+      default = 5;
+    };
+  };
+});
+
+systemdHealthCheckType = types.submodule ({ config, ... }: {
+  imports = [ healthCheckOptions ];
+
+  options = {
+    description = mkOption {
+        type = str;
+        description = "Health check description";
+        default = "${concatStringsSep ", " config.units} ${config.state}";
+    };
+    units = mkOption {
+      type = listOf str;
+      description = "Units to check";
+      example = [ "nginx.service" "postgresql.service" ];
+    };
+    state = mkOption {
+      type = enum [ "active" "inactive" "failed" ];
+      description = "State all units must be in, as reported by <literal>systemctl is-active</literal>";
+      default = "active";
     };
     timeout = mkOption {
       type = int;
@@ -153,6 +376,30 @@ cmdHealthCheckType = types.submodule ({ ... }: {
   };
 });
 
+activationPolicyType = submodule ({ ... }: {
+  options = {
+    neverRestart = mkOption {
+      type = listOf str;
+      default = [];
+      example = [ "postgresql.service" ];
+      description = "Units that must never be restarted (or stopped) automatically when switching configuration.";
+    };
+    neverStop = mkOption {
+      type = listOf str;
+      default = [];
+      description = "Units that must never be stopped automatically when switching configuration.";
+    };
+    onViolation = mkOption {
+      type = enum [ "abort" "confirm" ];
+      default = "abort";
+      description = ''
+        What to do when activation would violate the policy;
+        abort the deployment, or ask for confirmation before switching.
+      '';
+    };
+  };
+});
+
 in
 {
   options.deployment = {
@@ -162,6 +409,8 @@ in
       default = "";
       description = ''
         The remote host used for deployment. If this is not set it will fallback to the deployments attribute name.
+        IPv6 addresses may be given with or without brackets, e.g. "[2001:db8::1]".
+        "localhost" deploys to the machine morph runs on, without SSH.
       '';
     };
 
@@ -174,6 +423,186 @@ in
       '';
     };
 
+    preConnectCommand = mkOption {
+      type = listOf str;
+      default = [];
+      example = [ "knock" "example.com" "7000" "8000" "9000" ];
+      description = ''
+        Command to run on the deploying machine before connecting to the host for the first time, e.g. to
+        knock on ports, add a VPN route or open a firewall. The command runs once per morph invocation, with
+        <literal>MORPH_HOST</literal> and <literal>MORPH_TARGET_HOST</literal> set in its environment.
+        Morph doesn't connect to the host if the command fails.
+      '';
+    };
+
+    sshPasswordAuth = mkOption {
+      type = bool;
+      default = false;
+      description = ''
+        Fall back to password authentication when connecting to the host, e.g. for first-contact
+        deploys to freshly imaged appliances which don't have any SSH keys installed yet. The password
+        is asked for once per morph invocation - using the program in $SSH_ASKPASS if set, or on the
+        terminal - and used for all such hosts, including the connections made by nix copy.
+      '';
+    };
+
+    temporaryNixSettings = mkOption {
+      type = attrsOf str;
+      default = {};
+      example = { extra-trusted-public-keys = "cache.example.com-1:AbC...="; };
+      description = ''
+        Nix settings to apply to the nix daemon of the host while morph pushes to and activates it,
+        e.g. a trusted key or post-build hook for a new binary cache on hosts whose configuration
+        predates it. Morph temporarily replaces /etc/nix/nix.conf by a copy including the settings,
+        restarts the nix daemon, and restores the original configuration afterwards.
+      '';
+    };
+
+    privilegeEscalation = mkOption {
+      type = enum [ "sudo" "doas" "none" ];
+      default = "sudo";
+      description = ''
+        How morph gains root privileges on the host, for activation, secrets and other commands run as root.
+        "doas" is for OpenBSD-style setups; as doas only reads passwords from a terminal, the target user
+        has to be permitted with nopass. "none" runs the commands directly, for hosts which are deployed to
+        as root and deliberately don't install sudo.
+      '';
+    };
+
+    sudoPasswordFile = mkOption {
+      type = nullOr str;
+      default = null;
+      example = "secrets/db01-sudo-password";
+      description = ''
+        File on the deploying machine containing the sudo password of the host, for hosts whose
+        password differs from the one given by --passwd, --passwd-file or --passwd-env. Relative paths
+        are relative to the deployment file. Use a string, not a path, to keep the file out of the Nix store.
+      '';
+    };
+
+    hostKey = mkOption {
+      type = nullOr str;
+      default = null;
+      example = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIL0...";
+      description = ''
+        Public host key of the host, as in /etc/ssh/ssh_host_ed25519_key.pub. When set, morph only
+        accepts this key for the host, instead of the keys in the known_hosts files of the user.
+      '';
+    };
+
+    knownHostsFile = mkOption {
+      type = nullOr str;
+      default = null;
+      example = "known_hosts";
+      description = ''
+        known_hosts file to verify the host key of the host with, instead of the known_hosts files of the
+        user, e.g. one kept next to the deployment for all hosts. Relative paths are relative to the
+        deployment file. Ignored if hostKey is set.
+      '';
+    };
+
+    identityFile = mkOption {
+      type = nullOr str;
+      default = null;
+      example = "keys/production";
+      description = ''
+        Private key on the deploying machine to log in to the host with, instead of the keys of the user
+        and the one given by $SSH_IDENTITY_FILE. Only this key is offered, also when pushing closures. A
+        passphrase protected key is used through the ssh-agent, which must hold it. Relative paths are
+        relative to the deployment file. Use a string, not a path, to keep the key out of the Nix store.
+      '';
+    };
+
+    agentForwarding = mkOption {
+      type = bool;
+      default = false;
+      description = ''
+        Whether to forward the ssh-agent of the deploying user to the host, e.g. for activation scripts
+        fetching private repositories. Anyone with root on the host can use the forwarded keys while
+        morph is connected.
+      '';
+    };
+
+    connectTimeout = mkOption {
+      type = nullOr int;
+      default = null;
+      example = 60;
+      description = ''
+        Seconds to wait for connecting to the host, instead of --connect-timeout, e.g. for hosts behind
+        slow links.
+      '';
+    };
+
+    commandTimeout = mkOption {
+      type = nullOr int;
+      default = null;
+      example = 1800;
+      description = ''
+        Seconds to wait for each command on the host to finish - including pushing a closure, uploading a
+        secret and activating - instead of --command-timeout, e.g. for hosts with slow activations.
+      '';
+    };
+
+    sshOptions = mkOption {
+      type = listOf str;
+      default = [];
+      example = [ "-o" "ProxyCommand=ssh -W %h:%p bastion.example.com" ];
+      description = ''
+        Extra options for every ssh, scp and nix copy invocation for the host, taking precedence over
+        the options set by morph. They have to be understood by both ssh and scp, so use the -o form.
+        Hosts with options are connected to with the ssh binary instead of the built-in client.
+      '';
+    };
+
+    addressFamily = mkOption {
+      type = enum [ "any" "inet" "inet6" ];
+      default = "any";
+      description = ''
+        Connect to the host over IPv4 ("inet") or IPv6 ("inet6") only, e.g. for dual-stack hosts only
+        reachable over one of them from the deploying machine. Applies to the built-in client, ssh, scp
+        and nix copy alike.
+      '';
+    };
+
+    preActivation = mkOption {
+      type = listOf str;
+      default = [];
+      example = [ "systemctl stop batch-worker" ];
+      description = ''
+        Shell commands run as root on the host right before switch-to-configuration, for switch and test.
+        If one fails, the host isn't activated, and the deployment stops like for a failed health check.
+      '';
+    };
+
+    postActivation = mkOption {
+      type = listOf str;
+      default = [];
+      example = [ "curl -fsS http://localhost:8080/warm-cache" ];
+      description = ''
+        Shell commands run as root on the host right after switch-to-configuration succeeded, for switch
+        and test. If one fails, the deployment stops like for a failed health check.
+      '';
+    };
+
+    targetPort = mkOption {
+      type = nullOr port;
+      default = null;
+      description = ''
+        The SSH port of the remote host used for deployment. If this is not set, the default port (22) is used,
+        unless configured otherwise in the SSH config file when using the ssh binary.
+      '';
+    };
+
+    jumpHost = mkOption {
+      type = nullOr str;
+      default = null;
+      example = "admin@bastion.example.com:2222";
+      description = ''
+        Bastion to connect to the host through, given as <literal>[user@]host[:port]</literal> like the
+        <literal>-J</literal> option of ssh.
+      '';
+    };
+
     buildOnly = mkOption {
       type = bool;
       default = false;
@@ -185,6 +614,24 @@ in
       '';
     };
 
+    skipHealthChecks = mkOption {
+      type = bool;
+      default = false;
+      description = ''
+        Don't run the health checks of the host, e.g. for an isolated lab box which morph can't
+        reach the services of. Pass --ignore-host-skips to run them anyway.
+      '';
+    };
+
+    skipSecrets = mkOption {
+      type = bool;
+      default = false;
+      description = ''
+        Don't upload secrets to the host, also when --upload-secrets is given, e.g. for hosts
+        which get their secrets provisioned by other means. Pass --ignore-host-skips to upload them anyway.
+      '';
+    };
+
     substituteOnDestination = mkOption {
       type = bool;
       default = false;
@@ -229,11 +676,125 @@ in
         Host tags.
       '';
     };
+
+    deployAfter = mkOption {
+      type = listOf str;
+      default = [];
+      example = [ "db01" ];
+      description = ''
+        Names of hosts to deploy before this one, e.g. databases before the app servers using them or
+        primaries before their replicas. Hosts not selected for the run are ignored.
+      '';
+    };
+
+    environment = mkOption {
+      type = nullOr str;
+      default = null;
+      example = "production";
+      description = ''
+        Environment the host belongs to, e.g. production or staging.
+        It is shown when selecting hosts, and can be guarded against with
+        <literal>--only-environment</literal> and <literal>--forbid-environment</literal>.
+      '';
+    };
+
+    activationPolicy = mkOption {
+      type = activationPolicyType;
+      default = {};
+      description = ''
+        Restrictions on the units a switch may touch. When set, morph inspects the
+        <literal>dry-activate</literal> plan before running test or switch, and aborts
+        (or asks for confirmation) if a forbidden unit would be restarted or stopped.
+      '';
+    };
+
+    roles = mkOption {
+      type = listOf str;
+      default = [];
+      description = ''
+        Names of roles from <literal>network.roles</literal> applied to this host.
+        The module, secrets and health checks of each role are merged into the host.
+      '';
+    };
+
+    agent = {
+      enable = mkOption {
+        type = bool;
+        default = false;
+        description = ''
+          Run the morph agent on the host, a service which morph sends the commands of a deployment
+          to over a single channel, instead of starting an SSH session (and sudo) for each of them.
+          It also reports the state of the host for <literal>morph agent-status</literal>.
+          The agent is only used with the built-in SSH client; morph falls back to plain SSH
+          if it can't be reached.
+        '';
+      };
+
+      socket = mkOption {
+        type = str;
+        default = "/run/morph-agent/agent.sock";
+        description = "Unix socket the agent listens on, which morph connects to through SSH.";
+      };
+
+      allowedUsers = mkOption {
+        type = listOf str;
+        default = [ (if config.deployment.targetUser != "" then config.deployment.targetUser else "root") ];
+        defaultText = "[ deployment.targetUser ], or [ \"root\" ]";
+        description = ''
+          Users allowed to send commands to the agent. They are added to the group of the socket, and the
+          agent checks the user connecting to it; connections are authenticated by SSH.
+        '';
+      };
+
+      sudoUsers = mkOption {
+        type = listOf str;
+        default = [];
+        example = [ "deploy" ];
+        description = ''
+          Allowed users whose commands using sudo the agent runs as root itself - without sudo, so
+          neither sudoers, <literal>privilegeEscalation</literal> nor sudo passwords apply to them.
+          Root may always do so. For other users, morph runs such commands with sudo over SSH.
+        '';
+      };
+
+      group = mkOption {
+        type = str;
+        default = "morph-agent";
+        description = "Group owning the socket of the agent; only the allowed users are members of it.";
+      };
+
+      package = mkOption {
+        type = package;
+        default = pkgs.morph;
+        defaultText = "pkgs.morph";
+        description = "The morph package providing the agent.";
+      };
+    };
   };
 
   # Creates a txt-file that lists all system healthcheck commands
   # The file will end up linked in /run/current-system along with
   # all derived dependencies.
+  config.systemd.services.morph-agent = mkIf config.deployment.agent.enable {
+    description = "morph agent";
+    wantedBy = [ "multi-user.target" ];
+    # restarting the agent would interrupt the activation it runs
+    restartIfChanged = false;
+    serviceConfig = {
+      ExecStart = "${config.deployment.agent.package}/bin/morph agent --socket ${escapeShellArg config.deployment.agent.socket}"
+        + " --group ${escapeShellArg config.deployment.agent.group}"
+        + concatMapStrings (user: " --allow-user ${escapeShellArg user}") config.deployment.agent.allowedUsers
+        + concatMapStrings (user: " --allow-sudo-user ${escapeShellArg user}") config.deployment.agent.sudoUsers;
+      # commands still running when the agent is stopped are left to finish
+      KillMode = "process";
+      Restart = "always";
+    };
+  };
+
+  config.users.groups = mkIf config.deployment.agent.enable {
+    ${config.deployment.agent.group}.members = filter (user: user != "root") config.deployment.agent.allowedUsers;
+  };
+
   config.system.extraDependencies =
   let
     cmds = concatMap (h: h.cmd) config.deployment.healthChecks.cmd;
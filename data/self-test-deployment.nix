@@ -0,0 +1,37 @@
+# The deployment `morph self-test` runs against the VM built by
+# self-test-vm.nix: it changes the configuration, uploads a secret and
+# checks the results with health checks.
+{ authorizedKey, port, secret }:
+
+{
+  network.description = "morph self-test";
+
+  vm = { ... }: {
+    imports = [ (import ./self-test-machine.nix { inherit authorizedKey; }) ];
+
+    environment.etc."morph-self-test".text = "deployed by morph";
+
+    deployment = {
+      targetHost = "127.0.0.1";
+      targetPort = port;
+      targetUser = "root";
+
+      secrets.self-test = {
+        source = secret;
+        destination = "/var/lib/morph-self-test/secret";
+        permissions = "0400";
+      };
+
+      healthChecks.cmd = [
+        {
+          cmd = [ "grep" "-q" "deployed by morph" "/etc/morph-self-test" ];
+          description = "New configuration is active";
+        }
+        {
+          cmd = [ "grep" "-q" "morph self-test secret" "/var/lib/morph-self-test/secret" ];
+          description = "Secret has been uploaded";
+        }
+      ];
+    };
+  };
+}
@@ -0,0 +1,20 @@
+# The machine used by `morph self-test`: a QEMU VM reachable over SSH as root.
+{ authorizedKey }:
+{ modulesPath, lib, ... }:
+
+{
+  imports = [ "${modulesPath}/virtualisation/qemu-vm.nix" ];
+
+  networking.hostName = "morph-self-test";
+
+  # pushing requires the store of the VM to be writable, instead of only
+  # sharing the store of the host
+  virtualisation.writableStore = true;
+  virtualisation.memorySize = lib.mkDefault 1024;
+
+  services.openssh.enable = true;
+  services.openssh.permitRootLogin = "prohibit-password";
+  users.users.root.openssh.authorizedKeys.keys = [ authorizedKey ];
+
+  documentation.enable = false;
+}
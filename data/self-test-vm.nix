@@ -0,0 +1,6 @@
+# Build the VM for `morph self-test`, which is deployed to afterwards.
+{ authorizedKey }:
+
+(import <nixpkgs/nixos/lib/eval-config.nix> {
+  modules = [ (import ./self-test-machine.nix { inherit authorizedKey; }) ];
+}).config.system.build.vm
@@ -29,12 +29,18 @@ in
           description = "Testing that 'true' works.";
         }];
 
+        systemd = [{
+          units = [ "nginx.service" ];
+          state = "active";
+        }];
+
         http = [
           {
             scheme = "http";
             port = 80;
             path = "/";
             description = "Check whether nginx is running.";
+            after = [ "nginx.service active" ]; # only check once the systemd check passed
             period = 1; # number of seconds between retries
           }
           {
@@ -43,8 +49,26 @@ in
             host = "some-other-host.example.com"; # defaults to the hostname of the host if unset
             path = "/health";
             description = "Check whether $imaginaryService is running.";
+            initialDelay = 10; # $imaginaryService takes a while to start
+            retries = 5; # fail after 6 attempts, instead of retrying until the timeout
           }
         ];
+
+        port = [{
+          port = 5432;
+          description = "Check whether PostgreSQL accepts connections.";
+          timeout = 2; # seconds to wait for the TCP connection
+          severity = "warning"; # report a failure, but carry on with the deployment
+          retries = 3;
+        }];
+
+        dns = [{
+          name = "web01.example.com";
+          type = "A";
+          queryTarget = true; # ask the DNS server running on this host
+          expect = [ "192.0.2.10" ];
+          description = "Check whether the local name server answers.";
+        }];
       };
     };
   };
@@ -0,0 +1,56 @@
+let
+  # Pin the deployment package-set to a specific version of nixpkgs
+  pkgs = import (builtins.fetchTarball {
+    url = "https://github.com/NixOS/nixpkgs-channels/archive/51d115ac89d676345b05a0694b23bd2691bf708a.tar.gz";
+    sha256 = "1gfjaa25nq4vprs13h30wasjxh79i67jj28v54lkj4ilqjhgh2rs";
+  }) {};
+
+  hardware = {
+    boot.loader.systemd-boot.enable = true;
+    boot.loader.efi.canTouchEfiVariables = true;
+
+    fileSystems = {
+        "/" = { label = "nixos"; fsType = "ext4"; };
+        "/boot" = { label = "boot"; fsType = "vfat"; };
+    };
+  };
+in
+{
+  network =  {
+    inherit pkgs;
+    description = "hosts sharing roles";
+
+    roles = {
+      web = {
+        module = { config, pkgs, ... }: {
+          services.nginx.enable = true;
+        };
+
+        healthChecks = {
+          http = [{
+            scheme = "http";
+            port = 80;
+            path = "/";
+            description = "Check whether nginx is running.";
+          }];
+        };
+
+        secrets = {
+          "nginx-tls-key" = {
+            source = "../secrets/tls.key";
+            destination = "/var/secrets/tls.key";
+            owner.user = "nginx";
+          };
+        };
+      };
+    };
+  };
+
+  "web01.example.com" = { config, pkgs, ... }: hardware // {
+    deployment.roles = [ "web" ];
+  };
+
+  "web02.example.com" = { config, pkgs, ... }: hardware // {
+    deployment.roles = [ "web" ];
+  };
+}
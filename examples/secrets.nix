@@ -22,6 +22,38 @@ in
           permissions = "0400"; # this is the default
           action = ["sudo" "systemctl" "reload" "nginx.service"];
         };
+
+        "database-password" = {
+          # decrypted locally with sops while uploading, the plaintext never ends up in the repository
+          sopsFile = "../secrets/production.yaml";
+          sopsExtract = ''["database"]["password"]'';
+          destination = "/var/secrets/database-password";
+        };
+
+        "api-token" = {
+          # age-encrypted, e.g. with agenix
+          source = "../secrets/api-token.age";
+          ageIdentity = "~/.ssh/id_ed25519";
+          destination = "/var/secrets/api-token";
+        };
+
+        "smtp-password" = {
+          # read from Vault at deploy time, using $VAULT_ADDR and $VAULT_TOKEN
+          vaultPath = "kv/data/mail#password";
+          destination = "/var/secrets/smtp-password";
+        };
+
+        "postgres-password" = {
+          # injected by CI through the environment of morph
+          fromEnv = "PGPASSWORD";
+          destination = "/var/secrets/postgres-password";
+        };
+
+        "grafana-admin-password" = {
+          # the output of the command is uploaded, e.g. read from a password manager
+          fromCommand = [ "op" "read" "op://infra/grafana/password" ];
+          destination = "/var/secrets/grafana-admin-password";
+        };
       };
     };
 
@@ -1,15 +1,79 @@
 package filter
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
 	"github.com/dbcdk/morph/nix"
 	"github.com/gobwas/glob"
+	"io"
+	"regexp"
+	"strings"
 )
 
-func MatchHosts(allHosts []nix.Host, pattern string) (hosts []nix.Host, err error) {
-	g := glob.MustCompile(pattern)
+// Select the hosts matching pattern, leaving out those matching any of the except patterns
+func MatchHosts(allHosts []nix.Host, pattern string, except ...string) (hosts []nix.Host, err error) {
+	g, err := glob.Compile(pattern)
+	if err != nil {
+		return hosts, errors.New(fmt.Sprintf("Invalid pattern %s: %s", pattern, err.Error()))
+	}
+
+	excluded := make([]glob.Glob, 0, len(except))
+	for _, exceptPattern := range except {
+		e, err := glob.Compile(exceptPattern)
+		if err != nil {
+			return hosts, errors.New(fmt.Sprintf("Invalid pattern %s: %s", exceptPattern, err.Error()))
+		}
+		excluded = append(excluded, e)
+	}
+
+hosts:
+	for _, host := range allHosts {
+		if !g.Match(host.Name) {
+			continue
+		}
+		for _, e := range excluded {
+			if e.Match(host.Name) {
+				continue hosts
+			}
+		}
+		hosts = append(hosts, host)
+	}
+
+	return
+}
+
+// Select the hosts matching any of the patterns - or, with intersect, all of them - in the order of the deployment
+func MatchHostsGlobs(allHosts []nix.Host, patterns []string, intersect bool, except ...string) (hosts []nix.Host, err error) {
+	matches := make(map[string]int)
+	for _, pattern := range patterns {
+		matching, err := MatchHosts(allHosts, pattern, except...)
+		if err != nil {
+			return hosts, err
+		}
+		for _, host := range matching {
+			matches[host.Name]++
+		}
+	}
+
+	for _, host := range allHosts {
+		if matches[host.Name] > 0 && (!intersect || matches[host.Name] == len(patterns)) {
+			hosts = append(hosts, host)
+		}
+	}
+
+	return
+}
+
+// Select the hosts whose whole name matches the regular expression, for names globs can't express
+func MatchHostsRegex(allHosts []nix.Host, expr string) (hosts []nix.Host, err error) {
+	r, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return hosts, errors.New(fmt.Sprintf("Invalid regular expression %s: %s", expr, err.Error()))
+	}
 
 	for _, host := range allHosts {
-		if g.Match(host.Name) {
+		if r.MatchString(host.Name) {
 			hosts = append(hosts, host)
 		}
 	}
@@ -17,6 +81,131 @@ func MatchHosts(allHosts []nix.Host, pattern string) (hosts []nix.Host, err erro
 	return
 }
 
+// Read a list of host names, one per line; empty lines and comments starting with # are ignored
+func ReadHostNames(r io.Reader) (names []string, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if name := strings.TrimSpace(line); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, scanner.Err()
+}
+
+// Select the hosts with exactly these names, in the order of the deployment
+func MatchHostNames(allHosts []nix.Host, names []string) (hosts []nix.Host) {
+	selected := make(map[string]bool)
+	for _, name := range names {
+		selected[name] = true
+	}
+
+	for _, host := range allHosts {
+		if selected[host.Name] {
+			hosts = append(hosts, host)
+		}
+	}
+
+	return
+}
+
+// The names which aren't the name of any of the hosts
+func UnmatchedNames(allHosts []nix.Host, names []string) (unmatched []string) {
+	for _, name := range names {
+		if len(MatchHostNames(allHosts, []string{name})) == 0 {
+			unmatched = append(unmatched, name)
+		}
+	}
+
+	return
+}
+
+// The alternatives of a pattern which don't match any of the hosts, e.g. misspelled names in "{web01,web02}"
+func UnmatchedPatterns(allHosts []nix.Host, pattern string) (unmatched []string) {
+	for _, alternative := range expandAlternatives(pattern) {
+		g, err := glob.Compile(alternative)
+		if err != nil {
+			continue
+		}
+		found := false
+		for _, host := range allHosts {
+			if g.Match(host.Name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unmatched = append(unmatched, alternative)
+		}
+	}
+
+	return
+}
+
+// Expand "{a,b}" groups of a glob into the patterns they stand for, e.g. "web{01,02}" into "web01" and "web02"
+func expandAlternatives(pattern string) []string {
+	start := strings.Index(pattern, "{")
+	if start < 0 {
+		return []string{pattern}
+	}
+
+	// find the matching closing brace, leaving nested groups for the recursion
+	depth, end := 0, -1
+	for i := start; i < len(pattern) && end < 0; i++ {
+		switch pattern[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				end = i
+			}
+		}
+	}
+	if end < 0 {
+		return []string{pattern}
+	}
+
+	var patterns []string
+	depth, from := 0, start+1
+	for i := start + 1; i <= end; i++ {
+		switch {
+		case pattern[i] == '{':
+			depth++
+		case pattern[i] == '}' && depth > 0:
+			depth--
+		case (pattern[i] == ',' && depth == 0) || i == end:
+			for _, rest := range expandAlternatives(pattern[from:i] + pattern[end+1:]) {
+				patterns = append(patterns, pattern[:start]+rest)
+			}
+			from = i + 1
+		}
+	}
+
+	return patterns
+}
+
+// The tags which none of the hosts have
+func UnmatchedTags(allHosts []nix.Host, selectedTags []string) (unmatched []string) {
+	for _, tag := range selectedTags {
+		found := false
+		for _, host := range allHosts {
+			if hasTag(host, tag) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unmatched = append(unmatched, tag)
+		}
+	}
+
+	return
+}
+
 func FilterHosts(allHosts []nix.Host, skip int, every int, limit int) (hosts []nix.Host) {
 	// skip first $skip hosts
 	if skip >= len(allHosts) {
@@ -70,6 +259,24 @@ func FilterHostsTags(allHosts []nix.Host, selectedTags []string) (hosts []nix.Ho
 	return
 }
 
+// Select the hosts having any of the tags, unlike FilterHostsTags requiring all of them
+func FilterHostsAnyTag(allHosts []nix.Host, anyTags []string) (hosts []nix.Host) {
+	if len(anyTags) == 0 {
+		return allHosts
+	}
+
+	for _, host := range allHosts {
+		for _, tag := range anyTags {
+			if hasTag(host, tag) {
+				hosts = append(hosts, host)
+				break
+			}
+		}
+	}
+
+	return
+}
+
 // Split a list of hosts into two lists based on whether the hosts contain af specific tag.
 func splitByTag(hosts []nix.Host, requiredTag string) (hostsWithTag []nix.Host, hostsWithoutTag []nix.Host) {
 	for _, host := range hosts {
@@ -112,3 +319,47 @@ func SortHosts(hosts []nix.Host, ordering nix.HostOrdering) (sortedHosts []nix.H
 
 	return
 }
+
+// Order hosts after the hosts they are to be deployed after (deployment.deployAfter), keeping the given order
+// otherwise. Dependencies on hosts not in the list are ignored.
+func SortByDependencies(hosts []nix.Host) (sortedHosts []nix.Host, err error) {
+	listed := make(map[string]bool)
+	for _, host := range hosts {
+		listed[host.Name] = true
+	}
+
+	// each time, the first host which isn't waiting for another one goes next
+	placed := make(map[string]bool)
+	remainingHosts := hosts
+	for len(remainingHosts) > 0 {
+		next := -1
+		for i, host := range remainingHosts {
+			ready := true
+			for _, dependency := range host.DeployAfter {
+				if listed[dependency] && !placed[dependency] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				next = i
+				break
+			}
+		}
+
+		if next < 0 {
+			names := make([]string, 0, len(remainingHosts))
+			for _, host := range remainingHosts {
+				names = append(names, host.Name)
+			}
+			return nil, errors.New(fmt.Sprintf("Hosts depend on each other through deployAfter: %s\n", strings.Join(names, ", ")))
+		}
+
+		host := remainingHosts[next]
+		sortedHosts = append(sortedHosts, host)
+		placed[host.Name] = true
+		remainingHosts = append(append([]nix.Host{}, remainingHosts[:next]...), remainingHosts[next+1:]...)
+	}
+
+	return sortedHosts, nil
+}
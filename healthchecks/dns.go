@@ -0,0 +1,162 @@
+package healthchecks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dbcdk/morph/utils"
+	"net"
+	"sort"
+	"strings"
+)
+
+type DnsHealthCheck struct {
+	Description string
+	Name        string
+	Type        string
+	// Address (host[:port]) of the resolver to query; nil means the resolver of the deploying machine
+	Server *string
+	// Query the DNS server on the target host itself
+	QueryTarget  bool
+	Expect       []string
+	Period       int
+	Timeout      int
+	Retries      *int
+	InitialDelay int
+	Severity     string
+	After        []string
+}
+
+func (healthCheck DnsHealthCheck) GetDescription() string {
+	return healthCheck.Description
+}
+
+func (healthCheck DnsHealthCheck) GetPeriod() int {
+	return healthCheck.Period
+}
+
+func (healthCheck DnsHealthCheck) GetRetries() *int {
+	return healthCheck.Retries
+}
+
+func (healthCheck DnsHealthCheck) GetInitialDelay() int {
+	return healthCheck.InitialDelay
+}
+
+func (healthCheck DnsHealthCheck) GetSeverity() string {
+	return healthCheck.Severity
+}
+
+func (healthCheck DnsHealthCheck) GetAfter() []string {
+	return healthCheck.After
+}
+
+func (healthCheck DnsHealthCheck) Run(host Host) error {
+	resolver := net.DefaultResolver
+
+	server := ""
+	if healthCheck.QueryTarget {
+		server = host.GetTargetHost()
+	} else if healthCheck.Server != nil {
+		server = *healthCheck.Server
+	}
+	if server != "" {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+		}
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				dialer := net.Dialer{}
+				return dialer.DialContext(ctx, network, server)
+			},
+		}
+	}
+
+	ctx, cancel := utils.ContextWithConditionalTimeout(context.TODO(), healthCheck.Timeout)
+	defer cancel()
+
+	records, err := lookup(ctx, resolver, strings.ToUpper(healthCheck.Type), healthCheck.Name)
+	if ctx.Err() != nil {
+		return errors.New(fmt.Sprintf("Health check error: Timeout after %ds", healthCheck.Timeout))
+	}
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return errors.New(fmt.Sprintf("No %s records found for %s", healthCheck.Type, healthCheck.Name))
+	}
+
+	var missing []string
+	for _, expected := range healthCheck.Expect {
+		if !containsRecord(records, expected) {
+			missing = append(missing, expected)
+		}
+	}
+	if len(missing) > 0 {
+		return errors.New(fmt.Sprintf("Expected %s records missing for %s: %s (got: %s)",
+			healthCheck.Type, healthCheck.Name, strings.Join(missing, ", "), strings.Join(records, ", ")))
+	}
+
+	return nil
+}
+
+func lookup(ctx context.Context, resolver *net.Resolver, recordType string, name string) (records []string, err error) {
+	switch recordType {
+	case "A", "AAAA":
+		addrs, err := resolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if (addr.IP.To4() != nil) == (recordType == "A") {
+				records = append(records, addr.IP.String())
+			}
+		}
+	case "CNAME":
+		cname, err := resolver.LookupCNAME(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, cname)
+	case "MX":
+		mxs, err := resolver.LookupMX(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, mx := range mxs {
+			records = append(records, mx.Host)
+		}
+	case "NS":
+		nss, err := resolver.LookupNS(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, ns := range nss {
+			records = append(records, ns.Host)
+		}
+	case "TXT":
+		records, err = resolver.LookupTXT(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("Unsupported DNS record type: %s", recordType))
+	}
+
+	sort.Strings(records)
+	return records, nil
+}
+
+// Compares records ignoring case and the trailing dot of fully qualified names
+func containsRecord(records []string, expected string) bool {
+	normalize := func(record string) string {
+		return strings.TrimSuffix(strings.ToLower(record), ".")
+	}
+	for _, record := range records {
+		if normalize(record) == normalize(expected) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,70 +1,291 @@
 package healthchecks
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"github.com/dbcdk/morph/logging"
 	"github.com/dbcdk/morph/ssh"
-	"os"
-	"sync"
+	"github.com/dbcdk/morph/utils"
+	"strings"
 	"time"
 )
 
-func Perform(sshContext *ssh.SSHContext, host Host, timeout int) (err error) {
-	fmt.Fprintf(os.Stderr, "Running healthchecks on %s (%s):\n", host.GetName(), host.GetTargetHost())
+func Perform(sshContext *ssh.SSHContext, host Host, timeout int) error {
+	_, err := PerformWithReport(sshContext, host, timeout)
+	return err
+}
+
+// Like Perform, returning the outcome of every check
+func PerformWithReport(sshContext *ssh.SSHContext, host Host, timeout int) (report *Report, err error) {
+	log := logging.WithHost(host.GetName())
+	log.Infof("Running healthchecks on %s (%s):\n", host.GetName(), host.GetTargetHost())
 
-	wg := sync.WaitGroup{}
+	checks := make([]HealthCheck, 0)
 	for _, healthCheck := range host.GetHealthChecks().Cmd {
-		wg.Add(1)
 		healthCheck.SshContext = sshContext
-		go runCheckUntilSuccess(host, healthCheck, &wg)
+		checks = append(checks, healthCheck)
 	}
 	for _, healthCheck := range host.GetHealthChecks().Http {
-		wg.Add(1)
-		go runCheckUntilSuccess(host, healthCheck, &wg)
+		checks = append(checks, healthCheck)
+	}
+	for _, healthCheck := range host.GetHealthChecks().Port {
+		checks = append(checks, healthCheck)
+	}
+	for _, healthCheck := range host.GetHealthChecks().Dns {
+		checks = append(checks, healthCheck)
+	}
+	for _, healthCheck := range host.GetHealthChecks().Systemd {
+		healthCheck.SshContext = sshContext
+		checks = append(checks, healthCheck)
+	}
+
+	dependencies, err := resolveDependencies(checks)
+	if err != nil {
+		return nil, err
 	}
 
-	doneChan := make(chan bool)
+	ctx, cancel := utils.ContextWithConditionalTimeout(context.TODO(), timeout)
+	defer cancel()
 
-	go func() {
-		wg.Wait()
-		doneChan <- true
-	}()
+	started := time.Now()
+	report = &Report{
+		Host:    host.GetName(),
+		Results: make([]Result, len(checks)),
+	}
+	for index, healthCheck := range checks {
+		report.Results[index] = Result{
+			Description: healthCheck.GetDescription(),
+			Severity:    severity(healthCheck),
+			Status:      StatusTimeout,
+		}
+	}
 
-	// send timeout signal eventually
-	timeoutChan := make(chan bool)
-	if timeout > 0 {
-		go func() {
-			time.Sleep(time.Duration(timeout) * time.Second)
-			timeoutChan <- true
-		}()
+	// run all health checks in parallel until they succeed, run out of retries, or the timeout is reached
+	type completed struct {
+		index  int
+		result Result
+	}
+	results := make(chan completed, len(checks))
+	// outcome of each check, to be read by dependent checks once its done channel is closed
+	outcomes := make([]Result, len(checks))
+	done := make([]chan struct{}, len(checks))
+	for index := range checks {
+		done[index] = make(chan struct{})
+	}
+	for index, healthCheck := range checks {
+		go func(index int, healthCheck HealthCheck) {
+			result := waitForDependencies(ctx, log, checks, dependencies[index], outcomes, done, healthCheck)
+			if result == nil {
+				outcome := runCheckUntilSuccess(ctx, log, host, healthCheck)
+				result = &outcome
+			}
+			outcomes[index] = *result
+			close(done[index])
+			results <- completed{index, *result}
+		}(index, healthCheck)
 	}
 
-	// run health checks until done or timeout reached. Failing health checks will add themself to the chan again
-	done := false
-	for !done {
+	// checks still running shortly after the deadline are reported as timed out, instead of waiting for them
+	deadline := ctx.Done()
+	var expired <-chan time.Time
+	for pending := len(checks); pending > 0; {
 		select {
-		case <-doneChan:
-			fmt.Fprintln(os.Stderr, "Health checks OK")
-			done = true
-		case <-timeoutChan:
-			fmt.Fprintf(os.Stderr, "Timeout: Gave up waiting for health checks to complete after %d seconds\n", timeout)
-			return errors.New("timeout running health checks")
+		case done := <-results:
+			report.Results[done.index] = done.result
+			pending--
+		case <-deadline:
+			// give checks returning because of the deadline the chance to report their attempts
+			deadline = nil
+			expired = time.After(time.Second)
+		case <-expired:
+			pending = 0
 		}
 	}
+	report.Seconds = time.Since(started).Seconds()
 
-	return nil
+	printReport(log, report)
+
+	failed, warnings := report.Failed()
+	if len(warnings) > 0 {
+		log.Warnf("Warning: %d non-blocking health check(s) failed: %s\n", len(warnings), strings.Join(warnings, ", "))
+	}
+	if len(failed) > 0 && ctx.Err() == context.DeadlineExceeded {
+		log.Errorf("Timeout: Gave up waiting for health checks to complete after %d seconds\n", timeout)
+		return report, errors.New("timeout running health checks")
+	}
+	if len(failed) > 0 {
+		if skipped := report.Skipped(); skipped > 0 {
+			return report, errors.New(fmt.Sprintf("%d health check(s) failed, %d skipped", len(failed)-skipped, skipped))
+		}
+		return report, errors.New(fmt.Sprintf("%d health check(s) failed", len(failed)))
+	}
+
+	if len(warnings) > 0 {
+		log.Infof("Health checks OK, with warnings\n")
+	} else {
+		log.Infof("Health checks OK\n")
+	}
+	return report, nil
 }
 
-func runCheckUntilSuccess(host Host, healthCheck HealthCheck, wg *sync.WaitGroup) {
+func runCheckUntilSuccess(ctx context.Context, log *logging.Logger, host Host, healthCheck HealthCheck) (result Result) {
+	started := time.Now()
+	result = Result{
+		Description: healthCheck.GetDescription(),
+		Severity:    severity(healthCheck),
+	}
+	finish := func(status string, err error) Result {
+		result.Status = status
+		result.Seconds = time.Since(started).Seconds()
+		if err != nil {
+			result.Error = err.Error()
+		}
+		return result
+	}
+
+	// give slow-starting services a head start, instead of counting their start-up as failed attempts
+	if err := sleep(ctx, healthCheck.GetInitialDelay()); err != nil {
+		return finish(StatusTimeout, err)
+	}
+
 	for {
+		result.Attempts++
 		err := healthCheck.Run(host)
 		if err == nil {
-			fmt.Fprintf(os.Stderr, "\t* %s: OK\n", healthCheck.GetDescription())
-			break
-		} else {
-			fmt.Fprintf(os.Stderr, "\t* %s: Failed (%s)\n", healthCheck.GetDescription(), err)
-			time.Sleep(time.Duration(healthCheck.GetPeriod()) * time.Second)
+			log.Infof("\t* %s: OK\n", healthCheck.GetDescription())
+			return finish(StatusOK, nil)
+		}
+		log.Infof("\t* %s: Failed (%s)\n", healthCheck.GetDescription(), err)
+
+		if retries := healthCheck.GetRetries(); retries != nil && result.Attempts > *retries {
+			if healthCheck.GetSeverity() == SeverityWarning {
+				log.Warnf("\t* %s: Giving up after %d attempt(s)\n", healthCheck.GetDescription(), result.Attempts)
+			} else {
+				log.Errorf("\t* %s: Giving up after %d attempt(s)\n", healthCheck.GetDescription(), result.Attempts)
+			}
+			return finish(StatusFailed, err)
+		}
+
+		if sleepErr := sleep(ctx, healthCheck.GetPeriod()); sleepErr != nil {
+			return finish(StatusTimeout, err)
+		}
+	}
+}
+
+// Indices of the checks each check depends on, by description
+func resolveDependencies(checks []HealthCheck) ([][]int, error) {
+	byDescription := make(map[string][]int)
+	for index, healthCheck := range checks {
+		byDescription[healthCheck.GetDescription()] = append(byDescription[healthCheck.GetDescription()], index)
+	}
+
+	dependencies := make([][]int, len(checks))
+	for index, healthCheck := range checks {
+		for _, after := range healthCheck.GetAfter() {
+			indices, ok := byDescription[after]
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("Health check \"%s\" is to run after unknown health check \"%s\"", healthCheck.GetDescription(), after))
+			}
+			dependencies[index] = append(dependencies[index], indices...)
+		}
+	}
+
+	// checks depending on each other would wait for each other until the timeout
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(checks))
+	var visit func(index int) error
+	visit = func(index int) error {
+		switch state[index] {
+		case visiting:
+			return errors.New(fmt.Sprintf("Health check \"%s\" depends on itself through its after option", checks[index].GetDescription()))
+		case visited:
+			return nil
+		}
+		state[index] = visiting
+		for _, dependency := range dependencies[index] {
+			if err := visit(dependency); err != nil {
+				return err
+			}
+		}
+		state[index] = visited
+		return nil
+	}
+	for index := range checks {
+		if err := visit(index); err != nil {
+			return nil, err
+		}
+	}
+
+	return dependencies, nil
+}
+
+// Wait until the dependencies of a check passed; returns the result of the check if it can't be run
+func waitForDependencies(ctx context.Context, log *logging.Logger, checks []HealthCheck, dependencies []int, outcomes []Result, done []chan struct{}, healthCheck HealthCheck) *Result {
+	for _, dependency := range dependencies {
+		select {
+		case <-done[dependency]:
+			if outcomes[dependency].Status == StatusOK {
+				continue
+			}
+			reason := fmt.Sprintf("%s didn't pass", checks[dependency].GetDescription())
+			log.Infof("\t* %s: Skipped (%s)\n", healthCheck.GetDescription(), reason)
+			return &Result{
+				Description: healthCheck.GetDescription(),
+				Severity:    severity(healthCheck),
+				Status:      StatusSkipped,
+				Error:       reason,
+			}
+		case <-ctx.Done():
+			return &Result{
+				Description: healthCheck.GetDescription(),
+				Severity:    severity(healthCheck),
+				Status:      StatusTimeout,
+			}
+		}
+	}
+	return nil
+}
+
+// Print the outcome of every check of a host in one place, as the output of parallel checks is interleaved
+func printReport(log *logging.Logger, report *Report) {
+	if len(report.Results) == 0 {
+		return
+	}
+	log.Infof("Health check results (%.1fs):\n", report.Seconds)
+	for _, result := range report.Results {
+		status := strings.ToUpper(result.Status)
+		if result.Status != StatusOK && result.Severity == SeverityWarning {
+			status = "WARNING"
+		}
+		line := fmt.Sprintf("\t%-8s %s (%d attempt(s), %.1fs)", status, result.Description, result.Attempts, result.Seconds)
+		if result.Error != "" {
+			line += ": " + result.Error
 		}
+		log.Infof("%s\n", line)
+	}
+}
+
+func severity(healthCheck HealthCheck) string {
+	if healthCheck.GetSeverity() == "" {
+		return SeverityError
+	}
+	return healthCheck.GetSeverity()
+}
+
+func sleep(ctx context.Context, seconds int) error {
+	if seconds <= 0 {
+		return ctx.Err()
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Duration(seconds) * time.Second):
+		return nil
 	}
-	wg.Done()
 }
@@ -0,0 +1,50 @@
+package healthchecks
+
+const (
+	StatusOK      = "ok"
+	StatusFailed  = "failed"
+	StatusTimeout = "timeout"
+	// Not run, as a check it is to run after didn't pass
+	StatusSkipped = "skipped"
+)
+
+// Outcome of the health checks of a host
+type Report struct {
+	Host    string   `json:"host"`
+	Seconds float64  `json:"seconds"`
+	Results []Result `json:"results"`
+}
+
+type Result struct {
+	Description string  `json:"description"`
+	Severity    string  `json:"severity"`
+	Status      string  `json:"status"`
+	Attempts    int     `json:"attempts"`
+	Seconds     float64 `json:"seconds"`
+	Error       string  `json:"error,omitempty"`
+}
+
+// Descriptions of the checks which didn't succeed, by severity
+func (report *Report) Failed() (failed []string, warnings []string) {
+	for _, result := range report.Results {
+		if result.Status == StatusOK {
+			continue
+		}
+		if result.Severity == SeverityWarning {
+			warnings = append(warnings, result.Description)
+		} else {
+			failed = append(failed, result.Description)
+		}
+	}
+	return failed, warnings
+}
+
+// Number of (deployment-blocking) checks not run because a check they are to run after didn't pass
+func (report *Report) Skipped() (skipped int) {
+	for _, result := range report.Results {
+		if result.Status == StatusSkipped && result.Severity != SeverityWarning {
+			skipped++
+		}
+	}
+	return skipped
+}
@@ -0,0 +1,80 @@
+package healthchecks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dbcdk/morph/ssh"
+	"github.com/dbcdk/morph/utils"
+	"strings"
+)
+
+type SystemdHealthCheck struct {
+	SshContext  *ssh.SSHContext
+	Description string
+	Units       []string
+	// Expected state of all units as reported by systemctl is-active, e.g. active or failed
+	State        string
+	Period       int
+	Timeout      int
+	Retries      *int
+	InitialDelay int
+	Severity     string
+	After        []string
+}
+
+func (healthCheck SystemdHealthCheck) GetDescription() string {
+	return healthCheck.Description
+}
+
+func (healthCheck SystemdHealthCheck) GetPeriod() int {
+	return healthCheck.Period
+}
+
+func (healthCheck SystemdHealthCheck) GetRetries() *int {
+	return healthCheck.Retries
+}
+
+func (healthCheck SystemdHealthCheck) GetInitialDelay() int {
+	return healthCheck.InitialDelay
+}
+
+func (healthCheck SystemdHealthCheck) GetSeverity() string {
+	return healthCheck.Severity
+}
+
+func (healthCheck SystemdHealthCheck) GetAfter() []string {
+	return healthCheck.After
+}
+
+func (healthCheck SystemdHealthCheck) Run(host Host) error {
+	ctx, cancel := utils.ContextWithConditionalTimeout(context.TODO(), healthCheck.Timeout)
+	defer cancel()
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	cmd := append([]string{"systemctl", "is-active", "--"}, healthCheck.Units...)
+	// the exit code only tells whether any unit is active, so the state of each unit is read from the output instead
+	healthCheck.SshContext.RunContext(ctx, host, nil, &stdout, &stderr, cmd...)
+	if ctx.Err() != nil {
+		return errors.New(fmt.Sprintf("Health check error: Timeout after %ds", healthCheck.Timeout))
+	}
+
+	states := strings.Fields(stdout.String())
+	if len(states) != len(healthCheck.Units) {
+		return errors.New(fmt.Sprintf("Health check error: %s", strings.TrimSpace(stdout.String()+stderr.String())))
+	}
+
+	unexpected := make([]string, 0)
+	for index, unit := range healthCheck.Units {
+		if states[index] != healthCheck.State {
+			unexpected = append(unexpected, fmt.Sprintf("%s is %s", unit, states[index]))
+		}
+	}
+	if len(unexpected) > 0 {
+		return errors.New(fmt.Sprintf("Expected %s: %s", healthCheck.State, strings.Join(unexpected, ", ")))
+	}
+
+	return nil
+}
@@ -1,13 +1,16 @@
 package healthchecks
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/dbcdk/morph/ssh"
 	"github.com/dbcdk/morph/utils"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -16,37 +19,75 @@ type Host interface {
 	GetName() string
 	GetTargetHost() string
 	GetTargetUser() string
+	GetTargetPort() int
 	GetHealthChecks() HealthChecks
 }
 
 type HealthChecks struct {
-	Http []HttpHealthCheck
-	Cmd  []CmdHealthCheck
+	Http    []HttpHealthCheck
+	Cmd     []CmdHealthCheck
+	Port    []PortHealthCheck
+	Dns     []DnsHealthCheck
+	Systemd []SystemdHealthCheck
 }
 
 type CmdHealthCheck struct {
-	SshContext  *ssh.SSHContext
-	Description string
-	Cmd         []string
-	Period      int
-	Timeout     int
+	SshContext   *ssh.SSHContext
+	Description  string
+	Cmd          []string
+	Period       int
+	Timeout      int
+	Retries      *int
+	InitialDelay int
+	Severity     string
+	After        []string
 }
 
 type HttpHealthCheck struct {
-	Description string
-	Headers     map[string]string
-	Host        *string
-	InsecureSSL bool
-	Path        string
-	Port        int
-	Scheme      string
-	Period      int
-	Timeout     int
+	Description  string
+	Headers      map[string]string
+	Host         *string
+	InsecureSSL  bool
+	Path         string
+	Port         int
+	Scheme       string
+	Period       int
+	Timeout      int
+	Retries      *int
+	InitialDelay int
+	Severity     string
+	After        []string
 }
 
+type PortHealthCheck struct {
+	Description  string
+	Host         *string
+	Port         int
+	Period       int
+	Timeout      int
+	Retries      *int
+	InitialDelay int
+	Severity     string
+	After        []string
+}
+
+const (
+	// Failing checks fail the deployment
+	SeverityError = "error"
+	// Failing checks are reported, but don't fail the deployment
+	SeverityWarning = "warning"
+)
+
 type HealthCheck interface {
 	GetDescription() string
 	GetPeriod() int
+	// How often to retry a failing check; nil means until the health check timeout is reached
+	GetRetries() *int
+	GetInitialDelay() int
+	// Either SeverityError or SeverityWarning
+	GetSeverity() string
+	// Descriptions of the checks that must pass before this check is run
+	GetAfter() []string
 	Run(Host) error
 }
 
@@ -58,22 +99,34 @@ func (healthCheck CmdHealthCheck) GetPeriod() int {
 	return healthCheck.Period
 }
 
+func (healthCheck CmdHealthCheck) GetRetries() *int {
+	return healthCheck.Retries
+}
+
+func (healthCheck CmdHealthCheck) GetInitialDelay() int {
+	return healthCheck.InitialDelay
+}
+
+func (healthCheck CmdHealthCheck) GetSeverity() string {
+	return healthCheck.Severity
+}
+
+func (healthCheck CmdHealthCheck) GetAfter() []string {
+	return healthCheck.After
+}
+
 func (healthCheck CmdHealthCheck) Run(host Host) error {
 	ctx, cancel := utils.ContextWithConditionalTimeout(context.TODO(), healthCheck.Timeout)
 	defer cancel()
 
-	cmd, err := healthCheck.SshContext.CmdContext(ctx, host, healthCheck.Cmd...)
-	if err != nil {
-		errorMessage := fmt.Sprintf("Health check error: %s", err.Error())
-		return errors.New(errorMessage)
-	}
-	data, err := cmd.CombinedOutput()
+	var data bytes.Buffer
+	err := healthCheck.SshContext.RunContext(ctx, host, nil, &data, &data, healthCheck.Cmd...)
 	if ctx.Err() != nil {
 		errorMessage := fmt.Sprintf("Health check error: Timeout after %ds", healthCheck.Timeout)
 		return errors.New(errorMessage)
 	}
 	if err != nil {
-		errorMessage := fmt.Sprintf("Health check error: %s", string(data))
+		errorMessage := fmt.Sprintf("Health check error: %s", data.String())
 		return errors.New(errorMessage)
 	}
 
@@ -89,6 +142,22 @@ func (healthCheck HttpHealthCheck) GetPeriod() int {
 	return healthCheck.Period
 }
 
+func (healthCheck HttpHealthCheck) GetRetries() *int {
+	return healthCheck.Retries
+}
+
+func (healthCheck HttpHealthCheck) GetInitialDelay() int {
+	return healthCheck.InitialDelay
+}
+
+func (healthCheck HttpHealthCheck) GetSeverity() string {
+	return healthCheck.Severity
+}
+
+func (healthCheck HttpHealthCheck) GetAfter() []string {
+	return healthCheck.After
+}
+
 func (healthCheck HttpHealthCheck) Run(host Host) error {
 	// use the hosts hostname if the healthCheck host is not set
 	if healthCheck.Host == nil {
@@ -111,7 +180,8 @@ func (healthCheck HttpHealthCheck) Run(host Host) error {
 		Transport: transport,
 	}
 
-	url := fmt.Sprintf("%s://%s:%d%s", healthCheck.Scheme, *healthCheck.Host, healthCheck.Port, healthCheck.Path)
+	address := net.JoinHostPort(strings.Trim(*healthCheck.Host, "[]"), strconv.Itoa(healthCheck.Port))
+	url := fmt.Sprintf("%s://%s%s", healthCheck.Scheme, address, healthCheck.Path)
 	req, err := http.NewRequest("GET", url, nil)
 
 	for headerKey, headerValue := range healthCheck.Headers {
@@ -136,3 +206,44 @@ func (healthCheck HttpHealthCheck) Run(host Host) error {
 		return errors.New(fmt.Sprintf("Got non 2xx status code (%s)", resp.Status))
 	}
 }
+
+func (healthCheck PortHealthCheck) GetDescription() string {
+	return healthCheck.Description
+}
+
+func (healthCheck PortHealthCheck) GetPeriod() int {
+	return healthCheck.Period
+}
+
+func (healthCheck PortHealthCheck) GetRetries() *int {
+	return healthCheck.Retries
+}
+
+func (healthCheck PortHealthCheck) GetInitialDelay() int {
+	return healthCheck.InitialDelay
+}
+
+func (healthCheck PortHealthCheck) GetSeverity() string {
+	return healthCheck.Severity
+}
+
+func (healthCheck PortHealthCheck) GetAfter() []string {
+	return healthCheck.After
+}
+
+func (healthCheck PortHealthCheck) Run(host Host) error {
+	// use the hosts hostname if the healthCheck host is not set
+	hostname := host.GetTargetHost()
+	if healthCheck.Host != nil {
+		hostname = *healthCheck.Host
+	}
+
+	address := net.JoinHostPort(strings.Trim(hostname, "[]"), strconv.Itoa(healthCheck.Port))
+	conn, err := net.DialTimeout("tcp", address, time.Duration(healthCheck.Timeout)*time.Second)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Couldn't connect to %s: %s", address, err.Error()))
+	}
+	conn.Close()
+
+	return nil
+}
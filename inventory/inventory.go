@@ -0,0 +1,122 @@
+package inventory
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The hosts of a deployment, for tools which don't read morph deployments (Ansible, spreadsheets, monitoring, ..)
+type Host struct {
+	Name         string   `json:"name"`
+	TargetHost   string   `json:"targetHost"`
+	TargetUser   string   `json:"targetUser,omitempty"`
+	TargetPort   int      `json:"targetPort,omitempty"`
+	Environment  string   `json:"environment,omitempty"`
+	Tags         []string `json:"tags"`
+	Roles        []string `json:"roles"`
+	NixosRelease string   `json:"nixosRelease,omitempty"`
+}
+
+var Formats = []string{"ansible", "json", "csv"}
+
+func Write(out io.Writer, format string, hosts []Host) error {
+	switch format {
+	case "ansible":
+		return WriteAnsible(out, hosts)
+	case "json":
+		return WriteJson(out, hosts)
+	case "csv":
+		return WriteCsv(out, hosts)
+	default:
+		return errors.New(fmt.Sprintf("Unknown inventory format: %s", format))
+	}
+}
+
+func WriteJson(out io.Writer, hosts []Host) error {
+	data, err := json.MarshalIndent(hosts, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "%s\n", data)
+	return err
+}
+
+// One row per host; tags and roles are separated by spaces
+func WriteCsv(out io.Writer, hosts []Host) error {
+	writer := csv.NewWriter(out)
+	writer.Write([]string{"name", "targetHost", "targetUser", "targetPort", "environment", "tags", "roles", "nixosRelease"})
+	for _, host := range hosts {
+		port := ""
+		if host.TargetPort != 0 {
+			port = strconv.Itoa(host.TargetPort)
+		}
+		writer.Write([]string{
+			host.Name,
+			host.TargetHost,
+			host.TargetUser,
+			port,
+			host.Environment,
+			strings.Join(host.Tags, " "),
+			strings.Join(host.Roles, " "),
+			host.NixosRelease,
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+var invalidGroupChars = regexp.MustCompile("[^A-Za-z0-9_]")
+
+// Ansible inventory in INI format, with groups for every tag (tag_*), environment (env_*) and role (role_*)
+func WriteAnsible(out io.Writer, hosts []Host) error {
+	var s strings.Builder
+
+	groups := make(map[string][]string)
+	addToGroup := func(prefix string, name string, host string) {
+		group := prefix + "_" + invalidGroupChars.ReplaceAllString(name, "_")
+		groups[group] = append(groups[group], host)
+	}
+
+	s.WriteString("[all]\n")
+	for _, host := range hosts {
+		s.WriteString(host.Name)
+		fmt.Fprintf(&s, " ansible_host=%s", host.TargetHost)
+		if host.TargetUser != "" {
+			fmt.Fprintf(&s, " ansible_user=%s", host.TargetUser)
+		}
+		if host.TargetPort != 0 {
+			fmt.Fprintf(&s, " ansible_port=%d", host.TargetPort)
+		}
+		if host.Environment != "" {
+			fmt.Fprintf(&s, " morph_environment=%s", host.Environment)
+			addToGroup("env", host.Environment, host.Name)
+		}
+		s.WriteString("\n")
+
+		for _, tag := range host.Tags {
+			addToGroup("tag", tag, host.Name)
+		}
+		for _, role := range host.Roles {
+			addToGroup("role", role, host.Name)
+		}
+	}
+
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&s, "\n[%s]\n%s\n", name, strings.Join(groups[name], "\n"))
+	}
+
+	_, err := io.WriteString(out, s.String())
+	return err
+}
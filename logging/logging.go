@@ -0,0 +1,207 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	DebugLevel Level = iota
+	VerboseLevel
+	InfoLevel
+	WarningLevel
+	ErrorLevel
+)
+
+var (
+	// Messages below this level are discarded
+	Threshold = InfoLevel
+	// Prefix every line with the time it was logged at
+	Timestamps           = false
+	Output     io.Writer = os.Stderr
+
+	mutex       sync.Mutex
+	atLineStart = true
+	// The fields of the logger which left the current line open, and those of loggers whose line was ended by
+	// another logger, which continue on a line of their own
+	openFields  string
+	interrupted = make(map[string]bool)
+	std         = &Logger{}
+	redacted    []string
+)
+
+type field struct {
+	key   string
+	value string
+}
+
+// A Logger adds context fields (e.g. the host a message relates to) to every line it writes.
+// Messages without a trailing newline are continued by the next message of a logger with the same
+// fields, which allows for progress output like "Pushing .. " followed by "OK".
+type Logger struct {
+	fields []field
+}
+
+func WithHost(name string) *Logger {
+	return std.With("host", name)
+}
+
+func (l *Logger) With(key string, value string) *Logger {
+	fields := make([]field, len(l.fields), len(l.fields)+1)
+	copy(fields, l.fields)
+	return &Logger{fields: append(fields, field{key, value})}
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.log(DebugLevel, format, args...)
+}
+
+func (l *Logger) Verbosef(format string, args ...interface{}) {
+	l.log(VerboseLevel, format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log(InfoLevel, format, args...)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.log(WarningLevel, format, args...)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.log(ErrorLevel, format, args...)
+}
+
+// End a progress line started at info level with "Failed", at error level so failures aren't hidden by a higher
+// threshold; when the start of the line was discarded, what failed is told instead (e.g. "to push")
+func (l *Logger) Failed(what string) {
+	if Enabled(InfoLevel) {
+		l.Errorf("Failed\n")
+	} else {
+		l.Errorf("Failed %s\n", what)
+	}
+}
+
+func Debugf(format string, args ...interface{}) {
+	std.log(DebugLevel, format, args...)
+}
+
+func Verbosef(format string, args ...interface{}) {
+	std.log(VerboseLevel, format, args...)
+}
+
+func Infof(format string, args ...interface{}) {
+	std.log(InfoLevel, format, args...)
+}
+
+func Warnf(format string, args ...interface{}) {
+	std.log(WarningLevel, format, args...)
+}
+
+func Errorf(format string, args ...interface{}) {
+	std.log(ErrorLevel, format, args...)
+}
+
+func Failed(what string) {
+	std.Failed(what)
+}
+
+// Replace the value (e.g. the content of a secret) with a placeholder in all messages logged from now on
+func Redact(value string) {
+	if value == "" {
+		return
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	redacted = append(redacted, value)
+}
+
+func Enabled(level Level) bool {
+	return level >= Threshold
+}
+
+func (l *Logger) log(level Level, format string, args ...interface{}) {
+	if !Enabled(level) {
+		return
+	}
+
+	message := format
+	if len(args) > 0 {
+		message = fmt.Sprintf(format, args...)
+	}
+	if message == "" {
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for _, value := range redacted {
+		message = strings.Replace(message, value, "[redacted]", -1)
+	}
+
+	// hosts are deployed to in parallel, so the open line of one host mustn't be continued by another
+	var out strings.Builder
+	fields := l.fieldsKey()
+	if !atLineStart && fields != openFields {
+		out.WriteString("\n")
+		interrupted[openFields] = true
+		atLineStart = true
+	}
+
+	lines := strings.SplitAfter(message, "\n")
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		if atLineStart {
+			out.WriteString(l.prefix())
+			if interrupted[fields] {
+				out.WriteString("... ")
+				delete(interrupted, fields)
+			}
+		}
+		out.WriteString(line)
+		atLineStart = strings.HasSuffix(line, "\n")
+	}
+	openFields = fields
+
+	io.WriteString(Output, out.String())
+}
+
+func (l *Logger) fieldsKey() string {
+	parts := make([]string, 0, len(l.fields))
+	for _, f := range l.fields {
+		parts = append(parts, f.key+"="+f.value)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (l *Logger) prefix() string {
+	var prefix strings.Builder
+
+	if Timestamps {
+		prefix.WriteString(time.Now().Format(time.RFC3339))
+		prefix.WriteString(" ")
+	}
+
+	if len(l.fields) > 0 {
+		parts := make([]string, 0, len(l.fields))
+		for _, f := range l.fields {
+			if f.key == "host" {
+				parts = append(parts, f.value)
+			} else {
+				parts = append(parts, f.key+"="+f.value)
+			}
+		}
+		prefix.WriteString("[" + strings.Join(parts, " ") + "] ")
+	}
+
+	return prefix.String()
+}
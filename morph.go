@@ -1,20 +1,36 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/dbcdk/kingpin"
+	"github.com/dbcdk/morph/agent"
 	"github.com/dbcdk/morph/assets"
 	"github.com/dbcdk/morph/filter"
 	"github.com/dbcdk/morph/healthchecks"
+	"github.com/dbcdk/morph/inventory"
+	"github.com/dbcdk/morph/logging"
 	"github.com/dbcdk/morph/nix"
+	"github.com/dbcdk/morph/notify"
+	"github.com/dbcdk/morph/report"
 	"github.com/dbcdk/morph/secrets"
+	"github.com/dbcdk/morph/selftest"
 	"github.com/dbcdk/morph/ssh"
 	"github.com/dbcdk/morph/utils"
+	"io"
+	"io/ioutil"
 	"os"
+	"os/exec"
+	"os/user"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // This is set at build time via -ldflags magic
@@ -24,36 +40,129 @@ var switchActions = []string{"dry-activate", "test", "switch", "boot"}
 var (
 	app                 = kingpin.New("morph", "NixOS host manager").Version(version)
 	dryRun              = app.Flag("dry-run", "Don't do anything, just eval and print changes").Default("False").Bool()
-	selectGlob          string
+	selectGlobs         []string
+	selectIntersect     bool
+	secretsHistoryHost  string
 	selectTags          string
+	selectAnyTags       []string
+	selectExcept        []string
+	selectRegex         string
+	selectFile          string
+	selectNames         []string
 	selectEvery         int
 	selectSkip          int
 	selectLimit         int
 	orderingTags        string
+	ignoreMissing       bool
+	onlyEnvironments    []string
+	forbidEnvironments  []string
+	overrideTargetHost  string
+	overrideTargetUser  string
+	deployLocal         bool
 	deployment          string
 	timeout             int
 	askForSudoPasswd    bool
+	repromptSudoPasswd  bool
+	sudoPasswdFile      string
+	sudoPasswdEnv       string
+	sudoCredentials     string
 	nixBuildArg         []string
 	nixBuildTarget      string
 	nixBuildTargetFile  string
+	binaryCaches        []string
+	useSubstitutes      bool
+	signingKeyFile      string
+	buildMaxJobs        string
+	buildCores          string
 	build               = buildCmd(app.Command("build", "Evaluate and build deployment configuration to the local Nix store"))
 	push                = pushCmd(app.Command("push", "Build and transfer items from the local Nix store to target machines"))
 	deploy              = deployCmd(app.Command("deploy", "Build, push and activate new configuration on machines according to switch-action"))
 	deploySwitchAction  string
 	deployUploadSecrets bool
 	deployReboot        bool
+	deployKexec         bool
+	magicRollback       int
+	deployAt            string
+	deployDelay         time.Duration
+	deployShowDiff      bool
+	deployConfirm       bool
+	deployYes           bool
+	deployChangelog     string
+	deployStepOrder     string
+	skipDeploySteps     []string
+	maxUnavailable      string
+	deployResume        bool
+	resumeState         *report.Resume
 	skipHealthChecks    bool
+	ignoreHostSkips     bool
 	showTrace           bool
 	healthCheck         = healthCheckCmd(app.Command("check-health", "Run health checks"))
 	uploadSecrets       = uploadSecretsCmd(app.Command("upload-secrets", "Upload secrets"))
 	listSecrets         = listSecretsCmd(app.Command("list-secrets", "List secrets"))
+	auditSecrets        = auditSecretsCmd(app.Command("audit-secrets", "Report secrets with unsafe permissions, ownership or location on the target machines"))
+	secretsCmd          = app.Command("secrets", "Inspect the secrets uploaded to the target machines")
+	secretsHistory      = secretsHistoryCmd(secretsCmd.Command("history", "Show the versions of secrets uploaded to a host"))
 	asJson              bool
+	migrateHost         = migrateHostCmd(app.Command("migrate-host", "Move a host to a new target address, e.g. after replacing its hardware"))
+	migrateOld          string
+	migrateNew          string
+	migrateHostKey      string
+	migrateAcceptKey    bool
+	migrateSkipState    bool
+	selfTest            = selfTestCmd(app.Command("self-test", "Deploy to a throwaway NixOS VM in QEMU, to verify that morph works with the local nix setup"))
+	exportInventory     = exportInventoryCmd(app.Command("export-inventory", "Export the hosts of the deployment as an inventory for other tools"))
+	inventoryFormat     string
+	agentCmd            = agentCommand(app.Command("agent", "Run the morph agent on a target host (started by deployment.agent.enable)"))
+	agentSocket         string
+	agentAllowedUsers   []string
+	agentSudoUsers      []string
+	agentGroup          string
+	agentStatus         = agentStatusCmd(app.Command("agent-status", "Show the state of hosts as reported by their morph agents"))
+	docOptions          = docOptionsCmd(app.Command("doc-options", "Show documentation of the deployment options supported by morph"))
+	compareRuns         = compareRunsCmd(app.Command("compare-runs", "Compare two recorded runs: system changes, rotated secrets and slower hosts"))
+	compareFrom         string
+	compareTo           string
+	compareThreshold    float64
+	install             = installCmd(app.Command("install", "Install NixOS on fresh hosts booted into an installer, partitioning their disks with disko"))
+	installFormat       bool
+	installReboot       bool
+	installYes          bool
+	listGenerations     = listGenerationsCmd(app.Command("list-generations", "List the generations of the system profile on hosts, e.g. before a rollback"))
+	rollback            = rollbackCmd(app.Command("rollback", "Switch hosts back to the previous generation of their system profile"))
+	deploymentStatus    = statusCmd(app.Command("status", "Show what was last deployed to each host, according to the recorded deployments"))
+	clean               = cleanCmd(app.Command("clean", "Remove old build results kept by --keep-result, allowing them to be garbage collected"))
+	cleanKeep           int
 	execute             = executeCmd(app.Command("exec", "Execute arbitrary commands on machines"))
 	executeCommand      []string
-	keepGCRoot          = app.Flag("keep-result", "Keep latest build in .gcroots to prevent it from being garbage collected").Default("False").Bool()
+	executeSudo         bool
+	executeDiff         bool
+	keepGCRoot          = app.Flag("keep-result", "Keep each build in .gcroots to prevent it from being garbage collected until removed by `morph clean`").Default("False").Bool()
 	allowBuildShell     = app.Flag("allow-build-shell", "Allow using `network.buildShell` to build in a nix-shell which can execute arbitrary commands on the local system").Default("False").Bool()
-
-	assetRoot string
+	runsDir             = app.Flag("runs-dir", "Directory to store the manifests of push, deploy, rollback, check-health and upload-secrets runs in, for compare-runs").Default(report.DefaultDir()).String()
+	outputFormat        = app.Flag("output", "Format of the output written to stdout: text, or json for a machine-readable summary of the run").Default("text").Enum("text", "json")
+	retries             = app.Flag("retries", "How often to retry pushing, uploading secrets and activating on a host after transient failures, like a dropped connection").Default("2").Int()
+	retryDelay          = app.Flag("retry-delay", "Delay before the first retry, doubling for every further retry").Default("2s").Duration()
+	nixBackend          = app.Flag("nix-backend", "The nix tools to build and copy with: legacy (nix-build, nix copy over ssh://) or nix (nix build with structured progress, nix copy over ssh-ng://)").Default(nix.BackendLegacy).Enum(nix.Backends...)
+	evalCache           = app.Flag("eval-cache", "Reuse the evaluation of the deployment from an earlier run while the files it evaluated, the files next to it, the nix search path and the arguments are unchanged").Default("False").Bool()
+	extraNixArgs        = app.Flag("nix-arg", "Pass an argument on to the nix commands evaluating and building the deployment, e.g. --nix-arg=--keep-going (may be repeated)").Strings()
+	extraNixOptions     = app.Flag("nix-option", "Set a nix option for evaluating and building the deployment, like --option of nix-build (may be repeated)").PlaceHolder("NAME=VALUE").StringMap()
+	includePaths        = app.Flag("include-path", "Add a path to the nix search path used when evaluating and building, like the -I option of nix-build").Short('I').Strings()
+	useSystemSSH        = app.Flag("system-ssh", "Use the ssh and scp binaries on $PATH instead of the built-in SSH client, e.g. to rely on ~/.ssh/config").Default("False").Bool()
+	strictHostKeys      = app.Flag("strict-host-keys", "Only connect to hosts declaring their identity with deployment.hostKey or deployment.knownHostsFile").Default("False").Bool()
+	connectTimeout      = app.Flag("connect-timeout", "Seconds to wait for connecting to a host before failing it, 0 to wait forever").Default("30").Int()
+	commandTimeout      = app.Flag("command-timeout", "Seconds to wait for a command on a host (pushing, uploading a secret, activating, ...) before failing the host, 0 to wait forever").Default("0").Int()
+	verbose             = app.Flag("verbose", "Show more details of what is being done").Short('v').Default("False").Bool()
+	debug               = app.Flag("debug", "Show debug output, including every command run locally and on the target machines").Default("False").Bool()
+	quiet               = app.Flag("quiet", "Only show warnings and errors").Short('q').Default("False").Bool()
+	timestamps          = app.Flag("timestamps", "Prefix log lines with the time they were written").Default("False").Bool()
+	nonInteractive      = app.Flag("non-interactive", "Fail instead of prompting for anything (sudo or SSH passwords, confirmations, host keys), e.g. in CI jobs").Default("False").Bool()
+
+	assetRoot      string
+	runReport      *report.Run
+	deploymentMeta nix.DeploymentMetadata
+
+	// whether the start of the deployment was posted to the notification webhook
+	deployNotified bool
 )
 
 func deploymentArg(cmd *kingpin.CmdClause) {
@@ -74,15 +183,39 @@ func askForSudoPasswdFlag(cmd *kingpin.CmdClause) {
 		Flag("passwd", "Whether to ask interactively for remote sudo password when needed").
 		Default("False").
 		BoolVar(&askForSudoPasswd)
+	cmd.
+		Flag("reprompt-passwd", "Ask for the remote sudo password again when sudo rejects it, instead of failing the host").
+		Default("False").
+		BoolVar(&repromptSudoPasswd)
+	cmd.
+		Flag("passwd-file", "Read the remote sudo password from this file, e.g. for unattended deployments").
+		StringVar(&sudoPasswdFile)
+	cmd.
+		Flag("passwd-env", "Read the remote sudo password from this environment variable").
+		StringVar(&sudoPasswdEnv)
+	cmd.
+		Flag("sudo-credentials", "JSON file with the remote sudo passwords of individual hosts, by host name").
+		StringVar(&sudoCredentials)
 }
 
 func selectorFlags(cmd *kingpin.CmdClause) {
-	cmd.Flag("on", "Glob for selecting servers in the deployment").
-		Default("*").
-		StringVar(&selectGlob)
-	cmd.Flag("tagged", "Select hosts with these tags").
+	cmd.Flag("on", "Glob for selecting servers in the deployment, or - to read their names from stdin like --on-file (may be repeated, selecting servers matching any of them)").
+		StringsVar(&selectGlobs)
+	cmd.Flag("on-intersect", "Select only servers matching all --on globs, instead of any of them").
+		Default("False").
+		BoolVar(&selectIntersect)
+	cmd.Flag("on-file", "Select the servers named in this file, one per line (- for stdin)").
+		PlaceHolder("FILE").
+		StringVar(&selectFile)
+	cmd.Flag("on-regex", "Regular expression the whole name of selected servers has to match, in addition to --on").
+		StringVar(&selectRegex)
+	cmd.Flag("except", "Glob for leaving out servers selected otherwise (may be repeated)").
+		StringsVar(&selectExcept)
+	cmd.Flag("tagged", "Select hosts with all of these tags (comma separated list)").
 		Default("").
 		StringVar(&selectTags)
+	cmd.Flag("tag", "Select hosts with this tag; hosts with any of the tags given by repeating --tag are selected").
+		StringsVar(&selectAnyTags)
 	cmd.Flag("every", "Select every n hosts").
 		Default("1").
 		IntVar(&selectEvery)
@@ -94,6 +227,22 @@ func selectorFlags(cmd *kingpin.CmdClause) {
 	cmd.Flag("order-by-tags", "Order hosts by tags (comma separated list)").
 		Default("").
 		StringVar(&orderingTags)
+	cmd.Flag("ignore-missing", "Only warn about --on and --except names and --tagged or --tag tags not matching any host, instead of failing").
+		Default("False").
+		BoolVar(&ignoreMissing)
+	cmd.Flag("only-environment", "Refuse to run if any selected host is not in this environment (may be repeated)").
+		StringsVar(&onlyEnvironments)
+	cmd.Flag("forbid-environment", "Refuse to run if any selected host is in this environment (may be repeated)").
+		StringsVar(&forbidEnvironments)
+	cmd.Flag("target-host", "Connect to the selected host at this address instead of its deployment.targetHost, e.g. a rescue address").
+		PlaceHolder("ADDRESS").
+		StringVar(&overrideTargetHost)
+	cmd.Flag("target-user", "Connect to the selected hosts as this user instead of their deployment.targetUser").
+		PlaceHolder("USER").
+		StringVar(&overrideTargetUser)
+	cmd.Flag("local", "The selected host is the machine morph runs on: run its commands directly instead of over SSH, and skip pushing").
+		Default("False").
+		BoolVar(&deployLocal)
 }
 
 func nixBuildArgFlag(cmd *kingpin.CmdClause) {
@@ -101,6 +250,30 @@ func nixBuildArgFlag(cmd *kingpin.CmdClause) {
 		StringsVar(&nixBuildArg)
 }
 
+func buildResourceFlags(cmd *kingpin.CmdClause) {
+	cmd.Flag("max-jobs", "Number of builds to run in parallel, or auto for one per CPU (default: network.maxJobs, or nix.conf)").
+		StringVar(&buildMaxJobs)
+	cmd.Flag("cores", "Number of CPU cores each build may use, 0 for all of them (default: network.cores, or nix.conf)").
+		StringVar(&buildCores)
+}
+
+func pushToCacheFlag(cmd *kingpin.CmdClause) {
+	cmd.Flag("push-to-cache", "Copy the built systems to a binary cache after building, e.g. s3://bucket, ssh://host or cachix://name (may be repeated)").
+		StringsVar(&binaryCaches)
+}
+
+func signingKeyFlag(cmd *kingpin.CmdClause) {
+	cmd.Flag("sign-key", "Sign the built systems with this nix secret key file, for hosts and binary caches requiring signatures").
+		PlaceHolder("FILE").
+		ExistingFileVar(&signingKeyFile)
+}
+
+func useSubstitutesFlag(cmd *kingpin.CmdClause) {
+	cmd.Flag("use-substitutes", "Let the hosts fetch paths from their binary caches, only copying what isn't substitutable (like deployment.substituteOnDestination for all hosts)").
+		Default("False").
+		BoolVar(&useSubstitutes)
+}
+
 func nixBuildTargetFlag(cmd *kingpin.CmdClause) {
 	cmd.Flag("target", "A Nix lambda defining the build target to use instead of the default").
 		StringVar(&nixBuildTarget)
@@ -119,6 +292,13 @@ func skipHealthChecksFlag(cmd *kingpin.CmdClause) {
 		BoolVar(&skipHealthChecks)
 }
 
+func ignoreHostSkipsFlag(cmd *kingpin.CmdClause) {
+	cmd.
+		Flag("ignore-host-skips", "Run health checks and upload secrets also for hosts with deployment.skipHealthChecks or deployment.skipSecrets").
+		Default("False").
+		BoolVar(&ignoreHostSkips)
+}
+
 func showTraceFlag(cmd *kingpin.CmdClause) {
 	cmd.
 		Flag("show-trace", "Whether to pass --show-trace to all nix commands").
@@ -139,6 +319,10 @@ func buildCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
 	nixBuildArgFlag(cmd)
 	nixBuildTargetFlag(cmd)
 	nixBuildTargetFileFlag(cmd)
+	buildResourceFlags(cmd)
+	pushToCacheFlag(cmd)
+	signingKeyFlag(cmd)
+	asJsonFlag(cmd)
 	deploymentArg(cmd)
 	return cmd
 }
@@ -146,6 +330,11 @@ func buildCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
 func pushCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
 	selectorFlags(cmd)
 	showTraceFlag(cmd)
+	buildResourceFlags(cmd)
+	pushToCacheFlag(cmd)
+	signingKeyFlag(cmd)
+	useSubstitutesFlag(cmd)
+	askForSudoPasswdFlag(cmd)
 	deploymentArg(cmd)
 	return cmd
 }
@@ -156,6 +345,14 @@ func executeCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
 	askForSudoPasswdFlag(cmd)
 	timeoutFlag(cmd)
 	deploymentArg(cmd)
+	cmd.
+		Flag("sudo", "Run the command using sudo on the target").
+		Default("False").
+		BoolVar(&executeSudo)
+	cmd.
+		Flag("diff", "Group hosts by identical output, and show how the output of each group differs from the most common one").
+		Default("False").
+		BoolVar(&executeDiff)
 	cmd.
 		Arg("command", "Command to execute").
 		Required().
@@ -168,10 +365,15 @@ func deployCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
 	selectorFlags(cmd)
 	showTraceFlag(cmd)
 	nixBuildArgFlag(cmd)
+	buildResourceFlags(cmd)
+	pushToCacheFlag(cmd)
+	signingKeyFlag(cmd)
+	useSubstitutesFlag(cmd)
 	deploymentArg(cmd)
 	timeoutFlag(cmd)
 	askForSudoPasswdFlag(cmd)
 	skipHealthChecksFlag(cmd)
+	ignoreHostSkipsFlag(cmd)
 	cmd.
 		Flag("upload-secrets", "Upload secrets as part of the host deployment").
 		Default("False").
@@ -180,6 +382,50 @@ func deployCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
 		Flag("reboot", "Reboots the host after system activation, but before healthchecks has executed.").
 		Default("False").
 		BoolVar(&deployReboot)
+	cmd.
+		Flag("kexec", "Reboot with kexec instead of through the firmware, when the kernel, initrd or kernel parameters changed (or always, with --reboot)").
+		Default("False").
+		BoolVar(&deployKexec)
+	cmd.
+		Flag("magic-rollback", "Switch hosts back to their previous system unless morph can confirm the activation over a new connection within this many seconds (switch and test only)").
+		PlaceHolder("SECONDS").
+		IntVar(&magicRollback)
+	cmd.
+		Flag("at", "Build and push now, but activate at the given time (HH:MM, YYYY-MM-DD HH:MM or RFC3339)").
+		StringVar(&deployAt)
+	cmd.
+		Flag("delay", "Build and push now, but activate after the given delay (e.g. 2h30m)").
+		DurationVar(&deployDelay)
+	cmd.
+		Flag("show-diff", "Show the package changes and transfer size of each host before pushing to it").
+		Default("False").
+		BoolVar(&deployShowDiff)
+	cmd.
+		Flag("confirm", "Build and push to all hosts, then ask for confirmation before activating").
+		Default("False").
+		BoolVar(&deployConfirm)
+	cmd.
+		Flag("yes", "Assume yes when asked for confirmation, e.g. for --confirm in automation").
+		Default("False").
+		BoolVar(&deployYes)
+	cmd.
+		Flag("changelog", "Write a Markdown summary of the changes made by the deployment to this file").
+		PlaceHolder("out.md").
+		StringVar(&deployChangelog)
+	cmd.
+		Flag("steps", "Comma separated list of the steps to run for each host, in order, instead of network.steps or "+strings.Join(defaultDeploySteps, ",")).
+		StringVar(&deployStepOrder)
+	cmd.
+		Flag("skip-step", "Skip a deployment step (may be repeated)").
+		StringsVar(&skipDeploySteps)
+	cmd.
+		Flag("max-unavailable", "Deploy this many hosts at a time, or a percentage of the hosts like 25%; a host counts until its health checks passed").
+		Default("1").
+		StringVar(&maxUnavailable)
+	cmd.
+		Flag("resume", "Deploy to the hosts left by the last failed deployment, reusing its build if it's still in the store").
+		Default("False").
+		BoolVar(&deployResume)
 	cmd.
 		Arg("switch-action", "Either of "+strings.Join(switchActions, "|")).
 		Required().
@@ -191,16 +437,30 @@ func deployCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
 func healthCheckCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
 	selectorFlags(cmd)
 	showTraceFlag(cmd)
+	ignoreHostSkipsFlag(cmd)
 	deploymentArg(cmd)
 	timeoutFlag(cmd)
 	return cmd
 }
 
+func rollbackCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
+	selectorFlags(cmd)
+	showTraceFlag(cmd)
+	askForSudoPasswdFlag(cmd)
+	skipHealthChecksFlag(cmd)
+	ignoreHostSkipsFlag(cmd)
+	timeoutFlag(cmd)
+	deploymentArg(cmd)
+	return cmd
+}
+
 func uploadSecretsCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
 	selectorFlags(cmd)
 	showTraceFlag(cmd)
 	askForSudoPasswdFlag(cmd)
 	skipHealthChecksFlag(cmd)
+	ignoreHostSkipsFlag(cmd)
+	timeoutFlag(cmd)
 	deploymentArg(cmd)
 	return cmd
 }
@@ -213,6 +473,164 @@ func listSecretsCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
 	return cmd
 }
 
+func auditSecretsCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
+	selectorFlags(cmd)
+	showTraceFlag(cmd)
+	askForSudoPasswdFlag(cmd)
+	deploymentArg(cmd)
+	return cmd
+}
+
+func secretsHistoryCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
+	showTraceFlag(cmd)
+	askForSudoPasswdFlag(cmd)
+	asJsonFlag(cmd)
+	deploymentArg(cmd)
+	cmd.
+		Arg("host", "Name of the host, or a glob matching several hosts").
+		Required().
+		StringVar(&secretsHistoryHost)
+	return cmd
+}
+
+func exportInventoryCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
+	selectorFlags(cmd)
+	showTraceFlag(cmd)
+	deploymentArg(cmd)
+	cmd.
+		Flag("format", "Format of the inventory: "+strings.Join(inventory.Formats, ", ")).
+		Default("json").
+		EnumVar(&inventoryFormat, inventory.Formats...)
+	return cmd
+}
+
+func migrateHostCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
+	showTraceFlag(cmd)
+	askForSudoPasswdFlag(cmd)
+	timeoutFlag(cmd)
+	deploymentArg(cmd)
+	cmd.
+		Arg("old", "Name or current target address of the host").
+		Required().
+		StringVar(&migrateOld)
+	cmd.
+		Arg("new", "New target address of the host").
+		Required().
+		StringVar(&migrateNew)
+	cmd.
+		Flag("new-host-key", "Public host key of the new machine (e.g. \"ssh-ed25519 AAAA...\"), replacing deployment.hostKey and deployment.knownHostsFile").
+		StringVar(&migrateHostKey)
+	cmd.
+		Flag("accept-new-host-key", "Don't verify the host key of the new machine, e.g. a fresh install whose key isn't known yet").
+		Default("False").
+		BoolVar(&migrateAcceptKey)
+	cmd.
+		Flag("skip-state", "Don't copy the secrets manifest and deployment info from the old machine, e.g. because it is gone").
+		Default("False").
+		BoolVar(&migrateSkipState)
+	return cmd
+}
+
+func selfTestCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
+	showTraceFlag(cmd)
+	cmd.Flag("timeout", "Seconds to wait for the VM to boot, and for health checks to pass").
+		Default("300").
+		IntVar(&timeout)
+	return cmd
+}
+
+func agentCommand(cmd *kingpin.CmdClause) *kingpin.CmdClause {
+	cmd.
+		Flag("socket", "Unix socket to listen on").
+		Default(agent.DefaultSocket).
+		StringVar(&agentSocket)
+	cmd.
+		Flag("allow-user", "User allowed to send commands to the agent (may be repeated)").
+		Required().
+		StringsVar(&agentAllowedUsers)
+	cmd.
+		Flag("allow-sudo-user", "Allowed user who may also run commands as root through the agent, without sudo (may be repeated)").
+		StringsVar(&agentSudoUsers)
+	cmd.
+		Flag("group", "Group owning the socket; only its members may connect to the agent").
+		StringVar(&agentGroup)
+	return cmd
+}
+
+func agentStatusCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
+	selectorFlags(cmd)
+	showTraceFlag(cmd)
+	asJsonFlag(cmd)
+	deploymentArg(cmd)
+	return cmd
+}
+
+func installCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
+	selectorFlags(cmd)
+	showTraceFlag(cmd)
+	askForSudoPasswdFlag(cmd)
+	deploymentArg(cmd)
+	cmd.
+		Flag("format", "Partition, format and mount the disks with the disko script of the host (system.build.diskoScript); with --no-format, the file systems have to be mounted at /mnt already").
+		Default("True").
+		BoolVar(&installFormat)
+	cmd.
+		Flag("reboot", "Reboot the hosts into the installed system").
+		Default("False").
+		BoolVar(&installReboot)
+	cmd.
+		Flag("yes", "Don't ask for confirmation before erasing the disks of the hosts").
+		Default("False").
+		BoolVar(&installYes)
+	return cmd
+}
+
+func listGenerationsCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
+	selectorFlags(cmd)
+	showTraceFlag(cmd)
+	asJsonFlag(cmd)
+	deploymentArg(cmd)
+	return cmd
+}
+
+func compareRunsCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
+	asJsonFlag(cmd)
+	cmd.
+		Flag("threshold", "Percentage by which a host has to be slower to be reported").
+		Default("20").
+		Float64Var(&compareThreshold)
+	cmd.
+		Arg("from", "Id (or unique prefix of the id) of the earlier run, or the path of its manifest").
+		Required().
+		StringVar(&compareFrom)
+	cmd.
+		Arg("to", "Id (or unique prefix of the id) of the later run, or the path of its manifest").
+		Required().
+		StringVar(&compareTo)
+	return cmd
+}
+
+func statusCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
+	deploymentArg(cmd)
+	asJsonFlag(cmd)
+	return cmd
+}
+
+func cleanCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
+	deploymentArg(cmd)
+	cmd.
+		Flag("keep", "Number of the newest build results to keep (0 removes all of them)").
+		Default("1").
+		IntVar(&cleanKeep)
+	return cmd
+}
+
+func docOptionsCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
+	showTraceFlag(cmd)
+	asJsonFlag(cmd)
+	return cmd
+}
+
 func setup() {
 	utils.ValidateEnvironment("nix")
 
@@ -230,16 +648,67 @@ func main() {
 
 	clause := kingpin.MustParse(app.Parse(os.Args[1:]))
 
+	// commands with their own JSON output use it, the others print a summary of the run
+	if *outputFormat == "json" {
+		asJson = true
+	}
+	runReport = report.New(clause)
+	setupLogging()
+	utils.NonInteractive = *nonInteractive
+	nix.Backend = *nixBackend
+	nix.CopySignatures = signingKeyFile != ""
+
 	//TODO: Remove deprecation warning when removing --build-arg flag
 	if len(nixBuildArg) > 0 {
-		fmt.Fprintln(os.Stderr, "Deprecation: The --build-arg flag will be removed in a future release.")
+		logging.Warnf("Deprecation: The --build-arg flag will be removed in a future release.\n")
+	}
+
+	// the agent runs on the target hosts, which don't need nix on the $PATH of the service
+	if clause == agentCmd.FullCommand() {
+		handleError(agent.Serve(agentSocket, agentGroup, agentAllowedUsers, agentSudoUsers, version))
+		return
 	}
 
 	defer utils.RunFinalizers()
 	setup()
 
+	// commands not operating on a deployment
+	switch clause {
+	case docOptions.FullCommand():
+		handleError(execDocOptions())
+		return
+	case migrateHost.FullCommand():
+		handleError(execMigrateHost())
+		return
+	case selfTest.FullCommand():
+		handleError(execSelfTest())
+		return
+	case clean.FullCommand():
+		handleError(execClean())
+		return
+	case compareRuns.FullCommand():
+		handleError(execCompareRuns())
+		return
+	case deploymentStatus.FullCommand():
+		handleError(execStatus())
+		return
+	}
+
+	// the host argument replaces the selector flags
+	if clause == secretsHistory.FullCommand() {
+		selectGlobs = []string{secretsHistoryHost}
+		selectEvery = 1
+	}
+
+	if clause == deploy.FullCommand() && deployResume {
+		handleError(loadResumeState())
+	}
+
 	hosts, err := getHosts(deployment)
 	handleError(err)
+	if connectsToHosts(clause) {
+		handleError(checkHostKeys(hosts))
+	}
 
 	switch clause {
 	case build.FullCommand():
@@ -248,8 +717,17 @@ func main() {
 		_, err = execPush(hosts)
 	case deploy.FullCommand():
 		_, err = execDeploy(hosts)
+		if deployChangelog != "" {
+			if changelogErr := writeChangelog(err); changelogErr != nil {
+				logging.Errorf("Failed to write the changelog: %s\n", changelogErr.Error())
+			}
+		}
 	case healthCheck.FullCommand():
 		err = execHealthCheck(hosts)
+	case rollback.FullCommand():
+		err = execRollback(hosts)
+	case install.FullCommand():
+		err = execInstall(hosts)
 	case uploadSecrets.FullCommand():
 		err = execUploadSecrets(createSSHContext(), hosts)
 	case listSecrets.FullCommand():
@@ -258,189 +736,1772 @@ func main() {
 		} else {
 			execListSecrets(hosts)
 		}
+	case auditSecrets.FullCommand():
+		err = execAuditSecrets(hosts)
+	case secretsHistory.FullCommand():
+		err = execSecretsHistory(hosts)
+	case exportInventory.FullCommand():
+		err = execExportInventory(hosts)
+	case agentStatus.FullCommand():
+		err = execAgentStatus(hosts)
+	case listGenerations.FullCommand():
+		err = execListGenerations(hosts)
 	case execute.FullCommand():
 		err = execExecute(hosts)
 	}
 
 	handleError(err)
+	writeRunReport(clause, nil)
 }
 
-func handleError(err error) {
-	//Stupid handling of catch-all errors for now
-	if err != nil {
-		fmt.Fprint(os.Stderr, err.Error())
-		utils.Exit(1)
+func setupLogging() {
+	switch {
+	case *debug:
+		logging.Threshold = logging.DebugLevel
+	case *verbose:
+		logging.Threshold = logging.VerboseLevel
+	case *quiet:
+		logging.Threshold = logging.WarningLevel
 	}
+	logging.Timestamps = *timestamps
 }
 
-func execExecute(hosts []nix.Host) error {
-	sshContext := createSSHContext()
+// Exit codes telling scripts in which phase morph failed
+const (
+	exitFailure      = 1
+	exitEval         = 2
+	exitBuild        = 3
+	exitPush         = 4
+	exitSecrets      = 5
+	exitActivation   = 6
+	exitHealthChecks = 7
+)
 
-	for _, host := range hosts {
-		if host.BuildOnly {
-			fmt.Fprintf(os.Stderr, "Exec is disabled for build-only host: %s\n", host.Name)
-			continue
-		}
-		fmt.Fprintln(os.Stderr, "** "+host.Name)
-		sshContext.CmdInteractive(&host, timeout, executeCommand...)
-		fmt.Fprintln(os.Stderr)
-	}
+// An error failing a phase of the run, which determines the exit code of morph
+type phaseError struct {
+	exitCode int
+	err      error
+}
 
-	return nil
+func (e *phaseError) Error() string {
+	return e.err.Error()
 }
 
-func execBuild(hosts []nix.Host) (string, error) {
-	resultPath, err := buildHosts(hosts)
-	if err != nil {
-		return "", err
+// Mark err as failing the phase with the given exit code, unless it's from an earlier phase already
+func inPhase(exitCode int, err error) error {
+	if err == nil {
+		return nil
 	}
-
-	return resultPath, nil
+	if _, ok := err.(*phaseError); ok {
+		return err
+	}
+	return &phaseError{exitCode: exitCode, err: err}
 }
 
-func execPush(hosts []nix.Host) (string, error) {
-	resultPath, err := execBuild(hosts)
+func handleError(err error) {
 	if err != nil {
-		return "", err
-	}
+		writeRunReport(runReport.Command, err)
+		logging.Errorf("%s", err.Error())
 
-	fmt.Fprintln(os.Stderr)
-	return resultPath, pushPaths(createSSHContext(), hosts, resultPath)
+		exitCode := exitFailure
+		if phaseErr, ok := err.(*phaseError); ok {
+			exitCode = phaseErr.exitCode
+		}
+		// runs the finalizers, e.g. removing the assets and decrypted secrets
+		utils.Exit(exitCode)
+	}
 }
 
-func execDeploy(hosts []nix.Host) (string, error) {
-	doPush := false
-	doUploadSecrets := false
-	doActivate := false
+func writeRunReport(clause string, err error) {
+	switch clause {
+	case push.FullCommand(), deploy.FullCommand(), healthCheck.FullCommand(), uploadSecrets.FullCommand(), rollback.FullCommand(), install.FullCommand():
+	default:
+		return
+	}
 
+	runReport.Finish(err)
+	notifyDeployFinished()
 	if !*dryRun {
-		switch deploySwitchAction {
-		case "dry-activate":
-			doPush = true
-			doActivate = true
-		case "test":
-			fallthrough
-		case "switch":
-			fallthrough
-		case "boot":
-			doPush = true
-			doUploadSecrets = deployUploadSecrets
-			doActivate = true
+		if deploymentPath, absErr := filepath.Abs(deployment); absErr == nil {
+			runReport.Deployment = deploymentPath
+		}
+		if clause == deploy.FullCommand() {
+			runReport.SwitchAction = deploySwitchAction
+		}
+		if _, saveErr := runReport.Save(*runsDir); saveErr != nil {
+			logging.Warnf("Failed to store the run manifest: %s\n", saveErr.Error())
 		}
 	}
-
-	resultPath, err := buildHosts(hosts)
-	if err != nil {
-		return "", err
+	if *outputFormat == "json" {
+		runReport.Write(os.Stdout)
 	}
+}
 
-	fmt.Fprintln(os.Stderr)
+// The incoming webhook to post deployment notifications to: $MORPH_NOTIFY_WEBHOOK, or network.notifyWebhook
+func notifyWebhook() string {
+	if url := os.Getenv("MORPH_NOTIFY_WEBHOOK"); url != "" {
+		return url
+	}
+	return deploymentMeta.NotifyWebhook
+}
 
-	sshContext := createSSHContext()
+func notifyDeployStarted(hosts []nix.Host) {
+	url := notifyWebhook()
+	if url == "" {
+		return
+	}
 
+	names := make([]string, 0, len(hosts))
 	for _, host := range hosts {
-		if host.BuildOnly {
-			fmt.Fprintf(os.Stderr, "Deployment steps are disabled for build-only host: %s\n", host.Name)
-			continue
-		}
-
-		singleHostInList := []nix.Host{host}
+		names = append(names, host.Name)
+	}
+	runReport.SwitchAction = deploySwitchAction
+	postNotification(url, notify.Started(runReport, filepath.Base(deployment), names))
+	deployNotified = true
+}
 
-		if doPush {
-			err = pushPaths(sshContext, singleHostInList, resultPath)
-			if err != nil {
-				return "", err
-			}
-		}
-		fmt.Fprintln(os.Stderr)
+func notifyDeployFinished() {
+	if !deployNotified {
+		return
+	}
 
-		if doUploadSecrets {
-			err = execUploadSecrets(sshContext, singleHostInList)
-			if err != nil {
-				return "", err
-			}
+	failedChecks := make(map[string][]string)
+	for name, results := range healthCheckResults {
+		failed, warnings := results.Failed()
+		failedChecks[name] = append(failed, warnings...)
+	}
+	postNotification(notifyWebhook(), notify.Finished(runReport, filepath.Base(deployment), failedChecks))
+	deployNotified = false
+}
 
-			fmt.Fprintln(os.Stderr)
+// Notifications are informational, so failing to post them doesn't fail the deployment
+func postNotification(url string, text string) {
+	if err := notify.Post(url, text); err != nil {
+		logging.Warnf("Failed to post the deployment notification: %s\n", err.Error())
+	}
+}
+
+func writeChangelog(deployErr error) error {
+	runReport.Finish(deployErr)
+
+	file, err := os.Create(deployChangelog)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	title := fmt.Sprintf("Deployment of %s (%s)", filepath.Base(deployment), deploySwitchAction)
+	return runReport.WriteChangelog(file, title)
+}
+
+func execCompareRuns() error {
+	from, err := report.Find(*runsDir, compareFrom)
+	if err != nil {
+		return err
+	}
+	to, err := report.Find(*runsDir, compareTo)
+	if err != nil {
+		return err
+	}
+
+	between, err := report.Between(*runsDir, from.Id, to.Id)
+	if err != nil {
+		return err
+	}
+	comparison := report.Compare(from, to, between, compareThreshold)
+
+	if asJson {
+		jsonComparison, err := json.MarshalIndent(comparison, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "%s\n", jsonComparison)
+		return nil
+	}
+	return comparison.Write(os.Stdout)
+}
+
+func execStatus() error {
+	deploymentPath, err := filepath.Abs(deployment)
+	if err != nil {
+		return err
+	}
+	runs, err := report.All(*runsDir)
+	if err != nil {
+		return err
+	}
+	statuses := report.LastDeployed(runs, deploymentPath)
+
+	if asJson {
+		jsonStatus, err := json.MarshalIndent(statuses, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "%s\n", jsonStatus)
+		return nil
+	}
+	return report.WriteStatus(os.Stdout, statuses)
+}
+
+func execClean() error {
+	deploymentPath, err := filepath.Abs(deployment)
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		roots, err := nix.ResultGCRoots(deploymentPath)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < len(roots)-cleanKeep; i++ {
+			logging.Infof("Would remove %s\n", roots[i])
+		}
+		return nil
+	}
+
+	removed, err := nix.CleanResultGCRoots(deploymentPath, cleanKeep)
+	for _, root := range removed {
+		logging.Infof("Removed %s\n", root)
+	}
+	if err != nil {
+		return err
+	}
+	logging.Infof("Removed %d build results; run nix-collect-garbage to free their space\n", len(removed))
+	return nil
+}
+
+func execDocOptions() error {
+	options, err := getNixContext().GetOptions()
+	if err != nil {
+		return err
+	}
+
+	if asJson {
+		jsonOptions, err := json.MarshalIndent(options, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "%s\n", jsonOptions)
+		return nil
+	}
+
+	for _, option := range options {
+		fmt.Fprintln(os.Stdout, option.Name)
+		fmt.Fprintf(os.Stdout, "\tType: %s\n", option.Type)
+		if option.Default != nil {
+			defaultValue, err := json.Marshal(option.Default)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stdout, "\tDefault: %s\n", defaultValue)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(option.Description), "\n") {
+			fmt.Fprintf(os.Stdout, "\t%s\n", strings.TrimSpace(line))
+		}
+		fmt.Fprintln(os.Stdout)
+	}
+
+	return nil
+}
+
+func execExecute(hosts []nix.Host) error {
+	sshContext := createSSHContext()
+
+	command := executeCommand
+	if executeSudo && command[0] != "sudo" {
+		command = append([]string{"sudo"}, command...)
+	}
+
+	failedHosts := make([]string, 0)
+	groups := make([]*outputGroup, 0)
+	for _, host := range hosts {
+		if host.BuildOnly {
+			logging.Infof("Exec is disabled for build-only host: %s\n", host.Name)
+			continue
+		}
+
+		if executeDiff {
+			var output bytes.Buffer
+			writer := utils.NewLockedWriter(&output)
+			err := sshContext.CmdStreamed(&host, timeout, writer, writer, command...)
+			if err != nil {
+				failedHosts = append(failedHosts, host.Name)
+			}
+			groups = addToOutputGroup(groups, host.Name, output.String(), err)
+			continue
+		}
+
+		stdout := utils.NewPrefixWriter(os.Stdout, host.Name+": ")
+		stderr := utils.NewPrefixWriter(os.Stderr, host.Name+": ")
+		err := sshContext.CmdStreamed(&host, timeout, stdout, stderr, command...)
+		stdout.Flush()
+		stderr.Flush()
+
+		if err != nil {
+			logging.WithHost(host.Name).Errorf("%s\n", err.Error())
+			failedHosts = append(failedHosts, host.Name)
+		}
+	}
+
+	if executeDiff {
+		printOutputGroups(groups)
+	}
+
+	if len(failedHosts) > 0 {
+		return errors.New("Command failed on hosts: " + strings.Join(failedHosts, ", ") + "\n")
+	}
+
+	return nil
+}
+
+// Hosts which produced the same output (and error) for exec --diff
+type outputGroup struct {
+	output string
+	err    string
+	hosts  []string
+}
+
+func addToOutputGroup(groups []*outputGroup, hostName string, output string, err error) []*outputGroup {
+	errMessage := ""
+	if err != nil {
+		errMessage = err.Error()
+	}
+	for _, group := range groups {
+		if group.output == output && group.err == errMessage {
+			group.hosts = append(group.hosts, hostName)
+			return groups
+		}
+	}
+	return append(groups, &outputGroup{output: output, err: errMessage, hosts: []string{hostName}})
+}
+
+// Print the output of the largest group, followed by the difference to it for every other group
+func printOutputGroups(groups []*outputGroup) {
+	if len(groups) == 0 {
+		return
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return len(groups[i].hosts) > len(groups[j].hosts)
+	})
+
+	header := func(group *outputGroup) {
+		fmt.Fprintf(os.Stdout, "== %d host(s): %s\n", len(group.hosts), strings.Join(group.hosts, ", "))
+		if group.err != "" {
+			fmt.Fprintf(os.Stdout, "== failed: %s\n", group.err)
+		}
+	}
+
+	reference := groups[0]
+	header(reference)
+	fmt.Fprint(os.Stdout, reference.output)
+	if reference.output != "" && !strings.HasSuffix(reference.output, "\n") {
+		fmt.Fprintln(os.Stdout)
+	}
+
+	referenceLines := strings.Split(reference.output, "\n")
+	for _, group := range groups[1:] {
+		fmt.Fprintln(os.Stdout)
+		header(group)
+		for _, line := range utils.UnifiedDiff(referenceLines, strings.Split(group.output, "\n"), 3) {
+			fmt.Fprintln(os.Stdout, line)
+		}
+	}
+
+	if len(groups) == 1 {
+		logging.Infof("Output is identical on all %d host(s)\n", len(reference.hosts))
+	} else {
+		logging.Infof("Found %d different outputs\n", len(groups))
+	}
+}
+
+func execBuild(hosts []nix.Host) (string, error) {
+	resultPath, err := buildHosts(hosts)
+	if err != nil {
+		return "", err
+	}
+
+	if asJson {
+		err = printBuildResultAsJson(hosts, resultPath)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return resultPath, nil
+}
+
+func printBuildResultAsJson(hosts []nix.Host, resultPath string) error {
+	hostPaths := make(map[string]map[string]string)
+	for _, host := range hosts {
+		paths, err := nix.GetBuildTargetPaths(host, resultPath)
+		if err != nil {
+			return err
+		}
+		hostPaths[host.Name] = paths
+	}
+
+	jsonResult, err := json.MarshalIndent(struct {
+		ResultPath string                       `json:"resultPath"`
+		Hosts      map[string]map[string]string `json:"hosts"`
+	}{resultPath, hostPaths}, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "%s\n", jsonResult)
+
+	return nil
+}
+
+func execPush(hosts []nix.Host) (string, error) {
+	resultPath, err := execBuild(hosts)
+	if err != nil {
+		return "", err
+	}
+
+	logging.Infof("\n")
+	// the pushed systems are activated by a later deploy
+	return resultPath, inPhase(exitPush, pushPaths(createSSHContext(), hosts, resultPath, true))
+}
+
+func execDeploy(hosts []nix.Host) (string, error) {
+	doPush := false
+	doUploadSecrets := false
+	doActivate := false
+
+	if !*dryRun {
+		switch deploySwitchAction {
+		case "dry-activate":
+			doPush = true
+			doActivate = true
+		case "test":
+			fallthrough
+		case "switch":
+			fallthrough
+		case "boot":
+			doPush = true
+			doUploadSecrets = deployUploadSecrets
+			doActivate = true
+		}
+	}
+
+	if magicRollback > 0 && deploySwitchAction != "switch" && deploySwitchAction != "test" {
+		return "", errors.New(fmt.Sprintf("--magic-rollback only applies to switch and test, not %s\n", deploySwitchAction))
+	}
+	// kexec boots the new system right away, which only switch and boot make the system of the host
+	if deployKexec && deploySwitchAction != "switch" && deploySwitchAction != "boot" {
+		return "", errors.New(fmt.Sprintf("--kexec only applies to switch and boot, not %s\n", deploySwitchAction))
+	}
+
+	scheduled := deployAt != "" || deployDelay != 0
+	activateAt, err := utils.ScheduledTime(deployAt, deployDelay, time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	var resultPath string
+	if resumeState != nil && reusableResult(hosts, resumeState.ResultPath) {
+		resultPath = resumeState.ResultPath
+		logging.Infof("Reusing the build of the failed deployment: %s\n", resultPath)
+		recordResult(hosts, resultPath)
+	} else {
+		resultPath, err = buildHosts(hosts)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	logging.Infof("\n")
+
+	sshContext := createSSHContext()
+
+	// scheduled and confirmed deployments push to all hosts right away, leaving only activation for later
+	if (scheduled || deployConfirm) && doPush {
+		if deployShowDiff || deployChangelog != "" {
+			err = diffClosures(sshContext, hosts, resultPath)
+			if err != nil {
+				return "", err
+			}
+		}
+
+		err = pushPaths(sshContext, hosts, resultPath, true)
+		if err != nil {
+			return "", inPhase(exitPush, err)
+		}
+		logging.Infof("\n")
+
+		if deployConfirm {
+			err = confirmDeployment(hosts, resultPath)
+			if err != nil {
+				return "", err
+			}
 		}
 
-		if doActivate {
-			err = activateConfiguration(sshContext, singleHostInList, resultPath)
+		if scheduled {
+			// nobody might be around to enter the password once it's time to activate
+			err = sshContext.EnsureSudoPassword()
 			if err != nil {
 				return "", err
 			}
+
+			utils.WaitUntil(activateAt)
+		}
+
+		doPush = false
+	}
+
+	steps, err := deploySteps(doPush, doUploadSecrets, doActivate)
+	if err != nil {
+		return "", err
+	}
+
+	budget, err := unavailableBudget(maxUnavailable, len(hosts))
+	if err != nil {
+		return "", err
+	}
+
+	// hosts deployed to in parallel mustn't all ask for the password at once
+	if budget > 1 && (doUploadSecrets || doActivate) {
+		if err = sshContext.EnsureSudoPassword(); err != nil {
+			return "", err
+		}
+	}
+
+	runHooks := doActivate && deploySwitchAction != "dry-activate"
+	if runHooks {
+		err = runDeployHook("preDeploy", deploymentMeta.PreDeploy, hosts, resultPath, nil)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// only once the hosts are about to be activated: not before a scheduled time, a confirmation or the build
+	if !*dryRun && deploySwitchAction != "dry-activate" {
+		notifyDeployStarted(hosts)
+	}
+
+	deployed := make(map[string]bool)
+	err = rollingDeploy(hosts, budget, func(host nix.Host) error {
+		err := deployHost(sshContext, host, steps, resultPath)
+		if err == nil {
+			deployMutex.Lock()
+			deployed[host.Name] = true
+			deployMutex.Unlock()
+		}
+		return err
+	})
+	if !*dryRun {
+		updateResumeState(hosts, deployed, resultPath, err)
+	}
+
+	if runHooks {
+		status := "ok"
+		if err != nil {
+			status = "failed"
+		}
+		deployedNames := make([]string, 0, len(deployed))
+		for _, host := range hosts {
+			if deployed[host.Name] {
+				deployedNames = append(deployedNames, host.Name)
+			}
+		}
+		hookErr := runDeployHook("postDeploy", deploymentMeta.PostDeploy, hosts, resultPath, map[string]string{
+			"MORPH_DEPLOY_STATUS":  status,
+			"MORPH_DEPLOYED_HOSTS": strings.Join(deployedNames, " "),
+		})
+		if err == nil {
+			err = hookErr
+		} else if hookErr != nil {
+			logging.Errorf("%s", hookErr.Error())
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return resultPath, nil
+}
+
+// Run the preDeploy or postDeploy command of the deployment locally, in the directory of the deployment, with the
+// deployed hosts and build in the environment
+func runDeployHook(name string, command []string, hosts []nix.Host, resultPath string, extraEnv map[string]string) error {
+	if len(command) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(hosts))
+	targets := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		names = append(names, host.Name)
+		targets = append(targets, host.TargetHost)
+	}
+	deploymentPath, err := filepath.Abs(deployment)
+	if err != nil {
+		return err
+	}
+
+	logging.Infof("Running %s: %s\n", name, strings.Join(command, " "))
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Dir = filepath.Dir(deploymentPath)
+	cmd.Env = append(os.Environ(),
+		"MORPH_DEPLOYMENT="+deploymentPath,
+		"MORPH_HOSTS="+strings.Join(names, " "),
+		"MORPH_TARGET_HOSTS="+strings.Join(targets, " "),
+		"MORPH_RESULT_PATH="+resultPath,
+		"MORPH_SWITCH_ACTION="+deploySwitchAction)
+	for key, value := range extraEnv {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return errors.New(fmt.Sprintf("The %s command of the deployment failed: %s\n", name, err.Error()))
+	}
+
+	logging.Infof("\n")
+	return nil
+}
+
+// Read the state of the failed deployment to resume with --resume
+func loadResumeState() error {
+	deploymentPath, err := filepath.Abs(deployment)
+	if err != nil {
+		return err
+	}
+	resumeState, err = report.LoadResume(*runsDir, deploymentPath)
+	if err != nil {
+		return err
+	}
+	if resumeState.SwitchAction != deploySwitchAction {
+		return errors.New(fmt.Sprintf("The failed deployment was run with switch action %s, not %s\n", resumeState.SwitchAction, deploySwitchAction))
+	}
+
+	logging.Infof("Resuming run %s, which failed at %s, with %d host(s) left\n\n", resumeState.RunId, resumeState.Failed.Format(time.RFC3339), len(resumeState.Hosts))
+	return nil
+}
+
+// Remember the hosts not deployed by a failed deployment for --resume, or forget about them once a deployment succeeds
+func updateResumeState(hosts []nix.Host, deployed map[string]bool, resultPath string, deployErr error) {
+	deploymentPath, err := filepath.Abs(deployment)
+	if err != nil {
+		return
+	}
+
+	if deployErr == nil {
+		err = report.RemoveResume(*runsDir, deploymentPath)
+	} else {
+		state := &report.Resume{
+			Deployment:   deploymentPath,
+			SwitchAction: deploySwitchAction,
+			ResultPath:   resultPath,
+			RunId:        runReport.Id,
+			Failed:       time.Now(),
+			Hosts:        make([]string, 0),
+		}
+		for _, host := range hosts {
+			if !deployed[host.Name] && !host.BuildOnly {
+				state.Hosts = append(state.Hosts, host.Name)
+			}
+		}
+		logging.Infof("\nTo deploy the %d remaining host(s), run the same command with --resume\n", len(state.Hosts))
+		_, err = state.Save(*runsDir)
+	}
+	if err != nil {
+		logging.Warnf("Unable to update the state for --resume: %s\n", err.Error())
+	}
+}
+
+// The build of a failed deployment can be reused if it's still in the store and has the systems of all hosts
+func reusableResult(hosts []nix.Host, resultPath string) bool {
+	for _, host := range hosts {
+		systemPath, err := nix.GetNixSystemPath(host, resultPath)
+		if err != nil {
+			return false
+		}
+		if _, err := os.Stat(systemPath); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func deployHost(sshContext *ssh.SSHContext, host nix.Host, steps []deployStep, resultPath string) error {
+	if host.BuildOnly {
+		logging.Infof("Deployment steps are disabled for build-only host: %s\n", host.Name)
+		return nil
+	}
+
+	started := time.Now()
+	restoreNixSettings, err := nix.ApplyTemporarySettings(sshContext, host)
+	if err != nil {
+		return err
+	}
+	for _, step := range steps {
+		err = step.run(sshContext, host, resultPath)
+		if err != nil {
+			restoreNixSettings()
+			runReport.Host(host.Name).Duration = time.Since(started).Seconds()
+			return err
+		}
+	}
+	restoreNixSettings()
+	runReport.Host(host.Name).Duration = time.Since(started).Seconds()
+
+	logging.Infof("Done: %s\n", host.Name)
+	return nil
+}
+
+// Deploy to at most budget hosts at a time, in order. A host takes up its slot until all of its steps, including
+// the health checks, passed; after a failure no more hosts are started, and the ones in progress are finished.
+// Hosts with deployAfter wait for those hosts to be done, which come first in hosts.
+func rollingDeploy(hosts []nix.Host, budget int, deploy func(host nix.Host) error) error {
+	slots := make(chan bool, budget)
+	done := make(map[string]chan bool)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var firstErr error
+
+	for _, host := range hosts {
+		for _, dependency := range host.DeployAfter {
+			if dependencyDone, ok := done[dependency]; ok {
+				<-dependencyDone
+			}
+		}
+		slots <- true
+		mutex.Lock()
+		failed := firstErr != nil
+		mutex.Unlock()
+		if failed {
+			break
+		}
+
+		hostDone := make(chan bool)
+		done[host.Name] = hostDone
+		wg.Add(1)
+		go func(host nix.Host) {
+			defer wg.Done()
+			defer close(hostDone)
+			err := deploy(host)
+			mutex.Lock()
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			mutex.Unlock()
+			<-slots
+		}(host)
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+// The number of hosts --max-unavailable allows to deploy at a time, given as a number or a percentage of the hosts
+func unavailableBudget(value string, hosts int) (int, error) {
+	budget := 0
+	if strings.HasSuffix(value, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return 0, errors.New(fmt.Sprintf("Invalid --max-unavailable: %s (expected a number of hosts or a percentage up to 100%%)\n", value))
+		}
+		budget = int(float64(hosts) * percent / 100)
+	} else {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return 0, errors.New(fmt.Sprintf("Invalid --max-unavailable: %s (expected a number of hosts or a percentage up to 100%%)\n", value))
+		}
+		budget = n
+	}
+
+	// a percentage of few hosts still deploys one at a time
+	if budget < 1 {
+		budget = 1
+	}
+	return budget, nil
+}
+
+// A step of the deployment of each host
+type deployStep struct {
+	name string
+	run  func(sshContext *ssh.SSHContext, host nix.Host, resultPath string) error
+}
+
+var defaultDeploySteps = []string{"push", "secrets", "activate", "reboot", "healthchecks"}
+
+// Boot the new system with kexec if its kernel changed, or in any case with --reboot. Hosts without kexec are
+// rebooted the usual way.
+func kexecHost(sshContext *ssh.SSHContext, host nix.Host, resultPath string) error {
+	configuration, err := nix.GetNixSystemPath(host, resultPath)
+	if err != nil {
+		return err
+	}
+	log := logging.WithHost(host.Name)
+
+	if !deployReboot {
+		changed, err := host.KernelChanged(sshContext, configuration)
+		if err != nil {
+			log.Warnf("Couldn't tell whether the kernel changed, rebooting anyway: %s\n", err.Error())
+		} else if !changed {
+			log.Infof("The kernel of %s didn't change, not rebooting\n", host.Name)
+			return nil
+		}
+	}
+
+	if !host.SupportsKexec(sshContext) {
+		log.Warnf("%s doesn't support kexec, rebooting instead\n", host.Name)
+		err = host.Reboot(sshContext)
+	} else {
+		err = host.Kexec(sshContext, configuration)
+	}
+	if err != nil {
+		log.Errorf("Reboot failed\n")
+		return err
+	}
+	return nil
+}
+
+// Results of the healthchecks step by host, passed on to the custom steps run after it
+var healthCheckResults = make(map[string]*healthchecks.Report)
+
+// Guards the state shared between hosts deployed at the same time by --max-unavailable
+var deployMutex sync.Mutex
+
+// The steps to run for each host, in the order given by --steps, network.steps or the default order.
+// Built-in steps only do something if enabled, like secrets by --upload-secrets.
+func deploySteps(doPush bool, doUploadSecrets bool, doActivate bool) ([]deployStep, error) {
+	builtin := map[string]func(sshContext *ssh.SSHContext, host nix.Host, resultPath string) error{
+		"push": func(sshContext *ssh.SSHContext, host nix.Host, resultPath string) error {
+			singleHostInList := []nix.Host{host}
+			if doPush && (deployShowDiff || deployChangelog != "") {
+				if err := diffClosures(sshContext, singleHostInList, resultPath); err != nil {
+					return err
+				}
+			}
+			if doPush {
+				if err := pushPaths(sshContext, singleHostInList, resultPath, false); err != nil {
+					return inPhase(exitPush, err)
+				}
+			}
+			logging.Infof("\n")
+			return nil
+		},
+		"secrets": func(sshContext *ssh.SSHContext, host nix.Host, resultPath string) error {
+			if !doUploadSecrets || skipsSecrets(host) {
+				return nil
+			}
+			if err := execUploadSecrets(sshContext, []nix.Host{host}); err != nil {
+				return err
+			}
+			logging.Infof("\n")
+			return nil
+		},
+		"activate": func(sshContext *ssh.SSHContext, host nix.Host, resultPath string) error {
+			if !doActivate {
+				return nil
+			}
+			return inPhase(exitActivation, activateConfiguration(sshContext, []nix.Host{host}, resultPath))
+		},
+		"reboot": func(sshContext *ssh.SSHContext, host nix.Host, resultPath string) error {
+			if deployKexec && doActivate {
+				return kexecHost(sshContext, host, resultPath)
+			}
+			if !deployReboot {
+				return nil
+			}
+			if err := host.Reboot(sshContext); err != nil {
+				logging.WithHost(host.Name).Errorf("Reboot failed\n")
+				return err
+			}
+			return nil
+		},
+		"healthchecks": func(sshContext *ssh.SSHContext, host nix.Host, resultPath string) error {
+			if skipsHealthChecks(host) {
+				return nil
+			}
+			hostReport := runReport.Host(host.Name)
+			results, err := healthchecks.PerformWithReport(sshContext, &host, timeout)
+			if results != nil {
+				deployMutex.Lock()
+				healthCheckResults[host.Name] = results
+				deployMutex.Unlock()
+			}
+			err = hostReport.Record(&hostReport.HealthChecks, err)
+			if err != nil {
+				logging.Infof("\n")
+				logging.Errorf("Not deploying to additional hosts, since a host health check failed.\n")
+				return inPhase(exitHealthChecks, errors.New("Health checks failed on host: "+host.Name+"\n"))
+			}
+			return nil
+		},
+	}
+
+	names := defaultDeploySteps
+	if deploymentMeta.Steps != nil {
+		names = deploymentMeta.Steps
+	}
+	if deployStepOrder != "" {
+		names = strings.Split(deployStepOrder, ",")
+	}
+
+	steps := make([]deployStep, 0, len(names))
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if stringInList(name, skipDeploySteps) {
+			continue
+		}
+		if run, ok := builtin[name]; ok {
+			steps = append(steps, deployStep{name, run})
+		} else if custom, ok := deploymentMeta.CustomSteps[name]; ok {
+			steps = append(steps, deployStep{name, customStep(name, custom)})
+		} else {
+			return nil, errors.New(fmt.Sprintf("Unknown deployment step: %s (neither one of %s, nor declared in network.customSteps)\n", name, strings.Join(defaultDeploySteps, ", ")))
+		}
+	}
+	for _, name := range skipDeploySteps {
+		if _, ok := builtin[name]; !ok {
+			if _, ok := deploymentMeta.CustomSteps[name]; !ok {
+				return nil, errors.New(fmt.Sprintf("Unknown deployment step to skip: %s\n", name))
+			}
+		}
+	}
+
+	return steps, nil
+}
+
+// Run the command of a custom step locally or on the host, with details of the deployment in the environment
+func customStep(name string, step nix.CustomStep) func(sshContext *ssh.SSHContext, host nix.Host, resultPath string) error {
+	return func(sshContext *ssh.SSHContext, host nix.Host, resultPath string) error {
+		if *dryRun {
+			return nil
+		}
+		if len(step.Command) == 0 {
+			return errors.New(fmt.Sprintf("Deployment step %s has no command\n", name))
+		}
+		systemPath, err := nix.GetNixSystemPath(host, resultPath)
+		if err != nil {
+			return err
+		}
+		env := map[string]string{
+			"MORPH_HOST":          host.Name,
+			"MORPH_TARGET_HOST":   host.TargetHost,
+			"MORPH_SYSTEM_PATH":   systemPath,
+			"MORPH_SWITCH_ACTION": deploySwitchAction,
+			"MORPH_HEALTHCHECKS":  "none",
+		}
+
+		// the JSON results of the health checks are passed on stdin, if they have been run
+		var stdin io.Reader
+		deployMutex.Lock()
+		results, ok := healthCheckResults[host.Name]
+		deployMutex.Unlock()
+		if ok {
+			data, err := json.Marshal(results)
+			if err != nil {
+				return err
+			}
+			stdin = bytes.NewReader(data)
+			env["MORPH_HEALTHCHECKS"] = healthCheckStatus(results)
+		}
+
+		log := logging.WithHost(host.Name)
+		log.Infof("Running step %s on %s\n", name, host.Name)
+
+		stdout := utils.NewPrefixWriter(os.Stderr, host.Name+": ")
+		stderr := utils.NewPrefixWriter(os.Stderr, host.Name+": ")
+		defer stdout.Flush()
+		defer stderr.Flush()
+
+		if step.Remote {
+			command := []string{"env"}
+			for key, value := range env {
+				command = append(command, key+"="+utils.ShellQuote(value))
+			}
+			command = append(command, step.Command...)
+			if step.Sudo {
+				command = append([]string{"sudo"}, command...)
+			}
+			ctx, cancel := utils.ContextWithConditionalTimeout(context.TODO(), timeout)
+			defer cancel()
+			err = sshContext.RunContext(ctx, &host, stdin, stdout, stderr, command...)
+			if ctx.Err() != nil {
+				err = errors.New(fmt.Sprintf("timed out after %ds", timeout))
+			}
+		} else {
+			cmd := exec.Command(step.Command[0], step.Command[1:]...)
+			cmd.Dir = filepath.Dir(deployment)
+			cmd.Env = os.Environ()
+			for key, value := range env {
+				cmd.Env = append(cmd.Env, key+"="+value)
+			}
+			cmd.Stdin = stdin
+			cmd.Stdout = stdout
+			cmd.Stderr = stderr
+			err = cmd.Run()
+		}
+		if err != nil {
+			return errors.New(fmt.Sprintf("Deployment step %s failed on %s: %s\n", name, host.Name, err.Error()))
+		}
+
+		logging.Infof("\n")
+		return nil
+	}
+}
+
+// Summary of health check results for custom steps: ok, warnings (only checks with severity warning failed) or failed
+func healthCheckStatus(results *healthchecks.Report) string {
+	failed, warnings := results.Failed()
+	switch {
+	case len(failed) > 0:
+		return "failed"
+	case len(warnings) > 0:
+		return "warnings"
+	default:
+		return "ok"
+	}
+}
+
+// Print what is about to be activated where, and ask whether to go ahead
+func confirmDeployment(hosts []nix.Host, resultPath string) error {
+	targets := make([]nix.Host, 0)
+	for _, host := range hosts {
+		if !host.BuildOnly {
+			targets = append(targets, host)
+		}
+	}
+
+	logging.Infof("About to run '%s' on:\n", deploySwitchAction)
+	for _, host := range targets {
+		configuration, err := nix.GetNixSystemPath(host, resultPath)
+		if err != nil {
+			return err
+		}
+		logging.Infof("\t* %s%s (%s): %s\n", environmentLabel(host), host.Name, host.TargetHost, configuration)
+	}
+	logging.Infof("\n")
+
+	if deployYes {
+		return nil
+	}
+
+	ok, err := utils.Confirm(fmt.Sprintf("Deploy to these %d hosts?", len(targets)))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("Deployment aborted, nothing was activated\n")
+	}
+
+	return nil
+}
+
+func createSSHContext() *ssh.SSHContext {
+	return &ssh.SSHContext{
+		AskForSudoPassword: askForSudoPasswd,
+		IdentityFile:       os.Getenv("SSH_IDENTITY_FILE"),
+		DefaultUsername:    os.Getenv("SSH_USER"),
+		SkipHostKeyCheck:   os.Getenv("SSH_SKIP_HOST_KEY_CHECK") != "",
+		ConfigFile:         os.Getenv("SSH_CONFIG_FILE"),
+		UseSystemSSH:       *useSystemSSH,
+		StrictHostKeys:     *strictHostKeys,
+		Local:              deployLocal,
+		ConnectTimeout:     *connectTimeout,
+		CommandTimeout:     *commandTimeout,
+		JumpHostSessions:   deploymentMeta.JumpHostSessions,
+
+		RepromptSudoPassword: repromptSudoPasswd,
+		SudoPasswordFile:     sudoPasswdFile,
+		SudoPasswordEnv:      sudoPasswdEnv,
+		SudoCredentialsFile:  sudoCredentials,
+	}
+}
+
+// Commands opening connections to the hosts, as opposed to e.g. build, which verify the host keys first
+func connectsToHosts(clause string) bool {
+	switch clause {
+	case push.FullCommand(), deploy.FullCommand(), healthCheck.FullCommand(), rollback.FullCommand(), install.FullCommand(),
+		uploadSecrets.FullCommand(), auditSecrets.FullCommand(), secretsHistory.FullCommand(), agentStatus.FullCommand(),
+		listGenerations.FullCommand(), execute.FullCommand():
+		return true
+	}
+	return false
+}
+
+// Declared host keys have to be valid, and with --strict-host-keys, declared for all hosts morph connects to
+func checkHostKeys(hosts []nix.Host) error {
+	sshHosts := make([]ssh.Host, 0, len(hosts))
+	for i := range hosts {
+		if !hosts[i].BuildOnly {
+			sshHosts = append(sshHosts, &hosts[i])
+		}
+	}
+	return createSSHContext().CheckHostKeys(sshHosts...)
+}
+
+// Health checks are skipped for all hosts by --skip-health-checks, and for hosts opting out with
+// deployment.skipHealthChecks unless --ignore-host-skips is given
+func skipsHealthChecks(host nix.Host) bool {
+	return skipHealthChecks || (host.SkipHealthChecks && !ignoreHostSkips)
+}
+
+func skipsSecrets(host nix.Host) bool {
+	return host.SkipSecrets && !ignoreHostSkips
+}
+
+func execHealthCheck(hosts []nix.Host) error {
+	sshContext := createSSHContext()
+
+	var err error
+	for _, host := range hosts {
+		if host.BuildOnly {
+			logging.Infof("Healthchecks are disabled for build-only host: %s\n", host.Name)
+			continue
+		}
+		if skipsHealthChecks(host) {
+			logging.Infof("Healthchecks are disabled for host: %s\n", host.Name)
+			continue
+		}
+		hostReport := runReport.Host(host.Name)
+		if hostErr := hostReport.Record(&hostReport.HealthChecks, healthchecks.Perform(sshContext, &host, timeout)); hostErr != nil {
+			err = hostErr
+		}
+	}
+
+	if err != nil {
+		err = inPhase(exitHealthChecks, errors.New("One or more errors occurred during host healthchecks"))
+	}
+
+	return err
+}
+
+// Build targets of morph install: the system, and the script partitioning, formatting and mounting the disks
+const installTargets = `{
+  system = node: node.config.system.build.toplevel;
+  disko = node: node.config.system.build.diskoScript or (throw "${node.config.networking.hostName} has no disko configuration (system.build.diskoScript), import the disko NixOS module, or pass --no-format");
+}`
+
+const installTargetsNoFormat = `{ system = node: node.config.system.build.toplevel; }`
+
+// Install hosts booted into a NixOS installer (or any system with nix) like nixos-anywhere: run their disko script,
+// then nixos-install the built system into /mnt
+func execInstall(hosts []nix.Host) error {
+	targets := installTargets
+	if !installFormat {
+		targets = installTargetsNoFormat
+	}
+	resultPath, err := buildHostTargets(hosts, targets)
+	if err != nil {
+		return err
+	}
+	logging.Infof("\n")
+
+	installing := make([]nix.Host, 0)
+	for _, host := range hosts {
+		if host.BuildOnly {
+			logging.Infof("Install is disabled for build-only host: %s\n", host.Name)
+			continue
+		}
+		installing = append(installing, host)
+	}
+
+	if *dryRun {
+		for _, host := range installing {
+			logging.Infof("Would install %s (%s)\n", host.Name, host.TargetHost)
+		}
+		return nil
+	}
+
+	if installFormat && !installYes {
+		logging.Infof("Installing erases all disks declared by the disko configuration of:\n")
+		for _, host := range installing {
+			logging.Infof("\t* %s%s (%s)\n", environmentLabel(host), host.Name, host.TargetHost)
+		}
+		ok, err := utils.Confirm(fmt.Sprintf("Erase the disks of these %d hosts and install NixOS?", len(installing)))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("Install aborted, nothing was changed\n")
+		}
+	}
+
+	sshContext := createSSHContext()
+	for _, host := range installing {
+		hostReport := runReport.Host(host.Name)
+		if err := hostReport.Record(&hostReport.Activation, installHost(sshContext, host, resultPath)); err != nil {
+			return inPhase(exitActivation, err)
+		}
+		logging.Infof("Done: %s\n\n", host.Name)
+	}
+
+	return nil
+}
+
+func installHost(sshContext *ssh.SSHContext, host nix.Host, resultPath string) error {
+	log := logging.WithHost(host.Name)
+	paths, err := nix.GetBuildTargetPaths(host, resultPath)
+	if err != nil {
+		return err
+	}
+	runReport.Host(host.Name).SystemPath = paths["system"]
+
+	// the installer's store is usually in memory, the installed system is copied to /mnt by nixos-install
+	pushing := []string{paths["system"]}
+	if installFormat {
+		pushing = append(pushing, paths["disko"])
+	}
+	log.Infof("Pushing paths to %v (%v@%v):\n", host.Name, host.TargetUser, host.TargetHost)
+	for _, path := range pushing {
+		log.Infof("\t* %s\n", path)
+	}
+	if err := nix.Push(sshContext, host, pushing...); err != nil {
+		return inPhase(exitPush, err)
+	}
+
+	if installFormat {
+		log.Infof("Partitioning, formatting and mounting the disks of %s\n", host.Name)
+		if err := sshContext.Run(&host, nil, os.Stderr, os.Stderr, "sudo", paths["disko"]); err != nil {
+			return err
+		}
+	}
+
+	log.Infof("Installing %s\n", paths["system"])
+	err = sshContext.Run(&host, nil, os.Stderr, os.Stderr, "sudo", "nixos-install", "--root", "/mnt", "--system", paths["system"],
+		"--no-root-passwd", "--no-channel-copy")
+	if err != nil {
+		return err
+	}
+
+	if installReboot {
+		// the installed system has new host keys, so there is no waiting for it to come back
+		log.Infof("Rebooting %s into the installed system\n", host.Name)
+		if err := sshContext.Run(&host, nil, os.Stderr, os.Stderr, "sudo", "reboot"); err != nil && !ssh.IsDisconnected(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Switch the hosts back to their previous system one after the other, stopping at the first host failing its health checks
+func execRollback(hosts []nix.Host) error {
+	sshContext := createSSHContext()
+
+	for _, host := range hosts {
+		if host.BuildOnly {
+			logging.Infof("Rollback is disabled for build-only host: %s\n", host.Name)
+			continue
+		}
+
+		logging.Infof("** %s\n", host.Name)
+		if *dryRun {
+			logging.Infof("Would switch %s back to its previous generation\n\n", host.Name)
+			continue
+		}
+
+		if len(host.PreActivation) > 0 || len(host.PostActivation) > 0 {
+			logging.WithHost(host.Name).Warnf("Not running the preActivation and postActivation commands of %s for the rollback\n", host.Name)
+		}
+
+		hostReport := runReport.Host(host.Name)
+		configuration, err := sshContext.Rollback(&host)
+		if hostReport.Record(&hostReport.Activation, err) != nil {
+			return inPhase(exitActivation, err)
+		}
+		hostReport.SystemPath = configuration
+		logging.WithHost(host.Name).Infof("Switched %s back to %s\n", host.Name, configuration)
+
+		if !skipsHealthChecks(host) {
+			err = hostReport.Record(&hostReport.HealthChecks, healthchecks.Perform(sshContext, &host, timeout))
+			if err != nil {
+				logging.Errorf("Not rolling back additional hosts, since a host health check failed.\n")
+				return inPhase(exitHealthChecks, errors.New("Health checks failed on host: "+host.Name+"\n"))
+			}
+		}
+
+		logging.Infof("Done: %s\n\n", host.Name)
+	}
+
+	return nil
+}
+
+// Migrating a host means provisioning the new machine with the secrets of the host, along with the secrets manifest
+// (and so the history of the secrets) and the deployment info of the old machine; the NixOS configuration follows on
+// deploy. The state morph keeps locally refers to hosts by name, so it applies to the new machine as it is.
+func execMigrateHost() error {
+	if migrateHostKey != "" && migrateAcceptKey {
+		return errors.New("Only one of --new-host-key and --accept-new-host-key can be given")
+	}
+	if migrateAcceptKey && *strictHostKeys {
+		return errors.New("--accept-new-host-key can't be combined with --strict-host-keys")
+	}
+
+	deploymentAbsPath, err := filepath.Abs(deployment)
+	if err != nil {
+		return err
+	}
+	machines, err := getNixContext().GetMachines(deploymentAbsPath)
+	if err != nil {
+		return err
+	}
+	deploymentMeta = machines.Meta
+
+	var host *nix.Host
+	for i := range machines.Hosts {
+		candidate := &machines.Hosts[i]
+		if candidate.Name == migrateOld || candidate.TargetHost == migrateOld || candidate.TargetHost == migrateNew {
+			host = candidate
+			break
+		}
+	}
+	if host == nil {
+		return errors.New(fmt.Sprintf("No host named or targeting %s or %s in the deployment\n", migrateOld, migrateNew))
+	}
+	if host.BuildOnly {
+		return errors.New(fmt.Sprintf("Can't migrate build-only host: %s\n", host.Name))
+	}
+
+	oldHost := *host
+	if migrateOld != host.Name {
+		oldHost.TargetHost = migrateOld
+	}
+	if oldHost.TargetHost == migrateNew && !migrateSkipState {
+		return errors.New(fmt.Sprintf("deployment.targetHost of %s already is %s; give the address of the old machine instead of its name, or --skip-state\n", host.Name, migrateNew))
+	}
+
+	// the old machine keeps the declared host key, which the new one may not have
+	newHost := *host
+	newHost.TargetHost = migrateNew
+	if migrateHostKey != "" || migrateAcceptKey {
+		newHost.HostKey = migrateHostKey
+		newHost.KnownHostsFile = ""
+	}
+
+	checkedHosts := []nix.Host{newHost}
+	if !migrateSkipState {
+		checkedHosts = append(checkedHosts, oldHost)
+	}
+	if err = checkHostKeys(checkedHosts); err != nil {
+		return err
+	}
+
+	runReport.AddHost(newHost.Name, newHost.TargetHost, newHost.GetTags())
+
+	logging.Infof("Migrating %s from %s to %s\n\n", host.Name, oldHost.TargetHost, migrateNew)
+
+	// the machines are connections of their own, as they share the name of the host
+	newContext := createSSHContext()
+	newContext.SkipHostKeyCheck = newContext.SkipHostKeyCheck || migrateAcceptKey
+
+	if !migrateSkipState {
+		oldContext := createSSHContext()
+
+		logging.Infof("Copying the secrets manifest and deployment info from %s ... ", oldHost.TargetHost)
+		manifest, err := secrets.ReadManifest(oldContext, &oldHost)
+		if err != nil {
+			logging.Failed("to read the secrets manifest of " + oldHost.TargetHost)
+			return err
+		}
+		info, err := readDeploymentInfo(oldContext, oldHost)
+		if err != nil {
+			logging.Failed("to read the deployment info of " + oldHost.TargetHost)
+			return err
+		}
+
+		if len(manifest.Versions) > 0 {
+			if err = secrets.WriteManifest(newContext, &newHost, manifest); err != nil {
+				logging.Failed("to write the secrets manifest to " + migrateNew)
+				return err
+			}
+		}
+		if info != nil {
+			if err = uploadDeploymentInfo(newContext, newHost, info); err != nil {
+				logging.Failed("to write the deployment info to " + migrateNew)
+				return err
+			}
+		}
+		logging.Infof("OK (%d secrets manifest version(s))\n\n", len(manifest.Versions))
+	}
+
+	// the new machine doesn't run the configuration of the host until it has been deployed to
+	skipHealthChecks = true
+
+	err = execUploadSecrets(newContext, []nix.Host{newHost})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case host.TargetHost != migrateNew && migrateHostKey != "":
+		logging.Infof("\nUpdate deployment.targetHost of %s to %s and deployment.hostKey to the new key, and deploy to it.\n", host.Name, migrateNew)
+	case host.TargetHost != migrateNew:
+		logging.Infof("\nUpdate deployment.targetHost of %s to %s, and deploy to it.\n", host.Name, migrateNew)
+	case migrateHostKey != "":
+		logging.Infof("\nUpdate deployment.hostKey of %s to the new key, and deploy to it.\n", host.Name)
+	}
+
+	return nil
+}
+
+// Run a complete deployment (push, secrets, activation and health checks) against a local VM
+func execSelfTest() error {
+	utils.ValidateEnvironment("nix-build")
+
+	dir, err := ioutil.TempDir("", "morph-self-test-")
+	if err != nil {
+		return err
+	}
+	vm, err := selftest.New(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	utils.AddFinalizer(func() {
+		vm.Stop()
+		os.RemoveAll(dir)
+	})
+
+	logging.Infof("Building the self-test VM:\n")
+	nixArgs := make([]string, 0)
+	for _, path := range *includePaths {
+		nixArgs = append(nixArgs, "-I", path)
+	}
+	err = vm.Build(filepath.Join(assetRoot, assets.Friendly, "self-test-vm.nix"), nixArgs...)
+	if err != nil {
+		return err
+	}
+
+	logging.Infof("Booting the self-test VM (SSH on port %d) ... ", vm.Port)
+	err = vm.Start()
+	if err != nil {
+		logging.Failed("to boot the self-test VM")
+		return err
+	}
+
+	// the VM has a new host key on every run, which isn't worth adding to known_hosts
+	os.Setenv("SSH_IDENTITY_FILE", vm.IdentityFile)
+	os.Setenv("SSH_SKIP_HOST_KEY_CHECK", "1")
+
+	err = vm.WaitForSSH(createSSHContext(), time.Duration(timeout)*time.Second)
+	if err != nil {
+		logging.Failed("to boot the self-test VM")
+		return err
+	}
+	logging.Infof("OK\n\n")
+
+	deployment, err = vm.WriteDeployment(filepath.Join(assetRoot, assets.Friendly, "self-test-deployment.nix"))
+	if err != nil {
+		return err
+	}
+
+	selectGlobs = nil
+	selectEvery = 1
+	deploySwitchAction = "test"
+	deployUploadSecrets = true
+
+	hosts, err := getHosts(deployment)
+	if err != nil {
+		return err
+	}
+	_, err = execDeploy(hosts)
+	if err != nil {
+		return err
+	}
+
+	logging.Infof("\nSelf-test passed\n")
+
+	return nil
+}
+
+func execUploadSecrets(sshContext *ssh.SSHContext, hosts []nix.Host) error {
+	for _, host := range hosts {
+		if host.BuildOnly {
+			logging.Infof("Secret upload is disabled for build-only host: %s\n", host.Name)
+			continue
+		}
+		if skipsSecrets(host) {
+			logging.Infof("Secret upload is disabled for host: %s\n", host.Name)
+			continue
+		}
+		singleHostInList := []nix.Host{host}
+		hostReport := runReport.Host(host.Name)
+
+		err := hostReport.Record(&hostReport.Secrets, inPhase(exitSecrets, secretsUpload(sshContext, singleHostInList)))
+		if err != nil {
+			return err
+		}
+
+		if !skipsHealthChecks(host) {
+			err = hostReport.Record(&hostReport.HealthChecks, inPhase(exitHealthChecks, healthchecks.Perform(sshContext, &host, timeout)))
+			if err != nil {
+				logging.Infof("\n")
+				logging.Errorf("Not uploading to additional hosts, since a host health check failed.\n")
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Write the addresses, environments, tags and roles of the hosts to stdout; build-only hosts aren't reachable, and left out
+func execExportInventory(hosts []nix.Host) error {
+	inventoryHosts := make([]inventory.Host, 0, len(hosts))
+	for _, host := range hosts {
+		if host.BuildOnly {
+			continue
+		}
+		inventoryHosts = append(inventoryHosts, inventory.Host{
+			Name:         host.Name,
+			TargetHost:   host.TargetHost,
+			TargetUser:   host.TargetUser,
+			TargetPort:   host.TargetPort,
+			Environment:  host.Environment,
+			Tags:         host.Tags,
+			Roles:        host.Roles,
+			NixosRelease: host.NixosRelease,
+		})
+	}
+
+	return inventory.Write(os.Stdout, inventoryFormat, inventoryHosts)
+}
+
+// List the generations of the system profile of the hosts, marking the one running
+func execListGenerations(hosts []nix.Host) error {
+	sshContext := createSSHContext()
+
+	type hostGenerations struct {
+		Name        string           `json:"name"`
+		Generations []ssh.Generation `json:"generations"`
+		Error       string           `json:"error,omitempty"`
+	}
+	results := make([]hostGenerations, 0, len(hosts))
+
+	failed := false
+	for _, host := range hosts {
+		if host.BuildOnly {
+			continue
+		}
+		generations, err := sshContext.ListGenerations(&host)
+		entry := hostGenerations{Name: host.Name, Generations: generations}
+		if err != nil {
+			entry.Error = err.Error()
+			failed = true
+		}
+		results = append(results, entry)
+	}
+
+	if asJson {
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "%s\n", data)
+	} else {
+		for _, entry := range results {
+			if entry.Error != "" {
+				fmt.Fprintf(os.Stdout, "%s: %s\n", entry.Name, entry.Error)
+				continue
+			}
+			fmt.Fprintf(os.Stdout, "%s:\n", entry.Name)
+			for _, generation := range entry.Generations {
+				current := ""
+				if generation.Current {
+					current = " (current)"
+				}
+				fmt.Fprintf(os.Stdout, "\t%5d  %s  %-24s %s%s\n", generation.Number, generation.Date.Local().Format("2006-01-02 15:04:05"),
+					generation.Version, generation.SystemPath, current)
+			}
+		}
+	}
+
+	if failed {
+		return errors.New("Couldn't list the generations of one or more hosts\n")
+	}
+	return nil
+}
+
+// Ask the agents of the hosts for their state; hosts without an agent are reported as unreachable
+func execAgentStatus(hosts []nix.Host) error {
+	sshContext := createSSHContext()
+
+	type hostStatus struct {
+		Name   string        `json:"name"`
+		Status *agent.Status `json:"status,omitempty"`
+		Error  string        `json:"error,omitempty"`
+	}
+	statuses := make([]hostStatus, 0, len(hosts))
+
+	failed := false
+	for _, host := range hosts {
+		if host.BuildOnly {
+			continue
+		}
+		status, err := sshContext.AgentStatus(&host)
+		entry := hostStatus{Name: host.Name, Status: status}
+		if err != nil {
+			entry.Error = err.Error()
+			failed = true
+		}
+		statuses = append(statuses, entry)
+	}
+
+	if asJson {
+		data, err := json.MarshalIndent(statuses, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "%s\n", data)
+	} else {
+		for _, entry := range statuses {
+			if entry.Status == nil {
+				fmt.Fprintf(os.Stdout, "%s: %s\n", entry.Name, entry.Error)
+				continue
+			}
+			status := entry.Status
+			fmt.Fprintf(os.Stdout, "%s: %s, up %s\n", entry.Name, status.SystemState, time.Duration(status.Uptime)*time.Second)
+			fmt.Fprintf(os.Stdout, "\tSystem: %s\n", status.CurrentSystem)
+			if status.BootedSystem != status.CurrentSystem {
+				fmt.Fprintf(os.Stdout, "\tBooted: %s\n", status.BootedSystem)
+			}
+			if len(status.FailedUnits) > 0 {
+				fmt.Fprintf(os.Stdout, "\tFailed units: %s\n", strings.Join(status.FailedUnits, ", "))
+			}
+			fmt.Fprintf(os.Stdout, "\tAgent: %s\n", status.AgentVersion)
+		}
+	}
+
+	if failed {
+		return errors.New("One or more hosts didn't report their state\n")
+	}
+	return nil
+}
+
+func execListSecrets(hosts []nix.Host) {
+	for _, host := range hosts {
+		singleHostInList := []nix.Host{host}
+		for _, host := range singleHostInList {
+			fmt.Fprintf(os.Stdout, "Secrets for host %s:\n", host.Name)
+			for name, secret := range host.Secrets {
+				fmt.Fprintf(os.Stdout, "%s:\n- %v\n", name, &secret)
+			}
+			fmt.Fprintf(os.Stdout, "\n")
 		}
+	}
+}
 
-		if deployReboot {
-			err = host.Reboot(sshContext)
-			if err != nil {
-				fmt.Fprintln(os.Stderr, "Reboot failed")
-				return "", err
-			}
-		}
+func execListSecretsAsJson(hosts []nix.Host) error {
+	deploymentDir, err := filepath.Abs(filepath.Dir(deployment))
+	if err != nil {
+		return err
+	}
+	secretsByHost := make(map[string](map[string]secrets.Secret))
 
-		if !skipHealthChecks {
-			err := healthchecks.Perform(sshContext, &host, timeout)
-			if err != nil {
-				fmt.Fprintln(os.Stderr)
-				fmt.Fprintln(os.Stderr, "Not deploying to additional hosts, since a host health check failed.")
-				utils.Exit(1)
+	for _, host := range hosts {
+		singleHostInList := []nix.Host{host}
+		for _, host := range singleHostInList {
+			canonicalSecrets := make(map[string]secrets.Secret)
+			for name, secret := range host.Secrets {
+				if secret.Source != "" {
+					secret.Source = utils.GetAbsPathRelativeTo(secret.Source, deploymentDir)
+				}
+				if secret.SopsFile != "" {
+					secret.SopsFile = utils.GetAbsPathRelativeTo(secret.SopsFile, deploymentDir)
+				}
+				if secret.AgeIdentity != "" && !strings.HasPrefix(secret.AgeIdentity, "~") {
+					secret.AgeIdentity = utils.GetAbsPathRelativeTo(secret.AgeIdentity, deploymentDir)
+				}
+				canonicalSecrets[name] = secret
 			}
+			secretsByHost[host.Name] = canonicalSecrets
 		}
-
-		fmt.Fprintln(os.Stderr, "Done:", host.Name)
 	}
 
-	return resultPath, nil
-}
-
-func createSSHContext() *ssh.SSHContext {
-	return &ssh.SSHContext{
-		AskForSudoPassword: askForSudoPasswd,
-		IdentityFile:       os.Getenv("SSH_IDENTITY_FILE"),
-		DefaultUsername:    os.Getenv("SSH_USER"),
-		SkipHostKeyCheck:   os.Getenv("SSH_SKIP_HOST_KEY_CHECK") != "",
-		ConfigFile:         os.Getenv("SSH_CONFIG_FILE"),
+	jsonSecrets, err := json.MarshalIndent(secretsByHost, "", "  ")
+	if err != nil {
+		return err
 	}
+	fmt.Fprintf(os.Stdout, "%s\n", jsonSecrets)
+
+	return nil
 }
 
-func execHealthCheck(hosts []nix.Host) error {
+func execAuditSecrets(hosts []nix.Host) error {
 	sshContext := createSSHContext()
 
-	var err error
+	problems := 0
 	for _, host := range hosts {
 		if host.BuildOnly {
-			fmt.Fprintf(os.Stderr, "Healthchecks are disabled for build-only host: %s\n", host.Name)
+			logging.Infof("Secret audit is disabled for build-only host: %s\n", host.Name)
 			continue
 		}
-		err = healthchecks.Perform(sshContext, &host, timeout)
+		log := logging.WithHost(host.Name)
+		log.Infof("Auditing secrets on %s (%s):\n", host.Name, host.TargetHost)
+		for name, secret := range host.Secrets {
+			findings, err := secrets.AuditSecret(sshContext, &host, name, secret)
+			if err != nil {
+				return err
+			}
+			if len(findings) == 0 {
+				log.Infof("\t* %s: OK\n", name)
+			}
+			for _, finding := range findings {
+				fmt.Fprintf(os.Stdout, "%s: %s\n", host.Name, finding)
+			}
+			problems += len(findings)
+		}
+		logging.Infof("\n")
 	}
 
-	if err != nil {
-		err = errors.New("One or more errors occurred during host healthchecks")
+	if problems > 0 {
+		return errors.New(fmt.Sprintf("Found %d problem(s) with secrets\n", problems))
 	}
 
-	return err
+	return nil
 }
 
-func execUploadSecrets(sshContext *ssh.SSHContext, hosts []nix.Host) error {
+func execSecretsHistory(hosts []nix.Host) error {
+	sshContext := createSSHContext()
+
+	manifests := make(map[string]secrets.Manifest)
 	for _, host := range hosts {
 		if host.BuildOnly {
-			fmt.Fprintf(os.Stderr, "Secret upload is disabled for build-only host: %s\n", host.Name)
+			logging.Infof("Secrets are disabled for build-only host: %s\n", host.Name)
 			continue
 		}
-		singleHostInList := []nix.Host{host}
+		manifest, err := secrets.ReadManifest(sshContext, &host)
+		if err != nil {
+			return err
+		}
+		manifests[host.Name] = manifest
+	}
 
-		err := secretsUpload(sshContext, singleHostInList)
+	if asJson {
+		jsonManifests, err := json.MarshalIndent(manifests, "", "  ")
 		if err != nil {
 			return err
 		}
+		fmt.Fprintf(os.Stdout, "%s\n", jsonManifests)
+		return nil
+	}
 
-		if !skipHealthChecks {
-			err = healthchecks.Perform(sshContext, &host, timeout)
-			if err != nil {
-				fmt.Fprintln(os.Stderr)
-				fmt.Fprintln(os.Stderr, "Not uploading to additional hosts, since a host health check failed.")
-				return err
+	for _, host := range hosts {
+		manifest, ok := manifests[host.Name]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(os.Stdout, "%s:\n", host.Name)
+		if len(manifest.Versions) == 0 {
+			fmt.Fprintf(os.Stdout, "\tno secrets uploaded by morph\n")
+		}
+		for _, version := range manifest.Versions {
+			fmt.Fprintf(os.Stdout, "\tversion %d, uploaded %s by run %s:\n", version.Version, version.Uploaded.Local().Format(time.RFC3339), version.RunId)
+			names := make([]string, 0, len(version.Secrets))
+			for name := range version.Secrets {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				entry := version.Secrets[name]
+				fmt.Fprintf(os.Stdout, "\t\t* %s -> %s (sha256 %.12s, %d bytes)\n", name, entry.Destination, entry.Sha256, entry.Size)
 			}
 		}
 	}
@@ -448,157 +2509,598 @@ func execUploadSecrets(sshContext *ssh.SSHContext, hosts []nix.Host) error {
 	return nil
 }
 
-func execListSecrets(hosts []nix.Host) {
-	for _, host := range hosts {
-		singleHostInList := []nix.Host{host}
-		for _, host := range singleHostInList {
-			fmt.Fprintf(os.Stdout, "Secrets for host %s:\n", host.Name)
-			for name, secret := range host.Secrets {
-				fmt.Fprintf(os.Stdout, "%s:\n- %v\n", name, &secret)
+func getHosts(deploymentPath string) (hosts []nix.Host, err error) {
+
+	deploymentFile, err := os.Open(deploymentPath)
+	if err != nil {
+		return hosts, err
+	}
+
+	deploymentAbsPath, err := filepath.Abs(deploymentFile.Name())
+	if err != nil {
+		return hosts, err
+	}
+
+	ctx := getNixContext()
+	deployment, err := ctx.GetMachines(deploymentAbsPath)
+	if err != nil {
+		return hosts, inPhase(exitEval, err)
+	}
+	deploymentMeta = deployment.Meta
+	for _, warning := range deployment.Meta.Warnings {
+		logging.Warnf("Warning: %s\n", warning)
+	}
+
+	globs := make([]string, 0, len(selectGlobs))
+	for _, glob := range selectGlobs {
+		if glob == "-" {
+			selectFile = "-"
+		} else {
+			globs = append(globs, glob)
+		}
+	}
+	if len(globs) == 0 {
+		globs = append(globs, "*")
+	}
+	selectGlobs = globs
+	if selectFile != "" {
+		if selectNames, err = readHostNames(selectFile); err != nil {
+			return hosts, err
+		}
+	}
+
+	matchingHosts, err := filter.MatchHostsGlobs(deployment.Hosts, selectGlobs, selectIntersect, selectExcept...)
+	if err != nil {
+		return hosts, err
+	}
+	if selectFile != "" {
+		matchingHosts = filter.MatchHostNames(matchingHosts, selectNames)
+	}
+	if resumeState != nil {
+		matchingHosts = filter.MatchHostNames(matchingHosts, resumeState.Hosts)
+	}
+	if selectRegex != "" {
+		matchingHosts, err = filter.MatchHostsRegex(matchingHosts, selectRegex)
+		if err != nil {
+			return hosts, err
+		}
+	}
+
+	var selectedTags []string
+	if selectTags != "" {
+		selectedTags = strings.Split(selectTags, ",")
+	}
+
+	if err := checkUnmatchedSelectors(deployment.Hosts, append(selectedTags, selectAnyTags...)); err != nil {
+		return hosts, err
+	}
+
+	matchingHosts2 := filter.FilterHostsAnyTag(filter.FilterHostsTags(matchingHosts, selectedTags), selectAnyTags)
+
+	ordering := deployment.Meta.Ordering
+	if orderingTags != "" {
+		ordering = nix.HostOrdering{Tags: strings.Split(orderingTags, ",")}
+	}
+
+	sortedHosts := filter.SortHosts(matchingHosts2, ordering)
+
+	filteredHosts := filter.FilterHosts(sortedHosts, selectSkip, selectEvery, selectLimit)
+
+	if err := checkDependencies(deployment.Hosts); err != nil {
+		return hosts, err
+	}
+	filteredHosts, err = filter.SortByDependencies(filteredHosts)
+	if err != nil {
+		return hosts, err
+	}
+	if err := overrideTargets(filteredHosts); err != nil {
+		return hosts, err
+	}
+
+	logging.Infof("Selected %v/%v hosts (name filter:-%v, limits:-%v):\n", len(filteredHosts), len(deployment.Hosts), len(deployment.Hosts)-len(matchingHosts), len(matchingHosts)-len(filteredHosts))
+	for index, host := range filteredHosts {
+		runReport.AddHost(host.Name, host.TargetHost, host.GetTags()).Environment = host.Environment
+		logging.Infof("\t%3d: %s%s (secrets: %d, health checks: %d, tags: %s, roles: %s)\n", index, environmentLabel(host), host.Name, len(host.Secrets), len(host.HealthChecks.Cmd)+len(host.HealthChecks.Http)+len(host.HealthChecks.Port)+len(host.HealthChecks.Dns)+len(host.HealthChecks.Systemd), strings.Join(host.GetTags(), ","), strings.Join(host.Roles, ","))
+	}
+	logging.Infof("\n")
+
+	if err := checkEnvironments(filteredHosts); err != nil {
+		return hosts, err
+	}
+
+	return filteredHosts, nil
+}
+
+// Apply --target-host and --target-user to the selected hosts. A single address (or this machine, with --local) can
+// only stand in for a single host.
+func overrideTargets(hosts []nix.Host) error {
+	if overrideTargetHost != "" && len(hosts) != 1 {
+		return errors.New(fmt.Sprintf("--target-host needs exactly one selected host, %d are selected\n", len(hosts)))
+	}
+	if deployLocal && len(hosts) != 1 {
+		return errors.New(fmt.Sprintf("--local needs exactly one selected host, %d are selected\n", len(hosts)))
+	}
+	if deployLocal && overrideTargetHost != "" {
+		return errors.New("--local and --target-host can't be combined\n")
+	}
+	for i := range hosts {
+		if overrideTargetHost != "" {
+			logging.Infof("Connecting to %s at %s instead of %s\n", hosts[i].Name, overrideTargetHost, hosts[i].TargetHost)
+			hosts[i].TargetHost = overrideTargetHost
+		}
+		if overrideTargetUser != "" {
+			hosts[i].TargetUser = overrideTargetUser
+		}
+	}
+	return nil
+}
+
+// Hosts may only be deployed after hosts of the deployment
+func checkDependencies(allHosts []nix.Host) error {
+	names := make(map[string]bool)
+	for _, host := range allHosts {
+		names[host.Name] = true
+	}
+	for _, host := range allHosts {
+		for _, dependency := range host.DeployAfter {
+			if !names[dependency] {
+				return errors.New(fmt.Sprintf("Host %s is to be deployed after %s, which isn't a host of the deployment\n", host.Name, dependency))
 			}
-			fmt.Fprintf(os.Stdout, "\n")
 		}
 	}
+	return nil
 }
 
-func execListSecretsAsJson(hosts []nix.Host) error {
-	deploymentDir, err := filepath.Abs(filepath.Dir(deployment))
+// The host names given by --on-file, or on stdin
+func readHostNames(file string) ([]string, error) {
+	if file == "-" {
+		return filter.ReadHostNames(os.Stdin)
+	}
+
+	f, err := os.Open(file)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	secretsByHost := make(map[string](map[string]secrets.Secret))
+	defer f.Close()
+	return filter.ReadHostNames(f)
+}
+
+// Catch typos in the selectors, which would otherwise silently deploy to fewer hosts than intended
+func checkUnmatchedSelectors(allHosts []nix.Host, selectedTags []string) error {
+	unmatched := make([]string, 0)
+	for _, glob := range selectGlobs {
+		unmatched = append(unmatched, filter.UnmatchedPatterns(allHosts, glob)...)
+	}
+	unmatched = append(unmatched, filter.UnmatchedNames(allHosts, selectNames)...)
+	if selectRegex != "" {
+		if regexHosts, err := filter.MatchHostsRegex(allHosts, selectRegex); err == nil && len(regexHosts) == 0 {
+			unmatched = append(unmatched, "--on-regex "+selectRegex)
+		}
+	}
+	for _, pattern := range selectExcept {
+		for _, alternative := range filter.UnmatchedPatterns(allHosts, pattern) {
+			unmatched = append(unmatched, "--except "+alternative)
+		}
+	}
+	for _, tag := range filter.UnmatchedTags(allHosts, selectedTags) {
+		unmatched = append(unmatched, "tag "+tag)
+	}
+	if len(unmatched) == 0 {
+		return nil
+	}
+
+	if ignoreMissing {
+		logging.Warnf("Warning: No hosts match: %s\n", strings.Join(unmatched, ", "))
+		return nil
+	}
+	return errors.New(fmt.Sprintf("No hosts match: %s (pass --ignore-missing to continue with the matching hosts)\n", strings.Join(unmatched, ", ")))
+}
 
+// Prominent prefix for the name of a host in an environment, e.g. "[PRODUCTION] "
+func environmentLabel(host nix.Host) string {
+	if host.Environment == "" {
+		return ""
+	}
+	return "[" + strings.ToUpper(host.Environment) + "] "
+}
+
+// Guard against selecting hosts of the wrong environment, e.g. production hosts matched by a glob meant for staging
+func checkEnvironments(hosts []nix.Host) error {
+	notAllowed := make([]string, 0)
+	forbidden := make([]string, 0)
 	for _, host := range hosts {
-		singleHostInList := []nix.Host{host}
-		for _, host := range singleHostInList {
-			canonicalSecrets := make(map[string]secrets.Secret)
-			for name, secret := range host.Secrets {
-				sourcePath := utils.GetAbsPathRelativeTo(secret.Source, deploymentDir)
-				secret.Source = sourcePath
-				canonicalSecrets[name] = secret
-			}
-			secretsByHost[host.Name] = canonicalSecrets
+		environment := host.Environment
+		if environment == "" {
+			environment = "none"
+		}
+		if len(onlyEnvironments) > 0 && !stringInList(host.Environment, onlyEnvironments) {
+			notAllowed = append(notAllowed, fmt.Sprintf("%s (%s)", host.Name, environment))
+		} else if stringInList(host.Environment, forbidEnvironments) {
+			forbidden = append(forbidden, fmt.Sprintf("%s (%s)", host.Name, environment))
+		}
+	}
+
+	violations := make([]string, 0, 2)
+	if len(notAllowed) > 0 {
+		violations = append(violations, fmt.Sprintf("selected hosts not in the allowed environments (%s): %s",
+			strings.Join(onlyEnvironments, ", "), strings.Join(notAllowed, ", ")))
+	}
+	if len(forbidden) > 0 {
+		violations = append(violations, fmt.Sprintf("selected hosts in a forbidden environment: %s", strings.Join(forbidden, ", ")))
+	}
+	if len(violations) > 0 {
+		return errors.New(fmt.Sprintf("Refusing to continue, %s\n", strings.Join(violations, "; ")))
+	}
+	return nil
+}
+
+func stringInList(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func getNixContext() *nix.NixContext {
+	maxJobs := deploymentMeta.MaxJobs
+	if buildMaxJobs != "" {
+		maxJobs = buildMaxJobs
+	}
+	cores := deploymentMeta.Cores
+	if buildCores != "" {
+		cores = buildCores
+	}
+
+	return &nix.NixContext{
+		EvalMachines:    filepath.Join(assetRoot, assets.Friendly, "eval-machines.nix"),
+		EvalOptions:     filepath.Join(assetRoot, assets.Friendly, "eval-options.nix"),
+		ShowTrace:       showTrace,
+		KeepGCRoot:      *keepGCRoot,
+		AllowBuildShell: *allowBuildShell,
+		IncludePaths:    *includePaths,
+		Builders:        deploymentMeta.Builders,
+		NixOptions:      *extraNixOptions,
+		NixArgs:         *extraNixArgs,
+		MaxJobs:         maxJobs,
+		Cores:           cores,
+		EvalCache:       *evalCache,
+	}
+}
+
+func buildHosts(hosts []nix.Host) (resultPath string, err error) {
+	nixBuildTargets := ""
+	if nixBuildTargetFile != "" {
+		if path, err := filepath.Abs(nixBuildTargetFile); err == nil {
+			nixBuildTargets = fmt.Sprintf("import \"%s\"", path)
+		}
+	} else if nixBuildTarget != "" {
+		nixBuildTargets = fmt.Sprintf("{ \"out\" = %s; }", nixBuildTarget)
+	}
+
+	return buildHostTargets(hosts, nixBuildTargets)
+}
+
+// Build the given targets of the hosts, or their systems if nixBuildTargets is empty
+func buildHostTargets(hosts []nix.Host, nixBuildTargets string) (resultPath string, err error) {
+	if len(hosts) == 0 {
+		err = errors.New("No hosts selected")
+		return
+	}
+
+	deploymentPath, err := filepath.Abs(deployment)
+	if err != nil {
+		return
+	}
+
+	ctx := getNixContext()
+	resultPath, err = ctx.BuildMachines(deploymentPath, hosts, nixBuildArg, nixBuildTargets)
+
+	if err != nil {
+		err = inPhase(exitBuild, err)
+		return
+	}
+
+	recordResult(hosts, resultPath)
+
+	if signingKeyFile != "" && !*dryRun {
+		if err = signSystems(hosts, resultPath); err != nil {
+			err = inPhase(exitBuild, err)
+			return
+		}
+	}
+
+	if len(binaryCaches) > 0 && !*dryRun {
+		if err = pushToCaches(hosts, resultPath); err != nil {
+			err = inPhase(exitPush, err)
+			return
+		}
+	}
+
+	logging.Infof("nix result path: \n")
+	if asJson {
+		logging.Infof("%s\n", resultPath)
+	} else {
+		fmt.Println(resultPath)
+	}
+	return
+}
+
+func recordResult(hosts []nix.Host, resultPath string) {
+	runReport.ResultPath = resultPath
+	for _, host := range hosts {
+		if systemPath, err := nix.GetNixSystemPath(host, resultPath); err == nil {
+			runReport.Host(host.Name).SystemPath = systemPath
 		}
 	}
+	logSystemGroups(hosts, resultPath)
+}
+
+// Sign the closures of the systems of all hosts with the key given by --sign-key, before they are pushed anywhere
+func signSystems(hosts []nix.Host, resultPath string) error {
+	paths := make([]string, 0)
+	for _, group := range systemGroups(hosts, resultPath) {
+		paths = append(paths, group.systemPath)
+	}
+	if len(paths) == 0 {
+		return nil
+	}
 
-	jsonSecrets, err := json.MarshalIndent(secretsByHost, "", "  ")
+	keyFile, err := filepath.Abs(signingKeyFile)
 	if err != nil {
 		return err
 	}
-	fmt.Fprintf(os.Stdout, "%s\n", jsonSecrets)
+	logging.Infof("Signing %d systems with %s\n", len(paths), keyFile)
+	return nix.SignPaths(nil, keyFile, paths...)
+}
 
+// Copy the systems of all hosts to the binary caches given by --push-to-cache, for other operators, CI runs and the
+// hosts themselves to substitute from
+func pushToCaches(hosts []nix.Host, resultPath string) error {
+	paths := make([]string, 0)
+	for _, group := range systemGroups(hosts, resultPath) {
+		paths = append(paths, group.systemPath)
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+
+	for _, uri := range binaryCaches {
+		logging.Infof("Pushing %d systems to the binary cache %s\n", len(paths), uri)
+		err := utils.Retry(retryPolicy(), anyError, logRetry(&logging.Logger{}), func() error {
+			return nix.PushToCache(uri, hosts[0], paths...)
+		})
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func getHosts(deploymentPath string) (hosts []nix.Host, err error) {
+// Hosts with identical configurations build to the same system, which is only pushed in full once per group
+type systemGroup struct {
+	systemPath string
+	hosts      []nix.Host
+}
 
-	deploymentFile, err := os.Open(deploymentPath)
-	if err != nil {
-		return hosts, err
+// Group the hosts by system, in the order of their first host
+func systemGroups(hosts []nix.Host, resultPath string) []*systemGroup {
+	groups := make([]*systemGroup, 0)
+	bySystem := make(map[string]*systemGroup)
+	for _, host := range hosts {
+		systemPath, err := nix.GetNixSystemPath(host, resultPath)
+		if err != nil {
+			continue
+		}
+		group, ok := bySystem[systemPath]
+		if !ok {
+			group = &systemGroup{systemPath: systemPath}
+			bySystem[systemPath] = group
+			groups = append(groups, group)
+		}
+		group.hosts = append(group.hosts, host)
 	}
+	return groups
+}
 
-	deploymentAbsPath, err := filepath.Abs(deploymentFile.Name())
-	if err != nil {
-		return hosts, err
+func logSystemGroups(hosts []nix.Host, resultPath string) {
+	groups := systemGroups(hosts, resultPath)
+	if len(groups) == 0 || len(groups) == len(hosts) {
+		return
 	}
 
-	ctx := getNixContext()
-	deployment, err := ctx.GetMachines(deploymentAbsPath)
-	if err != nil {
-		return hosts, err
+	logging.Infof("%d hosts share %d distinct systems:\n", len(hosts), len(groups))
+	for _, group := range groups {
+		if len(group.hosts) < 2 {
+			continue
+		}
+		names := make([]string, 0, len(group.hosts))
+		for _, host := range group.hosts {
+			names = append(names, host.Name)
+		}
+		logging.Infof("\t* %s: %s\n", group.systemPath, strings.Join(names, ", "))
 	}
+}
 
-	matchingHosts, err := filter.MatchHosts(deployment.Hosts, selectGlob)
-	if err != nil {
-		return hosts, err
-	}
+// The first host each system was pushed to, to refer to it for the other hosts sharing the system
+var pushedSystems = make(map[string]string)
 
-	var selectedTags []string
-	if selectTags != "" {
-		selectedTags = strings.Split(selectTags, ",")
+// Hosts activating later than right after the push get a GC root for the pushed system, which is removed on activation
+func pushPaths(sshContext *ssh.SSHContext, filteredHosts []nix.Host, resultPath string, activateLater bool) error {
+	if len(deploymentMeta.TrustedPublicKeys) > 0 {
+		err := verifySignatures(filteredHosts, resultPath)
+		if err != nil {
+			return err
+		}
 	}
 
-	matchingHosts2 := filter.FilterHostsTags(matchingHosts, selectedTags)
+	for _, host := range filteredHosts {
+		if host.BuildOnly {
+			logging.Infof("Push is disabled for build-only host: %s\n", host.Name)
+			continue
+		}
+		if useSubstitutes {
+			host.SubstituteOnDestination = true
+		}
 
-	ordering := deployment.Meta.Ordering
-	if orderingTags != "" {
-		ordering = nix.HostOrdering{Tags: strings.Split(orderingTags, ",")}
-	}
+		paths, err := nix.GetPathsToPush(host, resultPath)
+		if err != nil {
+			return err
+		}
+		log := logging.WithHost(host.Name)
+		deployMutex.Lock()
+		sharedWith, shared := pushedSystems[paths[0]]
+		if !shared {
+			pushedSystems[paths[0]] = host.Name
+		}
+		deployMutex.Unlock()
+		if shared {
+			log.Infof("Pushing paths to %v (%v@%v), the same system as %v\n", host.Name, host.TargetUser, host.TargetHost, sharedWith)
+		} else {
+			log.Infof("Pushing paths to %v (%v@%v):\n", host.Name, host.TargetUser, host.TargetHost)
+			for _, path := range paths {
+				log.Infof("\t* %s\n", path)
+			}
+		}
+		// measured up front, since nix copy doesn't tell what it copied
+		missing, size, statsErr := nix.GetTransferSize(sshContext, host, paths)
+		if statsErr != nil {
+			log.Warnf("Couldn't determine the paths to transfer: %s\n", statsErr.Error())
+		}
 
-	sortedHosts := filter.SortHosts(matchingHosts2, ordering)
+		restoreNixSettings, err := nix.ApplyTemporarySettings(sshContext, host)
+		if err != nil {
+			return err
+		}
 
-	filteredHosts := filter.FilterHosts(sortedHosts, selectSkip, selectEvery, selectLimit)
+		hostReport := runReport.Host(host.Name)
+		// pushing only copies missing paths, so retrying picks up where a failed attempt left
+		err = hostReport.Record(&hostReport.Push, utils.Retry(retryPolicy(), anyError, logRetry(log), func() error {
+			return nix.Push(sshContext, host, paths...)
+		}))
+		restoreNixSettings()
+		if err != nil {
+			return err
+		}
 
-	fmt.Fprintf(os.Stderr, "Selected %v/%v hosts (name filter:-%v, limits:-%v):\n", len(filteredHosts), len(deployment.Hosts), len(deployment.Hosts)-len(matchingHosts), len(matchingHosts)-len(filteredHosts))
-	for index, host := range filteredHosts {
-		fmt.Fprintf(os.Stderr, "\t%3d: %s (secrets: %d, health checks: %d, tags: %s)\n", index, host.Name, len(host.Secrets), len(host.HealthChecks.Cmd)+len(host.HealthChecks.Http), strings.Join(host.GetTags(), ","))
+		if statsErr == nil {
+			hostReport.Transfer = &report.Transfer{Paths: missing, Bytes: size}
+			if host.SubstituteOnDestination {
+				// measured before the host substituted what it could
+				log.Infof("Transferred or substituted %d paths (%s)\n", missing, utils.FormatBytes(size))
+			} else {
+				log.Infof("Transferred %d paths (%s)\n", missing, utils.FormatBytes(size))
+			}
+		}
+
+		if activateLater {
+			// not being able to protect the system from a garbage collection shouldn't stop the deployment
+			if err = nix.AddPendingGCRoot(sshContext, host, paths[0]); err != nil {
+				log.Warnf("%s\n", err.Error())
+			}
+		}
 	}
-	fmt.Fprintln(os.Stderr)
 
-	return filteredHosts, nil
+	return nil
 }
 
-func getNixContext() *nix.NixContext {
-	return &nix.NixContext{
-		EvalMachines:    filepath.Join(assetRoot, assets.Friendly, "eval-machines.nix"),
-		ShowTrace:       showTrace,
-		KeepGCRoot:      *keepGCRoot,
-		AllowBuildShell: *allowBuildShell,
-	}
-}
+// Record the package changes of each host for the changelog, showing them with --show-diff
+func diffClosures(sshContext *ssh.SSHContext, hosts []nix.Host, resultPath string) error {
+	for _, host := range hosts {
+		if host.BuildOnly {
+			continue
+		}
 
-func buildHosts(hosts []nix.Host) (resultPath string, err error) {
-	if len(hosts) == 0 {
-		err = errors.New("No hosts selected")
-		return
-	}
+		systemPath, err := nix.GetNixSystemPath(host, resultPath)
+		if err != nil {
+			return err
+		}
 
-	deploymentPath, err := filepath.Abs(deployment)
-	if err != nil {
-		return
-	}
+		diff, err := nix.DiffClosures(sshContext, host, systemPath)
+		if err != nil {
+			return err
+		}
+		runReport.Host(host.Name).PackageChanges = diff.Changes()
 
-	nixBuildTargets := ""
-	if nixBuildTargetFile != "" {
-		if path, err := filepath.Abs(nixBuildTargetFile); err == nil {
-			nixBuildTargets = fmt.Sprintf("import \"%s\"", path)
+		if deployShowDiff {
+			logging.WithHost(host.Name).Infof("Changes to the running system on %s:\n%s", host.Name, diff)
 		}
-	} else if nixBuildTarget != "" {
-		nixBuildTargets = fmt.Sprintf("{ \"out\" = %s; }", nixBuildTarget)
+	}
+	if deployShowDiff {
+		logging.Infof("\n")
 	}
 
-	ctx := getNixContext()
-	resultPath, err = ctx.BuildMachines(deploymentPath, hosts, nixBuildArg, nixBuildTargets)
+	return nil
+}
 
-	if err != nil {
-		return
+func retryPolicy() utils.RetryPolicy {
+	return utils.RetryPolicy{
+		Retries:      *retries,
+		InitialDelay: *retryDelay,
+		MaxDelay:     time.Minute,
 	}
+}
 
-	fmt.Fprintln(os.Stderr, "nix result path: ")
-	fmt.Println(resultPath)
-	return
+func anyError(err error) bool {
+	return true
 }
 
-func pushPaths(sshContext *ssh.SSHContext, filteredHosts []nix.Host, resultPath string) error {
-	for _, host := range filteredHosts {
+func logRetry(log *logging.Logger) func(err error, delay time.Duration) {
+	return func(err error, delay time.Duration) {
+		log.Warnf("%s\nRetrying in %s ...\n", strings.TrimSpace(err.Error()), delay)
+	}
+}
+
+// Paths whose signatures were verified before, when pushing to another host sharing the system
+var verifiedPaths = make(map[string]bool)
+
+// Make sure that third-party paths in the closures to push are signed by one of network.trustedPublicKeys
+func verifySignatures(hosts []nix.Host, resultPath string) error {
+	paths := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, host := range hosts {
 		if host.BuildOnly {
-			fmt.Fprintf(os.Stderr, "Push is disabled for build-only host: %s\n", host.Name)
 			continue
 		}
-
-		paths, err := nix.GetPathsToPush(host, resultPath)
+		hostPaths, err := nix.GetPathsToPush(host, resultPath)
 		if err != nil {
 			return err
 		}
-		fmt.Fprintf(os.Stderr, "Pushing paths to %v (%v@%v):\n", host.Name, host.TargetUser, host.TargetHost)
-		for _, path := range paths {
-			fmt.Fprintf(os.Stderr, "\t* %s\n", path)
+		// hosts sharing a system are verified once
+		deployMutex.Lock()
+		for _, path := range hostPaths {
+			if !seen[path] && !verifiedPaths[path] {
+				seen[path] = true
+				paths = append(paths, path)
+			}
 		}
-		err = nix.Push(sshContext, host, paths...)
-		if err != nil {
-			return err
+		deployMutex.Unlock()
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+
+	logging.Infof("Verifying signatures of paths to push ... ")
+	untrusted, err := nix.VerifySignatures(nil, deploymentMeta.TrustedPublicKeys, paths...)
+	if err != nil {
+		logging.Failed("to verify signatures of paths to push")
+		return err
+	}
+	if len(untrusted) > 0 {
+		logging.Failed("to verify signatures of paths to push")
+		logging.Errorf("The following paths are neither built locally nor signed by a trusted key:\n")
+		for _, path := range untrusted {
+			logging.Errorf("\t* %s\n", path)
 		}
+		return errors.New(fmt.Sprintf("Refusing to push %d untrusted path(s)\n", len(untrusted)))
+	}
+	deployMutex.Lock()
+	for _, path := range paths {
+		verifiedPaths[path] = true
 	}
+	deployMutex.Unlock()
+	logging.Infof("OK\n")
 
 	return nil
 }
@@ -607,36 +3109,78 @@ func secretsUpload(ctx ssh.Context, filteredHosts []nix.Host) error {
 	// upload secrets
 	// relative paths are resolved relative to the deployment file (!)
 	deploymentDir := filepath.Dir(deployment)
+
+	// remove decrypted secrets once done
+	cleanups := make([]func(), 0)
+	defer func() {
+		for _, cleanup := range cleanups {
+			cleanup()
+		}
+	}()
+
 	for _, host := range filteredHosts {
-		fmt.Fprintf(os.Stderr, "Uploading secrets to %s (%s):\n", host.Name, host.TargetHost)
+		log := logging.WithHost(host.Name)
+		log.Infof("Uploading secrets to %s (%s):\n", host.Name, host.TargetHost)
 		postUploadActions := make(map[string][]string, 0)
+		uploaded := make(map[string]secrets.Secret)
 		for secretName, secret := range host.Secrets {
+			source, cleanup, err := secrets.ResolveSource(secret, deploymentDir)
+			if err != nil {
+				return err
+			}
+			cleanups = append(cleanups, cleanup)
+			secret.Source = source
+
 			secretSize, err := secrets.GetSecretSize(secret, deploymentDir)
 			if err != nil {
 				return err
 			}
 
-			secretErr := secrets.UploadSecret(ctx, &host, secret, deploymentDir)
-			fmt.Fprintf(os.Stderr, "\t* %s (%d bytes).. ", secretName, secretSize)
+			change, err := secrets.Compare(ctx, &host, secret, deploymentDir)
+			if err != nil {
+				return err
+			}
+			if change.Status == secrets.Unchanged {
+				// nothing to reload or restart for, so the action isn't run
+				log.Infof("\t* %s (%d bytes).. unchanged (%s)\n", secretName, secretSize, change.Hashes())
+				uploaded[secretName] = secret
+				continue
+			}
+
+			var secretErr *secrets.SecretError
+			// only losing the connection is worth trying again; other failures would just repeat
+			retryable := func(error) bool { return ssh.IsConnectionFailure(secretErr.Err) }
+			utils.Retry(retryPolicy(), retryable, logRetry(log), func() error {
+				secretErr = secrets.UploadSecret(ctx, &host, secret, deploymentDir)
+				if secretErr == nil {
+					return nil
+				}
+				return secretErr
+			})
+			log.Infof("\t* %s (%d bytes).. ", secretName, secretSize)
 			if secretErr != nil {
 				if secretErr.Fatal {
-					fmt.Fprintln(os.Stderr, "Failed")
+					log.Failed(fmt.Sprintf("to upload secret %s", secretName))
+					recordSecretsManifest(ctx, &host, uploaded, deploymentDir)
 					return secretErr
 				} else {
-					fmt.Fprintln(os.Stderr, "Partial")
-					fmt.Fprint(os.Stderr, secretErr.Error())
+					log.Infof("Partial (%s %s)\n", change.Status, change.Hashes())
+					log.Warnf("%s", secretErr.Error())
 				}
 			} else {
-				fmt.Fprintln(os.Stderr, "OK")
+				log.Infof("OK (%s %s)\n", change.Status, change.Hashes())
 			}
+			uploaded[secretName] = secret
 			if len(secret.Action) > 0 {
 				// ensure each action is only run once
 				postUploadActions[strings.Join(secret.Action, " ")] = secret.Action
 			}
 		}
+		recordSecretsManifest(ctx, &host, uploaded, deploymentDir)
+
 		// Execute post-upload secret actions one-by-one after all secrets have been uploaded
 		for _, action := range postUploadActions {
-			fmt.Fprintf(os.Stderr, "\t- executing post-upload command: "+strings.Join(action, " ")+"\n")
+			log.Infof("\t- executing post-upload command: %s\n", strings.Join(action, " "))
 			// Errors from secret actions will be printed on screen, but we won't stop the flow if they fail
 			ctx.CmdInteractive(&host, timeout, action...)
 		}
@@ -645,25 +3189,270 @@ func secretsUpload(ctx ssh.Context, filteredHosts []nix.Host) error {
 	return nil
 }
 
+// Add the uploaded secrets to the manifest on the host; failing to do so doesn't fail the upload itself
+func recordSecretsManifest(ctx ssh.Context, host *nix.Host, uploaded map[string]secrets.Secret, deploymentDir string) {
+	if len(uploaded) == 0 {
+		return
+	}
+	changed, err := secrets.RecordManifest(ctx, host, uploaded, deploymentDir, runReport.Id)
+	runReport.Host(host.Name).SecretsChanged = changed
+	if err != nil {
+		logging.WithHost(host.Name).Warnf("Failed to update the secrets manifest: %s\n", err.Error())
+	}
+}
+
 func activateConfiguration(ctx ssh.Context, filteredHosts []nix.Host, resultPath string) error {
-	fmt.Fprintln(os.Stderr, "Executing '"+deploySwitchAction+"' on matched hosts:")
-	fmt.Fprintln(os.Stderr)
+	logging.Infof("Executing '%s' on matched hosts:\n", deploySwitchAction)
+	logging.Infof("\n")
 	for _, host := range filteredHosts {
 
-		fmt.Fprintln(os.Stderr, "** "+host.Name)
+		logging.Infof("** %s\n", host.Name)
 
 		configuration, err := nix.GetNixSystemPath(host, resultPath)
 		if err != nil {
 			return err
 		}
 
-		err = ctx.ActivateConfiguration(&host, configuration, deploySwitchAction)
+		hostReport := runReport.Host(host.Name)
+		if deploySwitchAction == "dry-activate" {
+			changes, err := ctx.DryActivate(&host, configuration)
+			if hostReport.Record(&hostReport.Activation, err) != nil {
+				return err
+			}
+
+			hostReport.UnitChanges = changes
+			logging.WithHost(host.Name).Infof("Unit changes on %s:\n%s", host.Name, changes)
+		} else {
+			if deploySwitchAction != "boot" && !host.ActivationPolicy.IsEmpty() {
+				err = checkActivationPolicy(ctx, host, configuration)
+				if err != nil {
+					return hostReport.Record(&hostReport.Activation, err)
+				}
+			}
+
+			// knowing which deployment brought them up is nice to have for activation scripts, but not essential
+			if err = writeDeploymentInfo(ctx, host, configuration); err != nil {
+				logging.WithHost(host.Name).Warnf("Failed to write the deployment info: %s\n", err.Error())
+			}
+
+			if err = runActivationHooks(ctx, host, "preActivation", host.PreActivation); err != nil {
+				hostReport.Record(&hostReport.HealthChecks, err)
+				return err
+			}
+
+			err = hostReport.Record(&hostReport.Activation, activate(ctx, host, configuration))
+			if err != nil {
+				return err
+			}
+
+			if err = runActivationHooks(ctx, host, "postActivation", host.PostActivation); err != nil {
+				hostReport.Record(&hostReport.HealthChecks, err)
+				return err
+			}
+
+			// any system pushed ahead is either activated now, or superseded
+			if err = nix.RemovePendingGCRoot(ctx, host); err != nil {
+				logging.WithHost(host.Name).Warnf("%s\n", err.Error())
+			}
+		}
+
+		logging.Infof("\n")
+	}
+
+	return nil
+}
+
+// Run the preActivation or postActivation commands of the host on it, as root. They only apply to switching the
+// running system, and fail the host like failed health checks. Like activation scripts, they find the details of the
+// deployment in the deployment info.
+func runActivationHooks(ctx ssh.Context, host nix.Host, name string, commands []string) error {
+	log := logging.WithHost(host.Name)
+	if len(commands) > 0 && deploySwitchAction != "switch" && deploySwitchAction != "test" {
+		log.Warnf("Not running the %s commands of %s, which only apply to switch and test\n", name, host.Name)
+		return nil
+	}
+
+	for _, command := range commands {
+		log.Infof("Running %s command on %s: %s\n", name, host.Name, command)
+		err := ctx.Run(&host, nil, os.Stderr, os.Stderr, "sudo", "sh", "-c", utils.ShellQuote(command))
 		if err != nil {
+			logging.Errorf("Not deploying to additional hosts, since a %s command failed.\n", name)
+			return inPhase(exitHealthChecks, errors.New(fmt.Sprintf("The %s command `%s` failed on host %s: %s\n", name, command, host.Name, err.Error())))
+		}
+	}
+	return nil
+}
+
+func activate(ctx ssh.Context, host nix.Host, configuration string) error {
+	if magicRollback > 0 {
+		return activateWithMagicRollback(ctx, host, configuration)
+	}
+
+	// activation is only retried after losing the connection, not when the activation itself failed
+	return utils.Retry(retryPolicy(), ssh.IsConnectionFailure, logRetry(logging.WithHost(host.Name)), func() error {
+		return ctx.ActivateConfiguration(&host, configuration, deploySwitchAction)
+	})
+}
+
+// Activate with the rollback timer of --magic-rollback armed. Losing the connection isn't retried, as the new
+// configuration may be what broke it; instead morph keeps trying to confirm until the timer expires.
+func activateWithMagicRollback(ctx ssh.Context, host nix.Host, configuration string) error {
+	log := logging.WithHost(host.Name)
+
+	timer, err := ctx.ArmRollback(&host, deploySwitchAction, magicRollback)
+	if err != nil {
+		return err
+	}
+	log.Infof("Armed the rollback timer (%s), confirming within %ds\n", timer.Unit, magicRollback)
+
+	err = ctx.ActivateConfiguration(&host, configuration, deploySwitchAction)
+	if err != nil && !ssh.IsConnectionFailure(err) {
+		log.Warnf("Not confirming the failed activation, %s rolls back within %ds\n", host.Name, magicRollback)
+		return err
+	}
+	if err != nil {
+		log.Warnf("Lost the connection while activating, trying to confirm: %s\n", strings.TrimSpace(err.Error()))
+	}
+
+	deadline := timer.Armed.Add(time.Duration(magicRollback) * time.Second)
+	for {
+		err = ctx.ConfirmRollback(&host, timer)
+		if err == nil {
+			log.Infof("Confirmed the activation\n")
+			return nil
+		}
+		if _, rolledBack := err.(*ssh.RolledBackError); rolledBack {
 			return err
 		}
+		if time.Now().After(deadline) {
+			return errors.New(fmt.Sprintf("Couldn't confirm the activation on %s within %ds, it rolls back to the previous system: %s", host.Name, magicRollback, strings.TrimSpace(err.Error())))
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// Location of the details of the latest deployment on the target hosts. It is fixed, so sudoers rules only allowing
+// switch-to-configuration itself still apply.
+const deploymentInfoPath = "/var/lib/morph/deployment.json"
+
+type deploymentInfo struct {
+	Deployment   string    `json:"deployment"`
+	RunId        string    `json:"runId"`
+	GitRev       string    `json:"gitRev,omitempty"`
+	GitDirty     bool      `json:"gitDirty,omitempty"`
+	Host         string    `json:"host"`
+	SystemPath   string    `json:"systemPath"`
+	SwitchAction string    `json:"switchAction"`
+	DeployedBy   string    `json:"deployedBy"`
+	DeployedAt   time.Time `json:"deployedAt"`
+	MorphVersion string    `json:"morphVersion,omitempty"`
+}
+
+// Write the details of this deployment to the host before activating it, so activation scripts and services can
+// tell which deployment brought them up
+func writeDeploymentInfo(ctx ssh.Context, host nix.Host, configuration string) error {
+	deploymentDir := filepath.Dir(deployment)
+
+	info := deploymentInfo{
+		Deployment:   deploymentMeta.Description,
+		RunId:        runReport.Id,
+		Host:         host.Name,
+		SystemPath:   configuration,
+		SwitchAction: deploySwitchAction,
+		DeployedAt:   time.Now().UTC(),
+		MorphVersion: version,
+	}
+	if info.Deployment == "" {
+		info.Deployment = filepath.Base(deployment)
+	}
+	if rev, err := exec.Command("git", "-C", deploymentDir, "rev-parse", "HEAD").Output(); err == nil {
+		info.GitRev = strings.TrimSpace(string(rev))
+		status, err := exec.Command("git", "-C", deploymentDir, "status", "--porcelain").Output()
+		info.GitDirty = err == nil && len(bytes.TrimSpace(status)) > 0
+	}
+	if currentUser, err := user.Current(); err == nil {
+		info.DeployedBy = currentUser.Username
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		info.DeployedBy += "@" + hostname
+	}
+
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	return uploadDeploymentInfo(ctx, host, append(data, '\n'))
+}
+
+// Read the deployment info of the host, which is nil if it was never deployed to
+func readDeploymentInfo(ctx ssh.Context, host nix.Host) ([]byte, error) {
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	err := ctx.Run(&host, nil, &stdout, &stderr, "cat", deploymentInfoPath)
+	if err != nil {
+		if strings.Contains(stderr.String(), "No such file or directory") {
+			return nil, nil
+		}
+		return nil, errors.New("Reading the deployment info: " + strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
 
-		fmt.Fprintln(os.Stderr)
+func uploadDeploymentInfo(ctx ssh.Context, host nix.Host, data []byte) error {
+	tempFile, err := ioutil.TempFile("", "morph-deployment-info")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	_, err = tempFile.Write(data)
+	tempFile.Close()
+	if err != nil {
+		return err
+	}
+
+	// uploaded like a secret, but readable by everyone
+	if err := secrets.UploadSecret(ctx, &host, secrets.Secret{
+		Source:      tempFile.Name(),
+		Destination: deploymentInfoPath,
+		Owner:       secrets.Owner{User: "root", Group: "root"},
+		Permissions: "0644",
+		MkDirs:      true,
+	}, ""); err != nil {
+		return err
 	}
 
 	return nil
 }
+
+func checkActivationPolicy(ctx ssh.Context, host nix.Host, configuration string) error {
+	log := logging.WithHost(host.Name)
+	log.Infof("Checking activation policy of %s using dry-activate:\n", host.Name)
+	changes, err := ctx.DryActivate(&host, configuration)
+	if err != nil {
+		return err
+	}
+
+	violations := host.ActivationPolicy.Violations(changes)
+	if len(violations) == 0 {
+		log.Infof("Activation policy OK\n")
+		return nil
+	}
+
+	log.Warnf("Activation policy of %s would be violated:\n", host.Name)
+	for _, violation := range violations {
+		log.Warnf("\t* %s\n", violation)
+	}
+
+	if host.ActivationPolicy.OnViolation == "confirm" {
+		ok, err := utils.Confirm(fmt.Sprintf("Run '%s' on %s anyway?", deploySwitchAction, host.Name))
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+
+	return errors.New(fmt.Sprintf("Activation policy of %s forbids '%s'\n", host.Name, deploySwitchAction))
+}
@@ -0,0 +1,31 @@
+package nix
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dbcdk/morph/utils"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Copy paths (with their closures) to a binary cache: cachix://<name> pushes to a Cachix cache with the cachix CLI,
+// anything else is a nix store URI like s3://bucket or ssh://host, copied to with `nix copy`.
+func PushToCache(uri string, host Host, paths ...string) error {
+	var cmd *exec.Cmd
+	if name := strings.TrimPrefix(uri, "cachix://"); name != uri {
+		utils.ValidateEnvironment("cachix")
+		cmd = exec.Command("cachix", append([]string{"push", name}, paths...)...)
+	} else {
+		args := append([]string{"copy", "--to", uri}, mkOptions(host)...)
+		cmd = exec.Command("nix", append(args, paths...)...)
+	}
+
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	logCommand(cmd)
+	if err := cmd.Run(); err != nil {
+		return errors.New(fmt.Sprintf("Pushing to the binary cache %s failed: %s", uri, err.Error()))
+	}
+	return nil
+}
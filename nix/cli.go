@@ -0,0 +1,106 @@
+package nix
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/dbcdk/morph/logging"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	// nix-build, and nix copy over ssh://
+	BackendLegacy = "legacy"
+	// The nix 2 CLI: nix build with structured logs, and nix copy over ssh-ng://
+	BackendNix = "nix"
+)
+
+var Backends = []string{BackendLegacy, BackendNix}
+
+// The tools used for building and copying, set by --nix-backend
+var Backend = BackendLegacy
+
+// The arguments of `nix build` for building attribute of file, given the other arguments of nix-build
+func nixBuildArgs(file string, attribute string, args []string) []string {
+	return append([]string{"build", "--extra-experimental-features", "nix-command",
+		"--file", file, attribute, "--log-format", "internal-json"}, args...)
+}
+
+// Activity and result types of nix' internal-json log format
+const (
+	activityCopyPath   = 100
+	activityBuild      = 105
+	activitySubstitute = 108
+	resultBuildLogLine = 101
+	// messages up to this level are shown by default
+	logLevelInfo = 3
+)
+
+type logEntry struct {
+	Action string        `json:"action"`
+	Id     int64         `json:"id"`
+	Level  int           `json:"level"`
+	Type   int           `json:"type"`
+	Text   string        `json:"text"`
+	Msg    string        `json:"msg"`
+	Fields []interface{} `json:"fields"`
+}
+
+// Log the structured output of `nix build` as it progresses: a line per built, fetched or copied path, build logs
+// with --verbose, and the messages of nix (like errors) as they are. Returns the number of paths built and fetched.
+func followNixLog(stderr io.Reader) (built int, fetched int) {
+	scanner := bufio.NewScanner(stderr)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "@nix ") {
+			fmt.Fprintln(os.Stderr, line)
+			continue
+		}
+
+		var entry logEntry
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "@nix ")), &entry); err != nil {
+			fmt.Fprintln(os.Stderr, line)
+			continue
+		}
+
+		switch entry.Action {
+		case "msg":
+			fmt.Fprintln(os.Stderr, entry.Msg)
+		case "start":
+			switch entry.Type {
+			case activityBuild:
+				built++
+				logging.Infof("building %s\n", strings.TrimSuffix(storePathName(field(entry, 0)), ".drv"))
+			case activitySubstitute:
+				fetched++
+				logging.Infof("fetching %s from %s\n", storePathName(field(entry, 0)), field(entry, 1))
+			case activityCopyPath:
+				logging.Verbosef("copying %s\n", storePathName(field(entry, 0)))
+			}
+		case "result":
+			if entry.Type == resultBuildLogLine {
+				logging.Verbosef("%s\n", field(entry, 0))
+			}
+		}
+	}
+	return built, fetched
+}
+
+func field(entry logEntry, i int) string {
+	if i >= len(entry.Fields) {
+		return ""
+	}
+	return fmt.Sprint(entry.Fields[i])
+}
+
+// The name of a store path without the hash, e.g. nixos-system-web01-20.09 for /nix/store/<hash>-nixos-system-web01-20.09
+func storePathName(path string) string {
+	name := strings.TrimPrefix(path, "/nix/store/")
+	if i := strings.Index(name, "-"); i >= 0 && name != path {
+		return name[i+1:]
+	}
+	return path
+}
@@ -0,0 +1,193 @@
+package nix
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dbcdk/morph/ssh"
+	"github.com/dbcdk/morph/utils"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+)
+
+type VersionChange struct {
+	Name string
+	Old  []string
+	New  []string
+}
+
+// Differences between the closure of the system running on a host and the one about to be deployed
+type ClosureDiff struct {
+	Added        []VersionChange
+	Removed      []VersionChange
+	Changed      []VersionChange
+	MissingPaths int
+	TransferSize int64
+}
+
+func (d ClosureDiff) IsEmpty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+func (d ClosureDiff) String() string {
+	var s strings.Builder
+
+	if d.IsEmpty() {
+		fmt.Fprintln(&s, "\tNo package changes")
+	}
+	for _, change := range d.Changes() {
+		fmt.Fprintf(&s, "\t%s\n", change)
+	}
+	fmt.Fprintf(&s, "\tTo transfer: %d paths, %s\n", d.MissingPaths, utils.FormatBytes(d.TransferSize))
+
+	return s.String()
+}
+
+// One line per changed, added (+) or removed (-) package, e.g. "~ nginx: 1.16.1 -> 1.17.0"
+func (d ClosureDiff) Changes() []string {
+	changes := make([]string, 0, len(d.Changed)+len(d.Added)+len(d.Removed))
+	for _, change := range d.Changed {
+		changes = append(changes, fmt.Sprintf("~ %s: %s -> %s", change.Name, formatVersions(change.Old), formatVersions(change.New)))
+	}
+	for _, change := range d.Added {
+		changes = append(changes, fmt.Sprintf("+ %s: %s", change.Name, formatVersions(change.New)))
+	}
+	for _, change := range d.Removed {
+		changes = append(changes, fmt.Sprintf("- %s: %s", change.Name, formatVersions(change.Old)))
+	}
+	return changes
+}
+
+// Compare the closure of the system currently running on the host with the closure of systemPath
+func DiffClosures(ctx *ssh.SSHContext, host Host, systemPath string) (diff ClosureDiff, err error) {
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	err = ctx.Run(&host, nil, &stdout, &stderr, "nix-store", "--query", "--requisites", "/run/current-system")
+	if err != nil {
+		return diff, errors.New(fmt.Sprintf("Couldn't query the running system on %s: %s", host.Name, stderr.String()))
+	}
+	oldClosure := strings.Fields(stdout.String())
+
+	newClosure, err := GetClosure(mkOptions(host), systemPath)
+	if err != nil {
+		return diff, err
+	}
+
+	diff = diffVersions(versionsByName(oldClosure), versionsByName(newClosure))
+
+	diff.MissingPaths, diff.TransferSize, err = getTransferSize(ctx, host, newClosure)
+
+	return diff, err
+}
+
+// Get the combined size of the NARs of paths, i.e. roughly what it takes to transfer them uncompressed
+func GetNarSize(paths ...string) (size int64, err error) {
+	if len(paths) == 0 {
+		return 0, nil
+	}
+
+	cmd := exec.Command("nix", append([]string{"path-info", "--json"}, paths...)...)
+
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+
+	logCommand(cmd)
+	err = cmd.Run()
+	if err != nil {
+		return size, errors.New(fmt.Sprintf("Error while running `nix path-info ..`: %s", err.Error()))
+	}
+
+	var infos []struct {
+		NarSize int64
+	}
+	err = json.Unmarshal(stdout.Bytes(), &infos)
+	if err != nil {
+		return size, err
+	}
+
+	for _, info := range infos {
+		size += info.NarSize
+	}
+
+	return size, nil
+}
+
+// Split a store path into the name and version of the package, the way `nix-env` parses derivation names:
+// the version starts at the first dash followed by a non-letter.
+func parseStorePath(storePath string) (name string, version string) {
+	base := path.Base(storePath)
+	if i := strings.Index(base, "-"); i >= 0 {
+		base = base[i+1:]
+	}
+
+	for i := 0; i < len(base)-1; i++ {
+		c := base[i+1]
+		if base[i] == '-' && !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return base[:i], base[i+1:]
+		}
+	}
+
+	return base, ""
+}
+
+func versionsByName(closure []string) map[string][]string {
+	versions := make(map[string][]string)
+	for _, storePath := range closure {
+		name, version := parseStorePath(storePath)
+		if !contains(versions[name], version) {
+			versions[name] = append(versions[name], version)
+		}
+	}
+	for name := range versions {
+		sort.Strings(versions[name])
+	}
+	return versions
+}
+
+func diffVersions(old map[string][]string, new map[string][]string) (diff ClosureDiff) {
+	for name, newVersions := range new {
+		oldVersions, ok := old[name]
+		if !ok {
+			diff.Added = append(diff.Added, VersionChange{Name: name, New: newVersions})
+		} else if strings.Join(oldVersions, " ") != strings.Join(newVersions, " ") {
+			diff.Changed = append(diff.Changed, VersionChange{Name: name, Old: oldVersions, New: newVersions})
+		}
+	}
+	for name, oldVersions := range old {
+		if _, ok := new[name]; !ok {
+			diff.Removed = append(diff.Removed, VersionChange{Name: name, Old: oldVersions})
+		}
+	}
+
+	for _, changes := range [][]VersionChange{diff.Added, diff.Removed, diff.Changed} {
+		sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	}
+
+	return diff
+}
+
+func formatVersions(versions []string) string {
+	formatted := make([]string, len(versions))
+	for i, version := range versions {
+		if version == "" {
+			version = "ε"
+		}
+		formatted[i] = version
+	}
+	return strings.Join(formatted, ", ")
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+package nix
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/dbcdk/morph/logging"
+	"hash"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// With --eval-cache, the results of evaluating a deployment are reused while its inputs are unchanged: the files nix
+// evaluated to get them, wherever they are, the files in the directory of the deployment, the nix search path,
+// morph's evaluator and the arguments of the evaluation. Inputs nix doesn't evaluate outside of that directory, like
+// files read with builtins.readFile or URLs fetched without a hash, aren't noticed.
+func evalCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "morph", "eval")
+}
+
+func (ctx *NixContext) evalCacheKey(deploymentPath string, args ...string) string {
+	h := sha256.New()
+	for _, arg := range args {
+		fmt.Fprintf(h, "%s\x00", arg)
+	}
+	fmt.Fprintf(h, "%s\x00", deploymentPath)
+
+	// the evaluator is unpacked to a new directory for every run
+	hashTree(h, filepath.Dir(ctx.EvalMachines), true)
+	hashTree(h, filepath.Dir(deploymentPath), false)
+
+	searchPath := append(filepath.SplitList(os.Getenv("NIX_PATH")), ctx.IncludePaths...)
+	for _, entry := range searchPath {
+		fmt.Fprintf(h, "%s\x00", entry)
+		if i := strings.Index(entry, "="); i >= 0 {
+			entry = entry[i+1:]
+		}
+		if strings.Contains(entry, "://") {
+			continue
+		}
+		// channels are symlinks into the store, which change when they are updated
+		resolved, err := filepath.EvalSymlinks(entry)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(h, "%s\x00", resolved)
+		if !strings.HasPrefix(resolved, "/nix/store/") {
+			hashTree(h, resolved, false)
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Hash the names, sizes and modification times of the files in dir, like make does to tell what changed - or, with
+// contents, the relative names and contents of the files
+func hashTree(h hash.Hash, dir string, contents bool) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() && (info.Name() == ".git" || info.Name() == ".gcroots") {
+			return filepath.SkipDir
+		}
+		if contents {
+			if data, err := ioutil.ReadFile(path); err == nil && info.Mode().IsRegular() {
+				relative, _ := filepath.Rel(dir, path)
+				fmt.Fprintf(h, "%s\x00%s\x00", relative, data)
+			}
+		} else if info.Mode()&os.ModeSymlink != 0 {
+			target, _ := os.Readlink(path)
+			fmt.Fprintf(h, "%s -> %s\x00", path, target)
+		} else if info.Mode().IsRegular() {
+			fmt.Fprintf(h, "%s %d %d\x00", path, info.Size(), info.ModTime().UnixNano())
+		}
+		return nil
+	})
+}
+
+// A cached result, with the fingerprints of the files nix evaluated outside of the store to get it
+type evalCacheEntry struct {
+	Value string            `json:"value"`
+	Files map[string]string `json:"files"`
+}
+
+func readEvalCache(key string) (value string, ok bool) {
+	data, err := ioutil.ReadFile(filepath.Join(evalCacheDir(), key))
+	if err != nil {
+		return "", false
+	}
+
+	var entry evalCacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return "", false
+	}
+	for path, fingerprint := range entry.Files {
+		if fileFingerprint(path) != fingerprint {
+			logging.Verbosef("Not using the cached evaluation, %s changed\n", path)
+			return "", false
+		}
+	}
+	return entry.Value, true
+}
+
+func writeEvalCache(key string, value string, files []string) {
+	entry := evalCacheEntry{Value: value, Files: make(map[string]string)}
+	for _, path := range files {
+		if !strings.HasPrefix(path, "/nix/store/") {
+			entry.Files[path] = fileFingerprint(path)
+		}
+	}
+
+	data, err := json.Marshal(entry)
+	dir := evalCacheDir()
+	if err == nil {
+		err = os.MkdirAll(dir, 0700)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, key), data, 0600)
+	}
+	if err != nil {
+		logging.Warnf("Unable to cache the evaluation: %s\n", err.Error())
+	}
+}
+
+// Like make, tell changes by size and modification time
+func fileFingerprint(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "missing"
+	}
+	return fmt.Sprintf("%d %d", info.Size(), info.ModTime().UnixNano())
+}
+
+// Arguments making nix log the files it evaluates, which the result of an evaluation to be cached depends on
+var evalLogArgs = []string{"--log-format", "internal-json", "-v"}
+
+// Run a nix command given evalLogArgs, showing the messages nix would show without them, and collecting the files
+// it evaluated
+func runRecordingFiles(cmd *exec.Cmd) (files []string, err error) {
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	logCommand(cmd)
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(stderr)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		var entry logEntry
+		if !strings.HasPrefix(line, "@nix ") || json.Unmarshal([]byte(strings.TrimPrefix(line, "@nix ")), &entry) != nil {
+			fmt.Fprintln(os.Stderr, line)
+			continue
+		}
+		if entry.Action != "msg" {
+			continue
+		}
+		if strings.HasPrefix(entry.Msg, "evaluating file '") {
+			files = append(files, strings.TrimSuffix(strings.TrimPrefix(entry.Msg, "evaluating file '"), "'"))
+		} else if entry.Level <= logLevelInfo {
+			fmt.Fprintln(os.Stderr, entry.Msg)
+		}
+	}
+
+	return files, cmd.Wait()
+}
@@ -0,0 +1,113 @@
+package nix
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/dbcdk/morph/ssh"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// GC root protecting a system that was pushed ahead of its activation from `nix-collect-garbage` on the host
+const PendingGCRoot = "/nix/var/nix/gcroots/morph-pending"
+
+func AddPendingGCRoot(ctx ssh.Context, host Host, systemPath string) error {
+	var stderr bytes.Buffer
+	err := ctx.Run(&host, nil, &stderr, &stderr, "sudo", "ln", "-sfn", systemPath, PendingGCRoot)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Couldn't register GC root for %s on %s: %s", systemPath, host.Name, stderr.String()))
+	}
+
+	return nil
+}
+
+// Remove the GC root left by a previous push, once the system it protects has been activated (and is rooted by the system profile)
+func RemovePendingGCRoot(ctx ssh.Context, host Host) error {
+	var stderr bytes.Buffer
+	err := ctx.Run(&host, nil, &stderr, &stderr, "sudo", "rm", "-f", PendingGCRoot)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Couldn't remove GC root %s on %s: %s", PendingGCRoot, host.Name, stderr.String()))
+	}
+
+	return nil
+}
+
+// Build results kept by --keep-result are GC roots in .gcroots next to the deployment, one per build named after the
+// deployment and the time of the build. A link named after the deployment alone points to the latest of them.
+func resultGCRootsDir(deploymentPath string) string {
+	return filepath.Join(filepath.Dir(deploymentPath), ".gcroots")
+}
+
+func newResultGCRoot(deploymentPath string) string {
+	name := fmt.Sprintf("%s-%s", filepath.Base(deploymentPath), time.Now().Format("20060102-150405"))
+	return filepath.Join(resultGCRootsDir(deploymentPath), name)
+}
+
+// Point the latest link of the deployment to the root of the build that just finished
+func linkLatestResult(deploymentPath string, root string) error {
+	latest := filepath.Join(resultGCRootsDir(deploymentPath), filepath.Base(deploymentPath))
+	tmpLink := latest + ".tmp"
+	os.Remove(tmpLink)
+	if err := os.Symlink(filepath.Base(root), tmpLink); err != nil {
+		return err
+	}
+	return os.Rename(tmpLink, latest)
+}
+
+// The build results kept for the deployment, oldest first
+func ResultGCRoots(deploymentPath string) (roots []string, err error) {
+	dir := resultGCRootsDir(deploymentPath)
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return roots, nil
+	}
+	if err != nil {
+		return roots, err
+	}
+
+	pattern := regexp.MustCompile("^" + regexp.QuoteMeta(filepath.Base(deploymentPath)) + `-[0-9]{8}-[0-9]{6}$`)
+	for _, entry := range entries {
+		if pattern.MatchString(entry.Name()) {
+			roots = append(roots, filepath.Join(dir, entry.Name()))
+		}
+	}
+	// the timestamps sort chronologically
+	sort.Strings(roots)
+	return roots, nil
+}
+
+// Remove all but the newest keep build results of the deployment, so they can be garbage collected.
+// Removing all of them also removes the latest link.
+func CleanResultGCRoots(deploymentPath string, keep int) (removed []string, err error) {
+	roots, err := ResultGCRoots(deploymentPath)
+	if err != nil {
+		return removed, err
+	}
+	if keep < 0 {
+		keep = 0
+	}
+
+	for i := 0; i < len(roots)-keep; i++ {
+		if err := os.Remove(roots[i]); err != nil {
+			return removed, errors.New(fmt.Sprintf("Couldn't remove GC root %s: %s", roots[i], err.Error()))
+		}
+		removed = append(removed, roots[i])
+	}
+
+	if keep == 0 {
+		latest := filepath.Join(resultGCRootsDir(deploymentPath), filepath.Base(deploymentPath))
+		if _, err := os.Lstat(latest); err == nil {
+			if err := os.Remove(latest); err != nil {
+				return removed, errors.New(fmt.Sprintf("Couldn't remove GC root %s: %s", latest, err.Error()))
+			}
+			removed = append(removed, latest)
+		}
+	}
+
+	return removed, nil
+}
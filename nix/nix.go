@@ -6,14 +6,17 @@ import (
 	"errors"
 	"fmt"
 	"github.com/dbcdk/morph/healthchecks"
+	"github.com/dbcdk/morph/logging"
 	"github.com/dbcdk/morph/secrets"
 	"github.com/dbcdk/morph/ssh"
 	"github.com/dbcdk/morph/utils"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
@@ -25,11 +28,48 @@ type Host struct {
 	NixosRelease            string
 	TargetHost              string
 	TargetUser              string
+	TargetPort              int
+	JumpHost                string
 	Secrets                 map[string]secrets.Secret
 	BuildOnly               bool
 	SubstituteOnDestination bool
 	NixConfig               map[string]string
 	Tags                    []string
+	Environment             string
+	Roles                   []string
+	ActivationPolicy        ssh.ActivationPolicy
+	PreConnectCommand       []string
+	SshPasswordAuth         bool
+	TemporaryNixSettings    map[string]string
+	PrivilegeEscalation     string
+	SkipHealthChecks        bool
+	SkipSecrets             bool
+	SudoPasswordFile        string
+	Agent                   HostAgent
+	// Names of the hosts to deploy before this one
+	DeployAfter []string
+	// The identity of the host, verified instead of the known_hosts of the user
+	HostKey        string
+	KnownHostsFile string
+	// The key to log in with, instead of any key of the user
+	IdentityFile    string
+	AgentForwarding bool
+	// Seconds to wait for connecting, and for commands to finish, instead of --connect-timeout and --command-timeout
+	ConnectTimeout int
+	CommandTimeout int
+	// Extra options for ssh, scp and nix copy
+	SshOptions []string
+	// inet or inet6 to only connect over IPv4 or IPv6
+	AddressFamily string
+	// Shell commands run as root on the host right before and after switching it
+	PreActivation  []string
+	PostActivation []string
+}
+
+// The morph agent on the host, see deployment.agent
+type HostAgent struct {
+	Enable bool
+	Socket string
 }
 
 type HostOrdering struct {
@@ -37,8 +77,31 @@ type HostOrdering struct {
 }
 
 type DeploymentMetadata struct {
-	Description string
-	Ordering    HostOrdering
+	Description       string
+	Ordering          HostOrdering
+	TrustedPublicKeys []string
+	JumpHostSessions  map[string]int
+	Steps             []string
+	CustomSteps       map[string]CustomStep
+	// Commands run locally before and after deploying, declared in network.preDeploy and network.postDeploy
+	PreDeploy  []string
+	PostDeploy []string
+	// Slack or Mattermost incoming webhook to post deployment notifications to
+	NotifyWebhook string
+	// Remote builders, in the format of nix' --builders
+	Builders string
+	// Build parallelism, unless given on the command line; "" leaves it to nix.conf
+	MaxJobs  string
+	Cores    string
+	Warnings []string
+}
+
+// Command run for every host as part of the deployment, declared in network.customSteps
+type CustomStep struct {
+	Command []string
+	// Run the command on the host instead of locally
+	Remote bool
+	Sudo   bool
 }
 
 type Deployment struct {
@@ -48,9 +111,24 @@ type Deployment struct {
 
 type NixContext struct {
 	EvalMachines    string
+	EvalOptions     string
 	ShowTrace       bool
 	KeepGCRoot      bool
 	AllowBuildShell bool
+	IncludePaths    []string
+	Builders        string
+	NixOptions      map[string]string
+	NixArgs         []string
+	MaxJobs         string
+	Cores           string
+	EvalCache       bool
+}
+
+type OptionDoc struct {
+	Name        string
+	Description string
+	Type        string
+	Default     interface{}
 }
 
 type FileArgs struct {
@@ -65,6 +143,69 @@ func (host *Host) GetTargetHost() string {
 	return host.TargetHost
 }
 
+func (host *Host) GetTargetPort() int {
+	return host.TargetPort
+}
+
+func (host *Host) GetJumpHost() string {
+	return host.JumpHost
+}
+
+func (host *Host) GetPreConnectCommand() []string {
+	return host.PreConnectCommand
+}
+
+func (host *Host) GetSshPasswordAuth() bool {
+	return host.SshPasswordAuth
+}
+
+func (host *Host) GetPrivilegeEscalation() string {
+	return host.PrivilegeEscalation
+}
+
+func (host *Host) GetSudoPasswordFile() string {
+	return host.SudoPasswordFile
+}
+
+func (host *Host) GetHostKey() string {
+	return host.HostKey
+}
+
+func (host *Host) GetKnownHostsFile() string {
+	return host.KnownHostsFile
+}
+
+func (host *Host) GetIdentityFile() string {
+	return host.IdentityFile
+}
+
+func (host *Host) GetAgentForwarding() bool {
+	return host.AgentForwarding
+}
+
+func (host *Host) GetConnectTimeout() int {
+	return host.ConnectTimeout
+}
+
+func (host *Host) GetCommandTimeout() int {
+	return host.CommandTimeout
+}
+
+func (host *Host) GetSshOptions() []string {
+	return host.SshOptions
+}
+
+func (host *Host) GetAddressFamily() string {
+	return host.AddressFamily
+}
+
+func (host *Host) GetAgentSocket() string {
+	if !host.Agent.Enable {
+		return ""
+	}
+	return host.Agent.Socket
+}
+
 func (host *Host) GetTargetUser() string {
 	return host.TargetUser
 }
@@ -78,55 +219,91 @@ func (host *Host) GetTags() []string {
 }
 
 func (host *Host) Reboot(sshContext *ssh.SSHContext) error {
+	return host.restart(sshContext, "reboot", "sudo", "reboot")
+}
+
+// Boot the kernel of configuration directly with kexec, skipping the firmware and boot loader
+func (host *Host) Kexec(sshContext *ssh.SSHContext, configuration string) error {
+	load := fmt.Sprintf(`kexec --load %[1]s/kernel --initrd=%[1]s/initrd --append="init=%[1]s/init $(cat %[1]s/kernel-params)"`, configuration)
+	if err := sshContext.Run(host, nil, os.Stderr, os.Stderr, "sudo", "sh", "-c", utils.ShellQuote(load)); err != nil {
+		logging.WithHost(host.Name).Errorf("Failed to load the kernel of %s with kexec\n", configuration)
+		return err
+	}
+
+	return host.restart(sshContext, "kexec", "sudo", "systemctl", "kexec")
+}
+
+// Whether the host has kexec, and a kernel supporting it
+func (host *Host) SupportsKexec(sshContext *ssh.SSHContext) bool {
+	return sshContext.Run(host, nil, nil, nil, "sh", "-c", utils.ShellQuote("command -v kexec && test -e /sys/kernel/kexec_loaded")) == nil
+}
+
+// Whether configuration boots another kernel, initrd or kernel parameters than the running system was booted with
+func (host *Host) KernelChanged(sshContext *ssh.SSHContext, configuration string) (bool, error) {
+	var booted bytes.Buffer
+	var next bytes.Buffer
+	script := "readlink -f %[1]s/kernel %[1]s/initrd && cat %[1]s/kernel-params"
+	if err := sshContext.Run(host, nil, &booted, os.Stderr, "sh", "-c", utils.ShellQuote(fmt.Sprintf(script, "/run/booted-system"))); err != nil {
+		return true, err
+	}
+	if err := sshContext.Run(host, nil, &next, os.Stderr, "sh", "-c", utils.ShellQuote(fmt.Sprintf(script, configuration))); err != nil {
+		return true, err
+	}
+	return booted.String() != next.String(), nil
+}
+
+// Run the command making the host restart, and wait until it's back with a new boot ID
+func (host *Host) restart(sshContext *ssh.SSHContext, description string, command ...string) error {
 
 	var (
 		oldBootID string
 		newBootID string
 	)
 
+	log := logging.WithHost(host.Name)
+
+	if sshContext.IsLocal(host) {
+		return errors.New(fmt.Sprintf("Refusing to %s the machine morph is running on\n", description))
+	}
+
 	oldBootID, err := sshContext.GetBootID(host)
 	// If the host doesn't support getting boot ID's for some reason, warn about it, and skip the comparison
 	skipBootIDComparison := err != nil
 	if skipBootIDComparison {
-		fmt.Fprintf(os.Stderr, "Error getting boot ID (this is used to determine when the reboot is complete): %v\n", err)
-		fmt.Fprintf(os.Stderr, "This makes it impossible to detect when the host has rebooted, so health checks might pass before the host has rebooted.\n")
-	}
-
-	if cmd, err := sshContext.Cmd(host, "sudo", "reboot"); cmd != nil {
-		fmt.Fprint(os.Stderr, "Asking host to reboot ... ")
-		if err = cmd.Run(); err != nil {
-			// Here we assume that exit code 255 means: "SSH connection got disconnected",
-			// which is OK for a reboot - sshd may close active connections before we disconnect after all
-			if exitErr, ok := err.(*exec.ExitError); ok {
-				if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() == 255 {
-					fmt.Fprintln(os.Stderr, "Remote host disconnected.")
-					err = nil
-				}
-			}
-		}
+		log.Warnf("Error getting boot ID (this is used to determine when the reboot is complete): %v\n", err)
+		log.Warnf("This makes it impossible to detect when the host has rebooted, so health checks might pass before the host has rebooted.\n")
+	}
 
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "Failed")
-			return err
+	log.Infof("Asking host to %s ... ", description)
+	if err = sshContext.Run(host, nil, os.Stderr, os.Stderr, command...); err != nil {
+		// Losing the connection is OK for a reboot - sshd may close active connections before we disconnect after all
+		if ssh.IsDisconnected(err) {
+			log.Infof("Remote host disconnected.\n")
+			err = nil
 		}
 	}
 
-	fmt.Fprintln(os.Stderr, "OK")
+	if err != nil {
+		log.Failed("to " + description)
+		return err
+	}
+
+	log.Infof("OK\n")
 
 	if !skipBootIDComparison {
-		fmt.Fprint(os.Stderr, "Waiting for host to come online ")
+		log.Infof("Waiting for host to come online ")
 
 		// Wait for the host to get a new boot ID. These ID's should be unique for each boot,
 		// meaning a reboot will have been completed when the boot ID has changed.
 		for {
-			fmt.Fprint(os.Stderr, ".")
+			log.Infof(".")
 
 			// Ignore errors; there'll be plenty of them since we'll be attempting to connect to an offline host,
 			// and we know from previously that the host should support boot ID's
 			newBootID, _ = sshContext.GetBootID(host)
 
 			if newBootID != "" && oldBootID != newBootID {
-				fmt.Fprintln(os.Stderr, " OK")
+				log.Infof(" OK\n")
 				break
 			}
 
@@ -147,6 +324,7 @@ func (ctx *NixContext) GetBuildShell(deploymentPath string) (buildShell *string,
 	if ctx.ShowTrace {
 		args = append(args, "--show-trace")
 	}
+	args = append(args, ctx.extraArgs()...)
 
 	cmd := exec.Command("nix", args...)
 
@@ -159,6 +337,7 @@ func (ctx *NixContext) GetBuildShell(deploymentPath string) (buildShell *string,
 			_ = cmd.Process.Signal(syscall.SIGTERM)
 		}
 	})
+	logCommand(cmd)
 	err = cmd.Run()
 	if err != nil {
 		errorMessage := fmt.Sprintf(
@@ -185,6 +364,85 @@ func (ctx *NixContext) GetMachines(deploymentPath string) (deployment Deployment
 	if ctx.ShowTrace {
 		args = append(args, "--show-trace")
 	}
+	args = append(args, ctx.extraArgs()...)
+
+	var stdout bytes.Buffer
+	cacheKey, cached, ok := "", "", false
+	if ctx.EvalCache {
+		cacheKey = ctx.evalCacheKey(deploymentPath, append([]string{"info.deployment", fmt.Sprint(ctx.ShowTrace)}, ctx.extraArgs()...)...)
+		cached, ok = readEvalCache(cacheKey)
+	}
+	if ok {
+		logging.Verbosef("Using the cached evaluation of the deployment\n")
+		stdout.WriteString(cached)
+	} else {
+		if cacheKey != "" {
+			args = append(args, evalLogArgs...)
+		}
+		cmd := exec.Command("nix", args...)
+		cmd.Stdout = &stdout
+
+		utils.AddFinalizer(func() {
+			if (cmd.ProcessState == nil || !cmd.ProcessState.Exited()) && cmd.Process != nil {
+				_ = cmd.Process.Signal(syscall.SIGTERM)
+			}
+		})
+		var files []string
+		if cacheKey != "" {
+			files, err = runRecordingFiles(cmd)
+		} else {
+			cmd.Stderr = os.Stderr
+			logCommand(cmd)
+			err = cmd.Run()
+		}
+		if err != nil {
+			errorMessage := fmt.Sprintf(
+				"Error while running `nix eval ..`: %s", err.Error(),
+			)
+			return deployment, errors.New(errorMessage)
+		}
+		if cacheKey != "" {
+			writeEvalCache(cacheKey, stdout.String(), files)
+		}
+	}
+
+	err = json.Unmarshal(stdout.Bytes(), &deployment)
+	if err != nil {
+		return deployment, err
+	}
+
+	// password, known_hosts and key files are given relative to the deployment, and kept out of the store
+	for i, host := range deployment.Hosts {
+		if host.SudoPasswordFile != "" && !filepath.IsAbs(host.SudoPasswordFile) {
+			deployment.Hosts[i].SudoPasswordFile = filepath.Join(filepath.Dir(deploymentPath), host.SudoPasswordFile)
+		}
+		if host.KnownHostsFile != "" && !filepath.IsAbs(host.KnownHostsFile) {
+			deployment.Hosts[i].KnownHostsFile = filepath.Join(filepath.Dir(deploymentPath), host.KnownHostsFile)
+		}
+		if host.IdentityFile != "" && !filepath.IsAbs(host.IdentityFile) {
+			deployment.Hosts[i].IdentityFile = filepath.Join(filepath.Dir(deploymentPath), host.IdentityFile)
+		}
+		for _, secret := range host.Secrets {
+			if err = secrets.CheckSources(secret); err != nil {
+				return deployment, errors.New(fmt.Sprintf("Host %s: %s", host.Name, err.Error()))
+			}
+		}
+	}
+
+	return deployment, nil
+}
+
+// Evaluate the documentation of all host options supported by morph
+func (ctx *NixContext) GetOptions() (options []OptionDoc, err error) {
+
+	args := []string{"eval",
+		"-f", ctx.EvalOptions,
+		"--json"}
+
+	if ctx.ShowTrace {
+		args = append(args, "--show-trace")
+	}
+	args = append(args, ctx.extraArgs()...)
 
 	cmd := exec.Command("nix", args...)
 
@@ -192,25 +450,21 @@ func (ctx *NixContext) GetMachines(deploymentPath string) (deployment Deployment
 	cmd.Stdout = &stdout
 	cmd.Stderr = os.Stderr
 
-	utils.AddFinalizer(func() {
-		if (cmd.ProcessState == nil || !cmd.ProcessState.Exited()) && cmd.Process != nil {
-			_ = cmd.Process.Signal(syscall.SIGTERM)
-		}
-	})
+	logCommand(cmd)
 	err = cmd.Run()
 	if err != nil {
 		errorMessage := fmt.Sprintf(
 			"Error while running `nix eval ..`: %s", err.Error(),
 		)
-		return deployment, errors.New(errorMessage)
+		return options, errors.New(errorMessage)
 	}
 
-	err = json.Unmarshal(stdout.Bytes(), &deployment)
+	err = json.Unmarshal(stdout.Bytes(), &options)
 	if err != nil {
-		return deployment, err
+		return options, err
 	}
 
-	return deployment, nil
+	return options, nil
 }
 
 func (ctx *NixContext) BuildMachines(deploymentPath string, hosts []Host, nixArgs []string, nixBuildTargets string) (resultPath string, err error) {
@@ -242,37 +496,47 @@ func (ctx *NixContext) BuildMachines(deploymentPath string, hosts []Host, nixArg
 		return "", err
 	}
 
-	resultLinkPath := filepath.Join(path.Dir(deploymentPath), ".gcroots", path.Base(deploymentPath))
+	resultLinkPath := newResultGCRoot(deploymentPath)
 	if ctx.KeepGCRoot {
 		if err = os.MkdirAll(path.Dir(resultLinkPath), 0755); err != nil {
 			ctx.KeepGCRoot = false
-			fmt.Fprintf(os.Stderr, "Unable to create GC root, skipping: %s", err)
+			logging.Warnf("Unable to create GC root, skipping: %s\n", err)
 		}
 	}
 	if !ctx.KeepGCRoot {
 		// create tmp dir for result link
 		resultLinkPath = filepath.Join(tmpdir, "result")
 	}
-	args := []string{ctx.EvalMachines,
-		"-A", "machines",
+	// the arguments of both nix-build and nix build, which only differ in how the attribute is given
+	buildArgs := []string{
 		"--arg", "networkExpr", deploymentPath,
 		"--argstr", "argsFile", argsFile,
 		"--out-link", resultLinkPath}
 
-	args = append(args, mkOptions(hosts[0])...)
-
-	if len(nixArgs) > 0 {
-		args = append(args, nixArgs...)
+	// settings of the build, as opposed to the evaluation
+	settings := mkOptions(hosts[0])
+	if ctx.Builders != "" {
+		settings = append(settings, "--builders", ctx.Builders)
+	}
+	if ctx.MaxJobs != "" {
+		settings = append(settings, "--max-jobs", ctx.MaxJobs)
 	}
+	if ctx.Cores != "" {
+		settings = append(settings, "--cores", ctx.Cores)
+	}
+	settings = append(settings, nixArgs...)
+	buildArgs = append(buildArgs, settings...)
 
 	if ctx.ShowTrace {
-		args = append(args, "--show-trace")
+		buildArgs = append(buildArgs, "--show-trace")
 	}
+	buildArgs = append(buildArgs, ctx.extraArgs()...)
 
 	if nixBuildTargets != "" {
-		args = append(args,
+		buildArgs = append(buildArgs,
 			"--arg", "buildTargets", nixBuildTargets)
 	}
+	args := append([]string{ctx.EvalMachines, "-A", "machines"}, buildArgs...)
 
 	buildShell, err := ctx.GetBuildShell(deploymentPath)
 
@@ -283,23 +547,54 @@ func (ctx *NixContext) BuildMachines(deploymentPath string, hosts []Host, nixArg
 		return resultPath, errors.New(errorMessage)
 	}
 
+	if ctx.EvalCache && !(ctx.AllowBuildShell && buildShell != nil) {
+		key := ctx.evalCacheKey(deploymentPath, append([]string{"machines", strings.Join(hostsArg, ","), nixBuildTargets,
+			fmt.Sprint(ctx.ShowTrace), strings.Join(mkOptions(hosts[0]), " ")}, ctx.extraArgs()...)...)
+		return ctx.buildCached(key, deploymentPath, args, settings, resultLinkPath)
+	}
+
+	tool := "nix-build"
+	if Backend == BackendNix {
+		tool = "nix"
+		args = nixBuildArgs(ctx.EvalMachines, "machines", buildArgs)
+	}
+
 	var cmd *exec.Cmd
 	if ctx.AllowBuildShell && buildShell != nil {
-		shellArgs := strings.Join(append([]string{"nix-build"}, args...), " ")
+		quotedArgs := make([]string, 0, len(args))
+		for _, arg := range args {
+			quotedArgs = append(quotedArgs, utils.ShellQuote(arg))
+		}
+		shellArgs := strings.Join(append([]string{tool}, quotedArgs...), " ")
 		cmd = exec.Command("nix-shell", *buildShell, "--run", shellArgs)
 	} else {
-		cmd = exec.Command("nix-build", args...)
+		cmd = exec.Command(tool, args...)
 	}
 
 	// show process output on attached stdout/stderr
 	cmd.Stdout = os.Stderr
-	cmd.Stderr = os.Stderr
+	var nixLog io.ReadCloser
+	if Backend == BackendNix {
+		if nixLog, err = cmd.StderrPipe(); err != nil {
+			return "", err
+		}
+	} else {
+		cmd.Stderr = os.Stderr
+	}
 	utils.AddFinalizer(func() {
 		if (cmd.ProcessState == nil || !cmd.ProcessState.Exited()) && cmd.Process != nil {
 			_ = cmd.Process.Signal(syscall.SIGTERM)
 		}
 	})
-	err = cmd.Run()
+	logCommand(cmd)
+	err = cmd.Start()
+	if err == nil {
+		if nixLog != nil {
+			built, fetched := followNixLog(nixLog)
+			logging.Infof("Built %d and fetched %d paths\n", built, fetched)
+		}
+		err = cmd.Wait()
+	}
 
 	if err != nil {
 		errorMessage := fmt.Sprintf(
@@ -308,14 +603,95 @@ func (ctx *NixContext) BuildMachines(deploymentPath string, hosts []Host, nixArg
 		return resultPath, errors.New(errorMessage)
 	}
 
+	return ctx.readResult(deploymentPath, resultLinkPath)
+}
+
+func (ctx *NixContext) readResult(deploymentPath string, resultLinkPath string) (resultPath string, err error) {
 	resultPath, err = os.Readlink(resultLinkPath)
 	if err != nil {
 		return "", err
 	}
 
+	if ctx.KeepGCRoot {
+		if err := linkLatestResult(deploymentPath, resultLinkPath); err != nil {
+			logging.Warnf("Unable to link the latest build result: %s\n", err)
+		}
+	}
+
 	return
 }
 
+// Build the machines in two steps, instantiating them only if the derivation for the same inputs isn't cached, and
+// realising the derivation. args are those of nix-build, and settings the ones of them for the build.
+func (ctx *NixContext) buildCached(key string, deploymentPath string, args []string, settings []string, resultLinkPath string) (resultPath string, err error) {
+	drvPath, ok := readEvalCache(key)
+	if _, statErr := os.Stat(drvPath); ok && statErr == nil {
+		logging.Infof("Using the cached evaluation of the deployment: %s\n", drvPath)
+	} else {
+		// the out link is only for nix-build
+		instantiateArgs := make([]string, 0, len(args))
+		for i := 0; i < len(args); i++ {
+			if args[i] == "--out-link" {
+				i++
+				continue
+			}
+			instantiateArgs = append(instantiateArgs, args[i])
+		}
+
+		var stdout bytes.Buffer
+		cmd := exec.Command("nix-instantiate", append(instantiateArgs, evalLogArgs...)...)
+		cmd.Stdout = &stdout
+		files, err := runRecordingFiles(cmd)
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("Error while running `nix-instantiate ...`: %s", err.Error()))
+		}
+		drvPath = strings.TrimSpace(stdout.String())
+		writeEvalCache(key, drvPath, files)
+	}
+
+	realiseArgs := []string{"--realise", drvPath, "--add-root", resultLinkPath, "--indirect"}
+	realiseArgs = append(realiseArgs, settings...)
+	realiseArgs = append(realiseArgs, ctx.optionArgs()...)
+	cmd := exec.Command("nix-store", append(realiseArgs, ctx.NixArgs...)...)
+	cmd.Stdout = ioutil.Discard
+	cmd.Stderr = os.Stderr
+	utils.AddFinalizer(func() {
+		if (cmd.ProcessState == nil || !cmd.ProcessState.Exited()) && cmd.Process != nil {
+			_ = cmd.Process.Signal(syscall.SIGTERM)
+		}
+	})
+	logCommand(cmd)
+	if err := cmd.Run(); err != nil {
+		return "", errors.New(fmt.Sprintf("Error while running `%s ...`: See above.", cmd.String()))
+	}
+
+	return ctx.readResult(deploymentPath, resultLinkPath)
+}
+
+// Arguments for every evaluation and build: additions to the nix search path, e.g. for importing shared modules
+// in `<name>` style, and those passed through by --nix-option and --nix-arg
+func (ctx *NixContext) extraArgs() []string {
+	args := make([]string, 0)
+	for _, path := range ctx.IncludePaths {
+		args = append(args, "-I", path)
+	}
+	args = append(args, ctx.optionArgs()...)
+	return append(args, ctx.NixArgs...)
+}
+
+func (ctx *NixContext) optionArgs() []string {
+	args := make([]string, 0)
+	names := make([]string, 0, len(ctx.NixOptions))
+	for name := range ctx.NixOptions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		args = append(args, "--option", name, ctx.NixOptions[name])
+	}
+	return args
+}
+
 func mkOptions(host Host) []string {
 	var options = make([]string, 0)
 	for k, v := range host.NixConfig {
@@ -330,6 +706,36 @@ func GetNixSystemPath(host Host, resultPath string) (string, error) {
 	return os.Readlink(filepath.Join(resultPath, host.Name))
 }
 
+// Get the store paths built for a host, keyed by build target name.
+// Without custom build targets, the system configuration is returned as "out".
+func GetBuildTargetPaths(host Host, resultPath string) (paths map[string]string, err error) {
+	paths = make(map[string]string)
+	hostResult := filepath.Join(resultPath, host.Name)
+
+	info, err := os.Lstat(hostResult)
+	if err != nil {
+		return paths, err
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		paths["out"], err = os.Readlink(hostResult)
+		return paths, err
+	}
+
+	targets, err := ioutil.ReadDir(hostResult)
+	if err != nil {
+		return paths, err
+	}
+	for _, target := range targets {
+		paths[target.Name()], err = os.Readlink(filepath.Join(hostResult, target.Name()))
+		if err != nil {
+			return paths, err
+		}
+	}
+
+	return paths, nil
+}
+
 func GetNixSystemDerivation(host Host, resultPath string) (string, error) {
 	return os.Readlink(filepath.Join(resultPath, host.Name+".drv"))
 }
@@ -345,22 +751,74 @@ func GetPathsToPush(host Host, resultPath string) (paths []string, err error) {
 	return paths, nil
 }
 
+// Set with --sign-key: imports by the built-in SSH client drop the signatures of the paths, so they are always pushed
+// with nix copy
+var CopySignatures bool
+
 func Push(ctx *ssh.SSHContext, host Host, paths ...string) (err error) {
+	if ctx.IsLocal(&host) {
+		// the paths were built into the store of this machine
+		logging.WithHost(host.Name).Verbosef("Deploying locally, nothing to push\n")
+		return nil
+	}
+	if ctx.UsesNativeBackend(&host) && !CopySignatures {
+		return pushNative(ctx, host, paths...)
+	}
+
 	utils.ValidateEnvironment("ssh")
 
+	if err = ctx.PreConnect(&host); err != nil {
+		return err
+	}
+
 	var userArg = ""
 	var keyArg = ""
+	var sshOpts = make([]string, 0)
 	var env = os.Environ()
 	if host.TargetUser != "" {
 		userArg = host.TargetUser + "@"
 	} else if ctx.DefaultUsername != "" {
 		userArg = ctx.DefaultUsername + "@"
 	}
-	if ctx.IdentityFile != "" {
-		keyArg = "?ssh-key=" + ctx.IdentityFile
+	if identityFile := ctx.HostIdentityFile(&host); identityFile != "" {
+		keyArg = "?ssh-key=" + identityFile
+	}
+	sshOpts = append(sshOpts, ctx.HostKeyOptions(&host)...)
+	sshOpts = append(sshOpts, ctx.IdentityOptions(&host)...)
+	sshOpts = append(sshOpts, ctx.TimeoutOptions(&host)...)
+	sshOpts = append(sshOpts, ssh.AddressOptions(&host)...)
+	if address := ssh.TargetAddress(&host); strings.Contains(address, ":") {
+		// nix passes the host of the store URL on to ssh, brackets and all in some versions of nix
+		sshOpts = append(sshOpts, "-o HostName="+address)
+	}
+	if host.TargetPort != 0 {
+		sshOpts = append(sshOpts, fmt.Sprintf("-p %d", host.TargetPort))
 	}
-	if ctx.SkipHostKeyCheck {
-		env = append(env, fmt.Sprintf("NIX_SSHOPTS=%s", "-o StrictHostkeyChecking=No -o UserKnownHostsFile=/dev/null"))
+	if host.JumpHost != "" {
+		sshOpts = append(sshOpts, "-o ProxyJump="+host.JumpHost)
+	}
+	if ssh.UsesPasswordAuth(&host) {
+		sshOpts = append(sshOpts, "-o NumberOfPasswordPrompts=1")
+		passwordEnv, err := ctx.PasswordAuthEnv(&host)
+		if err != nil {
+			return err
+		}
+		env = append(env, passwordEnv...)
+	}
+	sshOpts = append(sshOpts, ctx.NonInteractiveOptions(&host)...)
+	optionsEnv, err := ctx.SshOptionsEnv(&host)
+	if err != nil {
+		return err
+	}
+	env = append(env, optionsEnv...)
+	if len(sshOpts) > 0 {
+		env = append(env, fmt.Sprintf("NIX_SSHOPTS=%s", strings.Join(sshOpts, " ")))
+	}
+
+	// ssh-ng:// talks to the nix daemon of the host, instead of running nix-store --serve
+	scheme := "ssh://"
+	if Backend == BackendNix {
+		scheme = "ssh-ng://"
 	}
 
 	options := mkOptions(host)
@@ -368,21 +826,24 @@ func Push(ctx *ssh.SSHContext, host Host, paths ...string) (err error) {
 		args := []string{
 			"copy",
 			path,
-			"--to", "ssh://" + userArg + host.TargetHost + keyArg,
+			"--to", scheme + userArg + ssh.BracketedAddress(&host) + keyArg,
 		}
 		args = append(args, options...)
 		if host.SubstituteOnDestination {
 			args = append(args, "--substitute-on-destination")
 		}
 
-		cmd := exec.Command(
+		timeoutCtx, cancel := ctx.CommandContext(&host)
+		cmd := exec.CommandContext(timeoutCtx,
 			"nix", args...,
 		)
 		cmd.Env = env
 
 		cmd.Stdout = os.Stderr
 		cmd.Stderr = os.Stderr
-		err = cmd.Run()
+		logCommand(cmd)
+		err = ctx.TimeoutErr(timeoutCtx, &host, []string{"nix", "copy", path}, ctx.WithSession(&host, cmd.Run))
+		cancel()
 
 		if err != nil {
 			return err
@@ -391,3 +852,7 @@ func Push(ctx *ssh.SSHContext, host Host, paths ...string) (err error) {
 
 	return nil
 }
+
+func logCommand(cmd *exec.Cmd) {
+	logging.Debugf("Running: %s\n", strings.Join(cmd.Args, " "))
+}
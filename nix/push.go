@@ -0,0 +1,148 @@
+package nix
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/dbcdk/morph/ssh"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Closures already queried, by options and paths. Hosts with identical systems share them, so the closure of a system
+// is only computed once per run no matter how many hosts it is pushed to.
+var (
+	closures     = make(map[string][]string)
+	closureMutex sync.Mutex
+)
+
+// Get the closure of the given store paths, in topological order (dependencies first)
+func GetClosure(options []string, paths ...string) (closure []string, err error) {
+	key := strings.Join(options, " ") + "\x00" + strings.Join(paths, " ")
+	closureMutex.Lock()
+	cached, ok := closures[key]
+	closureMutex.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	args := append([]string{"--query", "--requisites"}, options...)
+	args = append(args, paths...)
+
+	cmd := exec.Command("nix-store", args...)
+
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+
+	logCommand(cmd)
+	err = cmd.Run()
+	if err != nil {
+		return closure, errors.New(fmt.Sprintf("Error while running `nix-store --query --requisites ..`: %s", err.Error()))
+	}
+
+	closure = strings.Fields(stdout.String())
+	closureMutex.Lock()
+	closures[key] = closure
+	closureMutex.Unlock()
+
+	return closure, nil
+}
+
+// Filter paths to those not present in the store of the host
+func GetMissingPaths(ctx *ssh.SSHContext, host Host, paths []string) (missing []string, err error) {
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	// paths are passed on stdin, since closures easily exceed the maximum length of a command line
+	err = ctx.Run(&host, strings.NewReader(strings.Join(paths, "\n")+"\n"), &stdout, &stderr,
+		"xargs", "nix-store", "--check-validity", "--print-invalid")
+	if err != nil {
+		return missing, errors.New(fmt.Sprintf("Couldn't query store paths on %s: %s", host.Name, stderr.String()))
+	}
+
+	return strings.Fields(stdout.String()), nil
+}
+
+// Get the number of store paths in the closures of paths that are missing on the host, and the combined size of their NARs
+func GetTransferSize(ctx *ssh.SSHContext, host Host, paths []string) (missing int, size int64, err error) {
+	closure, err := GetClosure(mkOptions(host), paths...)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return getTransferSize(ctx, host, closure)
+}
+
+func getTransferSize(ctx *ssh.SSHContext, host Host, closure []string) (missing int, size int64, err error) {
+	missingPaths, err := GetMissingPaths(ctx, host, closure)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	size, err = GetNarSize(missingPaths...)
+
+	return len(missingPaths), size, err
+}
+
+// Copy paths to the host by piping `nix-store --export` into `nix-store --import` over the built-in SSH client
+func pushNative(ctx *ssh.SSHContext, host Host, paths ...string) error {
+	options := mkOptions(host)
+
+	closure, err := GetClosure(options, paths...)
+	if err != nil {
+		return err
+	}
+
+	missing, err := GetMissingPaths(ctx, host, closure)
+	if err != nil {
+		return err
+	}
+
+	if host.SubstituteOnDestination && len(missing) > 0 {
+		// let the host fetch what it can from its binary caches. Paths that aren't substitutable fail to realise,
+		// so errors are ignored, and the remaining paths copied from here.
+		_ = ctx.Run(&host, strings.NewReader(strings.Join(missing, "\n")+"\n"), os.Stderr, os.Stderr,
+			"xargs", "nix-store", "--realise", "--ignore-unknown")
+
+		missing, err = GetMissingPaths(ctx, host, missing)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	export := exec.Command("nix-store", append(append([]string{"--export"}, options...), missing...)...)
+	export.Stderr = os.Stderr
+	exportOutput, err := export.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	logCommand(export)
+	err = export.Start()
+	if err != nil {
+		return err
+	}
+
+	importErr := ctx.Run(&host, exportOutput, os.Stderr, os.Stderr, "nix-store", "--import")
+	if importErr != nil {
+		// nothing reads the rest of the export anymore, e.g. after --command-timeout, which would block it forever
+		export.Process.Kill()
+	}
+	exportErr := export.Wait()
+
+	if importErr != nil {
+		return errors.New(fmt.Sprintf("Couldn't import paths on %s: %s", host.Name, importErr.Error()))
+	}
+	if exportErr != nil {
+		return errors.New(fmt.Sprintf("Error while running `nix-store --export ..`: %s", exportErr.Error()))
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package nix
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/dbcdk/morph/logging"
+	"github.com/dbcdk/morph/ssh"
+	"github.com/dbcdk/morph/utils"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	nixConf              = "/etc/nix/nix.conf"
+	originalNixConf      = "/etc/nix/nix.conf.morph-original"
+	temporaryNixSettings = "/etc/nix/morph-temporary.conf"
+)
+
+// Hosts which currently have their temporary nix settings applied
+var (
+	temporarySettingsApplied = make(map[string]bool)
+	temporarySettingsMutex   sync.Mutex
+)
+
+// Apply the temporaryNixSettings of the host to its nix daemon, until the returned function is called.
+// nix.conf is replaced by a copy including the settings (it's usually a symlink into the store on NixOS),
+// and restored afterwards - unless an activation replaced it in the meantime.
+// Nested calls for the same host are no-ops.
+func ApplyTemporarySettings(ctx *ssh.SSHContext, host Host) (restore func(), err error) {
+	if len(host.TemporaryNixSettings) == 0 {
+		return func() {}, nil
+	}
+
+	temporarySettingsMutex.Lock()
+	defer temporarySettingsMutex.Unlock()
+
+	if temporarySettingsApplied[host.Name] {
+		return func() {}, nil
+	}
+
+	names := make([]string, 0, len(host.TemporaryNixSettings))
+	for name := range host.TemporaryNixSettings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var settings strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&settings, "%s = %s\n", name, host.TemporaryNixSettings[name])
+	}
+
+	log := logging.WithHost(host.Name)
+	log.Infof("Applying temporary nix settings on %s: %s\n", host.Name, strings.Join(names, ", "))
+
+	script := fmt.Sprintf(`set -e
+[ -e %[2]s ] || cp -P %[1]s %[2]s
+cat %[2]s > %[1]s.morph-tmp
+printf '\n!include %[3]s\n' >> %[1]s.morph-tmp
+printf '%%s' %[4]s > %[3]s
+mv -f %[1]s.morph-tmp %[1]s
+systemctl restart nix-daemon.service`, nixConf, originalNixConf, temporaryNixSettings, utils.ShellQuote(settings.String()))
+
+	if err := runSettingsScript(ctx, host, script); err != nil {
+		return nil, errors.New(fmt.Sprintf("Applying temporary nix settings on %s failed: %s", host.Name, err.Error()))
+	}
+	temporarySettingsApplied[host.Name] = true
+
+	restored := false
+	restore = func() {
+		temporarySettingsMutex.Lock()
+		defer temporarySettingsMutex.Unlock()
+
+		if restored {
+			return
+		}
+		restored = true
+		delete(temporarySettingsApplied, host.Name)
+
+		log.Infof("Removing temporary nix settings from %s\n", host.Name)
+		script := fmt.Sprintf(`set -e
+if [ -L %[1]s ]; then rm -f %[2]s; else mv -f %[2]s %[1]s; fi
+rm -f %[3]s
+systemctl restart nix-daemon.service`, nixConf, originalNixConf, temporaryNixSettings)
+		if err := runSettingsScript(ctx, host, script); err != nil {
+			log.Warnf("Removing temporary nix settings from %s failed: %s\n", host.Name, err.Error())
+		}
+	}
+	// also restore when morph is interrupted
+	utils.AddFinalizer(restore)
+
+	return restore, nil
+}
+
+func runSettingsScript(ctx *ssh.SSHContext, host Host, script string) error {
+	var output bytes.Buffer
+	writer := utils.NewLockedWriter(&output)
+	err := ctx.Run(&host, nil, writer, writer, "sudo", "sh", "-c", utils.ShellQuote(script))
+	if _, ok := err.(*ssh.SudoError); ok {
+		return err
+	}
+	if err != nil {
+		return errors.New(strings.TrimSpace(output.String()))
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package nix
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/dbcdk/morph/logging"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+var untrustedPathRegexp = regexp.MustCompile(`path '([^']+)' is untrusted`)
+
+// Check that every path in the closures of paths was either built locally, or signed by one of the trusted keys.
+// Returns the paths failing the check.
+func VerifySignatures(options []string, trustedKeys []string, paths ...string) (untrusted []string, err error) {
+	args := []string{"verify",
+		"--no-contents", "--recursive",
+		"--sigs-needed", "1",
+		"--option", "trusted-public-keys", strings.Join(trustedKeys, " ")}
+	args = append(args, options...)
+	args = append(args, paths...)
+
+	cmd := exec.Command("nix", args...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	logCommand(cmd)
+	err = cmd.Run()
+
+	for _, match := range untrustedPathRegexp.FindAllStringSubmatch(stderr.String(), -1) {
+		untrusted = append(untrusted, match[1])
+	}
+
+	if err != nil && len(untrusted) == 0 {
+		logging.Errorf("%s", stderr.String())
+		return untrusted, errors.New(fmt.Sprintf("Error while running `nix verify ..`: %s", err.Error()))
+	}
+
+	return untrusted, nil
+}
+
+// Sign the closures of paths with the secret key in keyFile, so hosts and binary caches requiring signatures accept them
+func SignPaths(options []string, keyFile string, paths ...string) error {
+	args := []string{"sign-paths", "--recursive", "--key-file", keyFile}
+	args = append(args, options...)
+	args = append(args, paths...)
+
+	cmd := exec.Command("nix", args...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	logCommand(cmd)
+	if err := cmd.Run(); err != nil {
+		return errors.New(fmt.Sprintf("Error while running `nix sign-paths ..`: %s", strings.TrimSpace(stderr.String())))
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dbcdk/morph/report"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Slack and Mattermost incoming webhooks accept the same message format
+type message struct {
+	Text string `json:"text"`
+}
+
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// Post text to the incoming webhook
+func Post(webhook string, text string) error {
+	body, err := json.Marshal(message{Text: text})
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Post(webhook, "application/json", bytes.NewReader(body))
+	if urlErr, ok := err.(*url.Error); ok {
+		// the URL of a webhook is its secret, which mustn't end up in logs
+		return urlErr.Err
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		reply, _ := ioutil.ReadAll(resp.Body)
+		return errors.New(fmt.Sprintf("%s: %s", resp.Status, strings.TrimSpace(string(reply))))
+	}
+	return nil
+}
+
+// Notice of a deployment about to activate hosts
+func Started(run *report.Run, deployment string, hosts []string) string {
+	return fmt.Sprintf(":rocket: %s is deploying *%s* (%s) to %d %s: %s", run.Operator, deployment, run.SwitchAction,
+		len(hosts), plural(len(hosts), "host", "hosts"), strings.Join(hosts, ", "))
+}
+
+// Summary of a finished deployment: its outcome, and the status and duration of every host, with the health checks
+// which didn't pass by host
+func Finished(run *report.Run, deployment string, failedChecks map[string][]string) string {
+	var s strings.Builder
+
+	duration := run.Finished.Sub(run.Started).Round(time.Second)
+	if run.Error == "" {
+		fmt.Fprintf(&s, ":white_check_mark: Deployment of *%s* (%s) by %s succeeded in %s", deployment,
+			run.SwitchAction, run.Operator, duration)
+	} else {
+		fmt.Fprintf(&s, ":x: Deployment of *%s* (%s) by %s failed after %s: %s", deployment,
+			run.SwitchAction, run.Operator, duration, firstLine(run.Error))
+	}
+
+	for _, host := range run.Hosts {
+		fmt.Fprintf(&s, "\n• %s: %s", host.Name, hostStatus(host))
+		if host.Duration > 0 {
+			fmt.Fprintf(&s, " (%.1fs)", host.Duration)
+		}
+		if checks := failedChecks[host.Name]; len(checks) > 0 {
+			fmt.Fprintf(&s, ", failed checks: %s", strings.Join(checks, ", "))
+		}
+	}
+
+	return s.String()
+}
+
+// The first failed step of the host, or whether it was deployed at all
+func hostStatus(host *report.Host) string {
+	steps := []struct {
+		name   string
+		status report.Status
+	}{
+		{"push", host.Push},
+		{"secrets", host.Secrets},
+		{"activation", host.Activation},
+		{"health checks", host.HealthChecks},
+	}
+
+	done := false
+	for _, step := range steps {
+		if step.status == report.StatusFailed {
+			return "failed in " + step.name
+		}
+		if step.status == report.StatusOK {
+			done = true
+		}
+	}
+	if !done {
+		return "not deployed"
+	}
+	return "ok"
+}
+
+func firstLine(text string) string {
+	text = strings.TrimSpace(text)
+	if i := strings.Index(text, "\n"); i >= 0 {
+		return text[:i]
+	}
+	return text
+}
+
+func plural(n int, singular string, plural string) string {
+	if n == 1 {
+		return singular
+	}
+	return plural
+}
@@ -0,0 +1,77 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Write a human-readable summary of the run in Markdown, e.g. for a change-management ticket
+func (run *Run) WriteChangelog(out io.Writer, title string) error {
+	var s strings.Builder
+
+	fmt.Fprintf(&s, "# %s\n\n", title)
+	fmt.Fprintf(&s, "* Run: %s\n", run.Id)
+	fmt.Fprintf(&s, "* Started: %s\n", run.Started.Format(time.RFC3339))
+	fmt.Fprintf(&s, "* Finished: %s\n", run.Finished.Format(time.RFC3339))
+	if run.Error != "" {
+		fmt.Fprintf(&s, "* Result: **failed**: %s\n", strings.TrimSpace(run.Error))
+	} else {
+		fmt.Fprintf(&s, "* Result: succeeded\n")
+	}
+	fmt.Fprintf(&s, "* Hosts: %d\n", len(run.Hosts))
+
+	for _, host := range run.Hosts {
+		fmt.Fprintf(&s, "\n## %s", host.Name)
+		if host.Environment != "" {
+			fmt.Fprintf(&s, " (%s)", host.Environment)
+		}
+		fmt.Fprintf(&s, "\n\n")
+
+		steps := make([]string, 0)
+		for _, step := range []struct {
+			name   string
+			status Status
+		}{
+			{"push", host.Push},
+			{"secrets", host.Secrets},
+			{"activation", host.Activation},
+			{"health checks", host.HealthChecks},
+		} {
+			if step.status != "" {
+				steps = append(steps, fmt.Sprintf("%s %s", step.name, step.status))
+			}
+		}
+		if len(steps) == 0 {
+			steps = append(steps, "not deployed")
+		}
+		fmt.Fprintf(&s, "* Status: %s\n", strings.Join(steps, ", "))
+		if host.SystemPath != "" {
+			fmt.Fprintf(&s, "* System: `%s`\n", host.SystemPath)
+		}
+		if host.Error != "" {
+			fmt.Fprintf(&s, "* Error: %s\n", strings.TrimSpace(host.Error))
+		}
+
+		if host.PackageChanges != nil {
+			fmt.Fprintf(&s, "\n### Package changes\n\n")
+			if len(host.PackageChanges) == 0 {
+				fmt.Fprintf(&s, "None\n")
+			}
+			for _, change := range host.PackageChanges {
+				fmt.Fprintf(&s, "* `%s`\n", change)
+			}
+		}
+
+		if len(host.SecretsChanged) > 0 {
+			fmt.Fprintf(&s, "\n### Secrets rotated\n\n")
+			for _, name := range host.SecretsChanged {
+				fmt.Fprintf(&s, "* %s\n", name)
+			}
+		}
+	}
+
+	_, err := io.WriteString(out, s.String())
+	return err
+}
@@ -0,0 +1,165 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Differences between two recorded runs
+type Comparison struct {
+	From           string           `json:"from"`
+	To             string           `json:"to"`
+	SystemChanges  []SystemChange   `json:"systemChanges"`
+	HostsAdded     []string         `json:"hostsAdded"`
+	HostsRemoved   []string         `json:"hostsRemoved"`
+	SecretsRotated []SecretsRotated `json:"secretsRotated"`
+	Duration       DurationChange   `json:"duration"`
+	Regressions    []DurationChange `json:"regressions"`
+}
+
+type SystemChange struct {
+	Host string `json:"host"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type SecretsRotated struct {
+	Host    string   `json:"host"`
+	Secrets []string `json:"secrets"`
+}
+
+// Durations in seconds; Host is empty for the duration of the whole run
+type DurationChange struct {
+	Host string  `json:"host,omitempty"`
+	From float64 `json:"from"`
+	To   float64 `json:"to"`
+}
+
+// Durations shorter than this don't count as regressions, however much slower they got
+const minRegression = 1.0
+
+// Compare run from with run to. Secrets rotated by any of the runs since from are reported, given as between
+// (which includes to); a host is regressed if it took more than threshold percent longer.
+func Compare(from *Run, to *Run, between []*Run, threshold float64) *Comparison {
+	c := &Comparison{
+		From:           from.Id,
+		To:             to.Id,
+		SystemChanges:  make([]SystemChange, 0),
+		HostsAdded:     make([]string, 0),
+		HostsRemoved:   make([]string, 0),
+		SecretsRotated: make([]SecretsRotated, 0),
+		Regressions:    make([]DurationChange, 0),
+		Duration:       DurationChange{From: from.duration(), To: to.duration()},
+	}
+
+	fromHosts := make(map[string]*Host)
+	for _, host := range from.Hosts {
+		fromHosts[host.Name] = host
+	}
+	toHosts := make(map[string]bool)
+	for _, host := range to.Hosts {
+		toHosts[host.Name] = true
+		old, ok := fromHosts[host.Name]
+		if !ok {
+			c.HostsAdded = append(c.HostsAdded, host.Name)
+			continue
+		}
+		if old.SystemPath != host.SystemPath && host.SystemPath != "" {
+			c.SystemChanges = append(c.SystemChanges, SystemChange{Host: host.Name, From: old.SystemPath, To: host.SystemPath})
+		}
+		if isRegression(old.Duration, host.Duration, threshold) {
+			c.Regressions = append(c.Regressions, DurationChange{Host: host.Name, From: old.Duration, To: host.Duration})
+		}
+	}
+	for _, host := range from.Hosts {
+		if !toHosts[host.Name] {
+			c.HostsRemoved = append(c.HostsRemoved, host.Name)
+		}
+	}
+
+	if len(between) == 0 {
+		between = []*Run{to}
+	}
+	rotated := make(map[string]map[string]bool)
+	for _, run := range between {
+		for _, host := range run.Hosts {
+			for _, name := range host.SecretsChanged {
+				if rotated[host.Name] == nil {
+					rotated[host.Name] = make(map[string]bool)
+				}
+				rotated[host.Name][name] = true
+			}
+		}
+	}
+	for host, names := range rotated {
+		secrets := make([]string, 0, len(names))
+		for name := range names {
+			secrets = append(secrets, name)
+		}
+		sort.Strings(secrets)
+		c.SecretsRotated = append(c.SecretsRotated, SecretsRotated{Host: host, Secrets: secrets})
+	}
+	sort.Slice(c.SecretsRotated, func(i, j int) bool { return c.SecretsRotated[i].Host < c.SecretsRotated[j].Host })
+
+	return c
+}
+
+func isRegression(from float64, to float64, threshold float64) bool {
+	return from > 0 && to-from >= minRegression && to > from*(1+threshold/100)
+}
+
+func (run *Run) duration() float64 {
+	if run.Finished.IsZero() {
+		return 0
+	}
+	return run.Finished.Sub(run.Started).Seconds()
+}
+
+func (c *Comparison) Write(out io.Writer) error {
+	var s strings.Builder
+
+	fmt.Fprintf(&s, "Comparing run %s with %s\n", c.From, c.To)
+
+	fmt.Fprintf(&s, "\nSystem changes:\n")
+	if len(c.SystemChanges) == 0 {
+		fmt.Fprintf(&s, "\tNone\n")
+	}
+	for _, change := range c.SystemChanges {
+		fmt.Fprintf(&s, "\t* %s: %s -> %s\n", change.Host, orUnknown(change.From), change.To)
+	}
+	if len(c.HostsAdded) > 0 {
+		fmt.Fprintf(&s, "\nHosts only in %s: %s\n", c.To, strings.Join(c.HostsAdded, ", "))
+	}
+	if len(c.HostsRemoved) > 0 {
+		fmt.Fprintf(&s, "\nHosts only in %s: %s\n", c.From, strings.Join(c.HostsRemoved, ", "))
+	}
+
+	fmt.Fprintf(&s, "\nSecrets rotated:\n")
+	if len(c.SecretsRotated) == 0 {
+		fmt.Fprintf(&s, "\tNone\n")
+	}
+	for _, rotated := range c.SecretsRotated {
+		fmt.Fprintf(&s, "\t* %s: %s\n", rotated.Host, strings.Join(rotated.Secrets, ", "))
+	}
+
+	fmt.Fprintf(&s, "\nDuration: %.1fs -> %.1fs\n", c.Duration.From, c.Duration.To)
+	if len(c.Regressions) > 0 {
+		fmt.Fprintf(&s, "\nSlower hosts:\n")
+	}
+	for _, regression := range c.Regressions {
+		fmt.Fprintf(&s, "\t* %s: %.1fs -> %.1fs (+%.0f%%)\n", regression.Host, regression.From, regression.To,
+			(regression.To/regression.From-1)*100)
+	}
+
+	_, err := io.WriteString(out, s.String())
+	return err
+}
+
+func orUnknown(path string) string {
+	if path == "" {
+		return "(unknown)"
+	}
+	return path
+}
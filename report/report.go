@@ -0,0 +1,161 @@
+package report
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+)
+
+// Outcome of a single step for a host
+type Status string
+
+const (
+	StatusOK      Status = "ok"
+	StatusFailed  Status = "failed"
+	StatusSkipped Status = "skipped"
+)
+
+// Machine-readable summary of a morph invocation, e.g. for CI pipelines and dashboards
+type Run struct {
+	Id         string `json:"id"`
+	Command    string `json:"command"`
+	Deployment string `json:"deployment,omitempty"`
+	// The user running morph, as user@host
+	Operator     string    `json:"operator,omitempty"`
+	SwitchAction string    `json:"switchAction,omitempty"`
+	Started      time.Time `json:"started"`
+	Finished     time.Time `json:"finished"`
+	ResultPath   string    `json:"resultPath,omitempty"`
+	Transfer     *Transfer `json:"transfer,omitempty"`
+	Hosts        []*Host   `json:"hosts"`
+	Error        string    `json:"error,omitempty"`
+
+	// hosts may be deployed at the same time
+	mutex sync.Mutex
+}
+
+type Host struct {
+	Name         string      `json:"name"`
+	TargetHost   string      `json:"targetHost"`
+	Tags         []string    `json:"tags"`
+	Environment  string      `json:"environment,omitempty"`
+	SystemPath   string      `json:"systemPath,omitempty"`
+	Push         Status      `json:"push,omitempty"`
+	Transfer     *Transfer   `json:"transfer,omitempty"`
+	Secrets      Status      `json:"secrets,omitempty"`
+	Activation   Status      `json:"activation,omitempty"`
+	UnitChanges  interface{} `json:"unitChanges,omitempty"`
+	HealthChecks Status      `json:"healthChecks,omitempty"`
+	Error        string      `json:"error,omitempty"`
+	// Seconds spent on the deployment steps of the host
+	Duration float64 `json:"duration,omitempty"`
+
+	// Package version changes compared to the system running before, one line per package
+	PackageChanges []string `json:"packageChanges,omitempty"`
+	// Names of the secrets with new or changed content
+	SecretsChanged []string `json:"secretsChanged,omitempty"`
+}
+
+// Store paths copied to a host with their combined (uncompressed) size; for a run, the total of all hosts
+type Transfer struct {
+	Paths int   `json:"paths"`
+	Bytes int64 `json:"bytes"`
+}
+
+func New(command string) *Run {
+	started := time.Now()
+	return &Run{
+		Id:       newRunId(started),
+		Command:  command,
+		Operator: operator(),
+		Started:  started,
+		Hosts:    make([]*Host, 0),
+	}
+}
+
+func operator() string {
+	name := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		return name + "@" + hostname
+	}
+	return name
+}
+
+// Sortable and unique id of a run, e.g. 20190102T150405-1a2b3c4d
+func newRunId(started time.Time) string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return started.UTC().Format("20060102T150405") + "-" + hex.EncodeToString(suffix)
+}
+
+func (run *Run) AddHost(name string, targetHost string, tags []string) *Host {
+	host := &Host{
+		Name:       name,
+		TargetHost: targetHost,
+		Tags:       tags,
+	}
+	run.mutex.Lock()
+	run.Hosts = append(run.Hosts, host)
+	run.mutex.Unlock()
+	return host
+}
+
+// Get the entry of a host, adding it if it isn't part of the run yet
+func (run *Run) Host(name string) *Host {
+	run.mutex.Lock()
+	for _, host := range run.Hosts {
+		if host.Name == name {
+			run.mutex.Unlock()
+			return host
+		}
+	}
+	run.mutex.Unlock()
+	return run.AddHost(name, "", nil)
+}
+
+// Record the outcome of a step, returning err for convenience
+func (host *Host) Record(step *Status, err error) error {
+	if err != nil {
+		*step = StatusFailed
+		host.Error = err.Error()
+	} else {
+		*step = StatusOK
+	}
+	return err
+}
+
+func (run *Run) Finish(err error) {
+	run.Finished = time.Now()
+	run.Transfer = nil
+	for _, host := range run.Hosts {
+		if host.Transfer == nil {
+			continue
+		}
+		if run.Transfer == nil {
+			run.Transfer = &Transfer{}
+		}
+		run.Transfer.Paths += host.Transfer.Paths
+		run.Transfer.Bytes += host.Transfer.Bytes
+	}
+	if err != nil {
+		run.Error = err.Error()
+	}
+}
+
+func (run *Run) Write(out io.Writer) error {
+	data, err := json.MarshalIndent(run, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = out.Write(append(data, '\n'))
+	return err
+}
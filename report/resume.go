@@ -0,0 +1,69 @@
+package report
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// What's left of a deployment which failed part way through the hosts, for `morph deploy --resume`
+type Resume struct {
+	Deployment   string    `json:"deployment"`
+	SwitchAction string    `json:"switchAction"`
+	ResultPath   string    `json:"resultPath"`
+	RunId        string    `json:"runId"`
+	Failed       time.Time `json:"failed"`
+	// The hosts not deployed yet, including the one that failed, in the order they were to be deployed
+	Hosts []string `json:"hosts"`
+}
+
+// There is one state file per deployment, named by a hash of the absolute path of the deployment
+func resumePath(dir string, deployment string) string {
+	sum := sha256.Sum256([]byte(deployment))
+	return filepath.Join(dir, "resume", hex.EncodeToString(sum[:8])+".json")
+}
+
+func (resume *Resume) Save(dir string) (path string, err error) {
+	path = resumePath(dir, resume.Deployment)
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+
+	data, err := json.MarshalIndent(resume, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return path, ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+func LoadResume(dir string, deployment string) (*Resume, error) {
+	path := resumePath(dir, deployment)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, errors.New(fmt.Sprintf("There is no failed deployment of %s to resume\n", deployment))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var resume Resume
+	if err := json.Unmarshal(data, &resume); err != nil {
+		return nil, errors.New(fmt.Sprintf("Couldn't read the resume state %s: %s\n", path, err.Error()))
+	}
+	return &resume, nil
+}
+
+// Forget about the failed deployment, once it has been completed
+func RemoveResume(dir string, deployment string) error {
+	err := os.Remove(resumePath(dir, deployment))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
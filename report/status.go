@@ -0,0 +1,111 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// What was last deployed to a host, according to the stored runs
+type HostStatus struct {
+	Host         string    `json:"host"`
+	SystemPath   string    `json:"systemPath"`
+	Deployed     time.Time `json:"deployed"`
+	Operator     string    `json:"operator,omitempty"`
+	SwitchAction string    `json:"switchAction,omitempty"`
+	RunId        string    `json:"runId"`
+	// A later deployment which failed on the host, if any
+	FailedRunId string     `json:"failedRunId,omitempty"`
+	Failed      *time.Time `json:"failed,omitempty"`
+}
+
+// All stored runs, oldest first
+func All(dir string) (runs []*Run, err error) {
+	ids, err := List(dir)
+	if err != nil {
+		return runs, err
+	}
+
+	for _, id := range ids {
+		run, err := Load(filepath.Join(dir, id+".json"))
+		if err != nil {
+			return runs, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
+// The last system activated on each host by the deploy and rollback runs of deployment, sorted by host
+func LastDeployed(runs []*Run, deployment string) []HostStatus {
+	statuses := make(map[string]*HostStatus)
+	for _, run := range runs {
+		// dry-activate doesn't change the hosts
+		if run.Command != "deploy" && run.Command != "rollback" || run.Deployment != deployment || run.SwitchAction == "dry-activate" {
+			continue
+		}
+		switchAction := run.SwitchAction
+		if run.Command == "rollback" {
+			switchAction = "rollback"
+		}
+		for _, host := range run.Hosts {
+			switch host.Activation {
+			case StatusOK:
+				statuses[host.Name] = &HostStatus{
+					Host:         host.Name,
+					SystemPath:   host.SystemPath,
+					Deployed:     run.Finished,
+					Operator:     run.Operator,
+					SwitchAction: switchAction,
+					RunId:        run.Id,
+				}
+			case StatusFailed:
+				status, ok := statuses[host.Name]
+				if !ok {
+					status = &HostStatus{Host: host.Name}
+					statuses[host.Name] = status
+				}
+				failed := run.Finished
+				status.FailedRunId = run.Id
+				status.Failed = &failed
+			}
+		}
+	}
+
+	result := make([]HostStatus, 0, len(statuses))
+	for _, status := range statuses {
+		result = append(result, *status)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Host < result[j].Host })
+	return result
+}
+
+func WriteStatus(out io.Writer, statuses []HostStatus) error {
+	var s strings.Builder
+
+	if len(statuses) == 0 {
+		fmt.Fprintf(&s, "No deployments recorded\n")
+	}
+	for _, status := range statuses {
+		fmt.Fprintf(&s, "%s:\n", status.Host)
+		if status.RunId != "" {
+			fmt.Fprintf(&s, "\tSystem:   %s\n", orUnknown(status.SystemPath))
+			fmt.Fprintf(&s, "\tDeployed: %s (%s)", status.Deployed.Local().Format("2006-01-02 15:04:05"), status.SwitchAction)
+			if status.Operator != "" {
+				fmt.Fprintf(&s, " by %s", status.Operator)
+			}
+			fmt.Fprintf(&s, ", run %s\n", status.RunId)
+		} else {
+			fmt.Fprintf(&s, "\tNo successful deployment recorded\n")
+		}
+		if status.FailedRunId != "" {
+			fmt.Fprintf(&s, "\tFailed:   %s, run %s\n", status.Failed.Local().Format("2006-01-02 15:04:05"), status.FailedRunId)
+		}
+	}
+
+	_, err := io.WriteString(out, s.String())
+	return err
+}
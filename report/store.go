@@ -0,0 +1,122 @@
+package report
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Runs are stored as one manifest per run, named by the id of the run, so they sort chronologically
+func DefaultDir() string {
+	if state := os.Getenv("XDG_STATE_HOME"); state != "" {
+		return filepath.Join(state, "morph", "runs")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(".morph", "runs")
+	}
+	return filepath.Join(home, ".local", "state", "morph", "runs")
+}
+
+// Store the manifest of the run in dir
+func (run *Run) Save(dir string) (path string, err error) {
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	data, err := json.MarshalIndent(run, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	path = filepath.Join(dir, run.Id+".json")
+	return path, ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+func Load(path string) (*Run, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var run Run
+	if err := json.Unmarshal(data, &run); err != nil {
+		return nil, errors.New(fmt.Sprintf("Couldn't read the run manifest %s: %s", path, err.Error()))
+	}
+	return &run, nil
+}
+
+// The ids of the runs stored in dir, oldest first
+func List(dir string) (ids []string, err error) {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return ids, nil
+	}
+	if err != nil {
+		return ids, err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+			ids = append(ids, strings.TrimSuffix(entry.Name(), ".json"))
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Find a stored run by its id, a unique prefix of the id, or the path of its manifest
+func Find(dir string, ref string) (*Run, error) {
+	if _, err := os.Stat(ref); err == nil && strings.HasSuffix(ref, ".json") {
+		return Load(ref)
+	}
+
+	ids, err := List(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := make([]string, 0)
+	for _, id := range ids {
+		if id == ref {
+			return Load(filepath.Join(dir, id+".json"))
+		}
+		if strings.HasPrefix(id, ref) {
+			matches = append(matches, id)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, errors.New(fmt.Sprintf("No run %s in %s", ref, dir))
+	case 1:
+		return Load(filepath.Join(dir, matches[0]+".json"))
+	default:
+		return nil, errors.New(fmt.Sprintf("Run %s is ambiguous, matching: %s", ref, strings.Join(matches, ", ")))
+	}
+}
+
+// The stored runs after the run with id from, up to and including the run with id to
+func Between(dir string, from string, to string) (runs []*Run, err error) {
+	ids, err := List(dir)
+	if err != nil {
+		return runs, err
+	}
+
+	for _, id := range ids {
+		if id <= from || id > to {
+			continue
+		}
+		run, err := Load(filepath.Join(dir, id+".json"))
+		if err != nil {
+			return runs, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
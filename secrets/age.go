@@ -0,0 +1,52 @@
+package secrets
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/dbcdk/morph/utils"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Plaintext of age-encrypted secrets, kept in memory only, so each secret is decrypted once per run
+var (
+	decryptedAge      = make(map[string][]byte)
+	decryptedAgeMutex sync.Mutex
+)
+
+// Decrypt the age-encrypted source of a secret using its identity file
+func decryptAge(secret Secret, deploymentWD string) ([]byte, error) {
+	source := utils.GetAbsPathRelativeTo(secret.Source, deploymentWD)
+	identity := secret.AgeIdentity
+	if strings.HasPrefix(identity, "~/") {
+		identity = os.Getenv("HOME") + identity[1:]
+	}
+	identity = utils.GetAbsPathRelativeTo(identity, deploymentWD)
+
+	decryptedAgeMutex.Lock()
+	defer decryptedAgeMutex.Unlock()
+
+	key := source + "\x00" + identity
+	if plaintext, ok := decryptedAge[key]; ok {
+		return plaintext, nil
+	}
+
+	if _, err := exec.LookPath("age"); err != nil {
+		return nil, errors.New("Decrypting secrets with age requires the age binary on $PATH")
+	}
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	cmd := exec.Command("age", "--decrypt", "--identity", identity, source)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, errors.New(fmt.Sprintf("Decrypting %s with age failed: %s", secret.Source, strings.TrimSpace(stderr.String())))
+	}
+
+	decryptedAge[key] = stdout.Bytes()
+	return stdout.Bytes(), nil
+}
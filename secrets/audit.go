@@ -0,0 +1,96 @@
+package secrets
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/dbcdk/morph/ssh"
+	"strconv"
+	"strings"
+)
+
+type AuditFinding struct {
+	Secret      string
+	Destination string
+	Problem     string
+}
+
+func (f AuditFinding) String() string {
+	return fmt.Sprintf("%s (%s): %s", f.Secret, f.Destination, f.Problem)
+}
+
+// Filesystems considered non-persistent for ephemeral secrets
+var ephemeralFilesystems = []string{"tmpfs", "ramfs"}
+
+// Check a secret on the remote host for world-readable permissions, wrong ownership and
+// (for ephemeral secrets) a destination on a persistent filesystem.
+func AuditSecret(ctx ssh.Context, host ssh.Host, name string, secret Secret) (findings []AuditFinding, err error) {
+	finding := func(format string, args ...interface{}) {
+		findings = append(findings, AuditFinding{
+			Secret:      name,
+			Destination: secret.Destination,
+			Problem:     fmt.Sprintf(format, args...),
+		})
+	}
+
+	stat, err := remoteStat(ctx, host, "-c", "%a:%U:%G", secret.Destination)
+	if err != nil {
+		finding("missing or unreadable: %s", err)
+		return findings, nil
+	}
+
+	parts := strings.Split(stat, ":")
+	if len(parts) != 3 {
+		return findings, errors.New("Unexpected output from stat: " + stat)
+	}
+	mode, err := strconv.ParseUint(parts[0], 8, 32)
+	if err != nil {
+		return findings, err
+	}
+
+	if mode&0004 != 0 {
+		finding("world-readable (mode %s)", parts[0])
+	}
+	if mode&0002 != 0 {
+		finding("world-writable (mode %s)", parts[0])
+	}
+	if expected, err := strconv.ParseUint(secret.Permissions, 8, 32); err == nil && expected != mode {
+		finding("permissions are %04o, expected %04o", mode, expected)
+	}
+	if parts[1] != secret.Owner.User || parts[2] != secret.Owner.Group {
+		finding("owned by %s:%s, expected %s:%s", parts[1], parts[2], secret.Owner.User, secret.Owner.Group)
+	}
+
+	if secret.Ephemeral {
+		fsType, err := remoteStat(ctx, host, "-f", "-c", "%T", secret.Destination)
+		if err != nil {
+			return findings, err
+		}
+		if !isEphemeralFilesystem(fsType) {
+			finding("ephemeral secret stored on a persistent filesystem (%s)", fsType)
+		}
+	}
+
+	return findings, nil
+}
+
+func isEphemeralFilesystem(fsType string) bool {
+	for _, ephemeral := range ephemeralFilesystems {
+		if fsType == ephemeral {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteStat(ctx ssh.Context, host ssh.Host, args ...string) (string, error) {
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	err := ctx.Run(host, nil, &stdout, &stderr, append([]string{"sudo", "stat"}, args...)...)
+	if err != nil {
+		return "", errors.New(strings.TrimSpace(stderr.String()))
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
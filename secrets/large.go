@@ -0,0 +1,129 @@
+package secrets
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/dbcdk/morph/logging"
+	"github.com/dbcdk/morph/ssh"
+	"github.com/dbcdk/morph/utils"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Secrets of at least this size are streamed to a resumable staging file, with progress and checksum verification
+const LargeSecretSize = 16 * 1024 * 1024
+
+// Directory below the home of the SSH user on the target, holding partially uploaded large secrets
+const uploadStagingDir = ".cache/morph/uploads"
+
+// Stream a file to a staging path on the host, named after its checksum, continuing a previous attempt if one was
+// interrupted. Returns the staging path once the checksum of the uploaded file matches.
+func uploadLargeFile(ctx ssh.Context, host ssh.Host, source string, size int64) (path string, err error) {
+	log := logging.WithHost(host.GetName())
+
+	checksum, _, err := hashFile(source)
+	if err != nil {
+		return "", err
+	}
+	path = uploadStagingDir + "/" + checksum
+
+	if _, err := remoteOutput(ctx, host, nil, "mkdir", "-p", "-m", "700", uploadStagingDir); err != nil {
+		return "", err
+	}
+
+	offset, err := remoteSize(ctx, host, path)
+	if err != nil {
+		return "", err
+	}
+	if offset > size {
+		// not a partial upload of this file, start over
+		offset = 0
+	}
+	if offset > 0 {
+		log.Infof("\t  resuming upload of %s at %s\n", source, utils.FormatBytes(offset))
+	} else {
+		log.Verbosef("Uploading %s via %s\n", source, path)
+	}
+
+	file, err := os.Open(source)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if offset < size {
+		redirect := ">>"
+		if offset == 0 {
+			redirect = ">"
+		}
+		progress := &progressReader{
+			reader: io.NewSectionReader(file, offset, size-offset),
+			log:    log,
+			name:   source,
+			done:   offset,
+			total:  size,
+			// only report progress beyond what was uploaded before
+			reported: offset * 10 / size,
+		}
+		if _, err := remoteOutput(ctx, host, progress, "cat", redirect, utils.ShellQuote(path)); err != nil {
+			return "", err
+		}
+	}
+
+	output, err := remoteOutput(ctx, host, nil, "sha256sum", utils.ShellQuote(path))
+	if err != nil {
+		return "", err
+	}
+	if fields := strings.Fields(output); len(fields) == 0 || fields[0] != checksum {
+		remoteOutput(ctx, host, nil, "rm", "-f", utils.ShellQuote(path))
+		return "", errors.New(fmt.Sprintf("Checksum mismatch after uploading %s, expected sha256 %s", source, checksum))
+	}
+
+	return path, nil
+}
+
+// Size of a file on the host, or 0 if it doesn't exist
+func remoteSize(ctx ssh.Context, host ssh.Host, path string) (int64, error) {
+	output, err := remoteOutput(ctx, host, nil, "stat", "-c", "%s", utils.ShellQuote(path), "2>/dev/null", "||", "echo", "0")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(output), 10, 64)
+}
+
+func remoteOutput(ctx ssh.Context, host ssh.Host, stdin io.Reader, parts ...string) (string, error) {
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	err := ctx.Run(host, stdin, &stdout, &stderr, parts...)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Error running %s on %s: %s", parts[0], host.GetName(), strings.TrimSpace(stderr.String())))
+	}
+
+	return stdout.String(), nil
+}
+
+// Logs the progress of an upload for every tenth of the file read
+type progressReader struct {
+	reader   io.Reader
+	log      *logging.Logger
+	name     string
+	done     int64
+	total    int64
+	reported int64
+}
+
+func (r *progressReader) Read(p []byte) (n int, err error) {
+	n, err = r.reader.Read(p)
+	r.done += int64(n)
+
+	if tenth := r.done * 10 / r.total; tenth > r.reported {
+		r.reported = tenth
+		r.log.Infof("\t  uploading %s: %d%% (%s of %s)\n", r.name, tenth*10, utils.FormatBytes(r.done), utils.FormatBytes(r.total))
+	}
+
+	return n, err
+}
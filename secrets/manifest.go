@@ -0,0 +1,191 @@
+package secrets
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/dbcdk/morph/ssh"
+	"github.com/dbcdk/morph/utils"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Location of the manifest of uploaded secrets on the target hosts
+const ManifestPath = "/var/lib/morph/secrets-manifest.json"
+
+// Number of versions kept in the manifest, dropping the oldest ones
+const manifestVersionsKept = 100
+
+// History of the secrets uploaded to a host, oldest version first
+type Manifest struct {
+	Versions []ManifestVersion `json:"versions"`
+}
+
+// Secrets uploaded to a host by a single morph run
+type ManifestVersion struct {
+	Version  int                      `json:"version"`
+	RunId    string                   `json:"runId"`
+	Uploaded time.Time                `json:"uploaded"`
+	Secrets  map[string]ManifestEntry `json:"secrets"`
+}
+
+type ManifestEntry struct {
+	Destination string `json:"destination"`
+	Sha256      string `json:"sha256"`
+	Size        int64  `json:"size"`
+	Owner       Owner  `json:"owner"`
+	Permissions string `json:"permissions"`
+}
+
+func (manifest *Manifest) Latest() *ManifestVersion {
+	if len(manifest.Versions) == 0 {
+		return nil
+	}
+	return &manifest.Versions[len(manifest.Versions)-1]
+}
+
+// Read the manifest of a host; a host which never had secrets uploaded by morph has an empty manifest
+func ReadManifest(ctx ssh.Context, host ssh.Host) (manifest Manifest, err error) {
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	err = ctx.Run(host, nil, &stdout, &stderr, "sudo", "cat", ManifestPath)
+	if err != nil {
+		if strings.Contains(stderr.String(), "No such file or directory") {
+			return manifest, nil
+		}
+		return manifest, errors.New("Reading secrets manifest: " + strings.TrimSpace(stderr.String()))
+	}
+
+	err = json.Unmarshal(stdout.Bytes(), &manifest)
+	return manifest, err
+}
+
+// Add a version for the given uploaded secrets to the manifest of the host, unless they are the same as in the
+// previous version, returning the names of the secrets which are new or have a different content
+func RecordManifest(ctx ssh.Context, host ssh.Host, uploaded map[string]Secret, deploymentWD string, runId string) (changed []string, err error) {
+	manifest, err := ReadManifest(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	version := ManifestVersion{
+		Version:  1,
+		RunId:    runId,
+		Uploaded: time.Now().UTC(),
+		Secrets:  make(map[string]ManifestEntry),
+	}
+	latest := manifest.Latest()
+	if latest != nil {
+		version.Version = latest.Version + 1
+	}
+
+	for name, secret := range uploaded {
+		hash, size, err := hashSecret(secret, deploymentWD)
+		if err != nil {
+			return nil, err
+		}
+		if latest == nil || latest.Secrets[name].Sha256 != hash {
+			changed = append(changed, name)
+		}
+		version.Secrets[name] = ManifestEntry{
+			Destination: secret.Destination,
+			Sha256:      hash,
+			Size:        size,
+			Owner:       secret.Owner,
+			Permissions: secret.Permissions,
+		}
+	}
+	sort.Strings(changed)
+
+	// uploads which change nothing (secrets, owners and permissions) don't add a version
+	if latest != nil && sameEntries(latest.Secrets, version.Secrets) {
+		return changed, nil
+	}
+	manifest.Versions = append(manifest.Versions, version)
+	if len(manifest.Versions) > manifestVersionsKept {
+		manifest.Versions = manifest.Versions[len(manifest.Versions)-manifestVersionsKept:]
+	}
+
+	return changed, WriteManifest(ctx, host, manifest)
+}
+
+func sameEntries(a map[string]ManifestEntry, b map[string]ManifestEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, entry := range a {
+		if other, ok := b[name]; !ok || other != entry {
+			return false
+		}
+	}
+	return true
+}
+
+// Replace the manifest of the host, e.g. with the one of the machine it replaces
+func WriteManifest(ctx ssh.Context, host ssh.Host, manifest Manifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := ioutil.TempFile("", "morph-secrets-manifest")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	_, err = tempFile.Write(data)
+	tempFile.Close()
+	if err != nil {
+		return err
+	}
+
+	// the manifest is uploaded like a secret, readable by root only
+	uploadErr := UploadSecret(ctx, host, Secret{
+		Source:      tempFile.Name(),
+		Destination: ManifestPath,
+		Owner:       Owner{User: "root", Group: "root"},
+		Permissions: "0600",
+		MkDirs:      true,
+	}, "")
+	if uploadErr != nil {
+		return uploadErr
+	}
+
+	return nil
+}
+
+// Hash the plaintext content of a secret
+func hashSecret(secret Secret, deploymentWD string) (hash string, size int64, err error) {
+	if plaintext, ok, err := inMemoryPlaintext(secret, deploymentWD); ok {
+		if err != nil {
+			return "", 0, err
+		}
+		sum := sha256.Sum256(plaintext)
+		return hex.EncodeToString(sum[:]), int64(len(plaintext)), nil
+	}
+	return hashFile(utils.GetAbsPathRelativeTo(secret.Source, deploymentWD))
+}
+
+func hashFile(path string) (hash string, size int64, err error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer fh.Close()
+
+	hasher := sha256.New()
+	size, err = io.Copy(hasher, fh)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), size, nil
+}
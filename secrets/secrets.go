@@ -1,10 +1,16 @@
 package secrets
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/dbcdk/morph/logging"
 	"github.com/dbcdk/morph/ssh"
 	"github.com/dbcdk/morph/utils"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 type SecretError struct {
@@ -31,6 +37,10 @@ func (e SecretError) Error() string {
 }
 
 func GetSecretSize(secret Secret, deploymentWD string) (size int64, err error) {
+	if plaintext, ok, err := inMemoryPlaintext(secret, deploymentWD); ok {
+		return int64(len(plaintext)), err
+	}
+
 	fh, err := os.Open(utils.GetAbsPathRelativeTo(secret.Source, deploymentWD))
 	if err != nil {
 		return size, err
@@ -47,7 +57,10 @@ func GetSecretSize(secret Secret, deploymentWD string) (size int64, err error) {
 func UploadSecret(ctx ssh.Context, host ssh.Host, secret Secret, deploymentWD string) *SecretError {
 	var partialErr *SecretError
 
-	tempPath, err := ctx.MakeTempFile(host)
+	log := logging.WithHost(host.GetName())
+	source := utils.GetAbsPathRelativeTo(secret.Source, deploymentWD)
+
+	size, err := GetSecretSize(secret, deploymentWD)
 	if err != nil {
 		return wrap(err)
 	}
@@ -58,25 +71,136 @@ func UploadSecret(ctx ssh.Context, host ssh.Host, secret Secret, deploymentWD st
 		}
 	}
 
-	err = ctx.UploadFile(host, utils.GetAbsPathRelativeTo(secret.Source, deploymentWD), tempPath)
+	var tempPath string
+	if plaintext, ok, err := inMemoryPlaintext(secret, deploymentWD); ok {
+		// the plaintext is streamed from memory, and never written to a local file
+		if err != nil {
+			return wrap(err)
+		}
+		label := secret.Source
+		if secret.VaultPath != "" {
+			label = "vault:" + secret.VaultPath
+		} else if len(secret.FromCommand) > 0 {
+			label = "output of " + secret.FromCommand[0]
+		}
+		tempPath, err = ctx.MakeTempFile(host)
+		if err != nil {
+			return wrap(err)
+		}
+		log.Verbosef("Uploading decrypted %s via %s\n", label, tempPath)
+
+		var output bytes.Buffer
+		writer := utils.NewLockedWriter(&output)
+		err = ctx.Run(host, bytes.NewReader(plaintext), writer, writer, "cat", ">", utils.ShellQuote(tempPath))
+		if err != nil {
+			return wrap(errors.New(fmt.Sprintf("Couldn't upload decrypted %s -> %s: %s", label, tempPath, output.String())))
+		}
+	} else if size >= LargeSecretSize {
+		tempPath, err = uploadLargeFile(ctx, host, source, size)
+		if err != nil {
+			return wrap(err)
+		}
+	} else {
+		tempPath, err = ctx.MakeTempFile(host)
+		if err != nil {
+			return wrap(err)
+		}
+		log.Verbosef("Uploading %s via %s\n", secret.Source, tempPath)
+
+		err = ctx.UploadFile(host, source, tempPath)
+		if err != nil {
+			return wrap(err)
+		}
+	}
+
+	installed, err := ctx.InstallFile(host, tempPath, secret.Destination, secret.Owner.User, secret.Owner.Group, secret.Permissions)
 	if err != nil {
-		return wrap(err)
+		if !installed {
+			return wrap(err)
+		}
+		partialErr = wrapNonFatal(err)
 	}
 
-	err = ctx.MoveFile(host, tempPath, secret.Destination)
+	return partialErr
+}
+
+// How a secret compares to the copy on the host, before uploading it
+type Change struct {
+	// "created" if the secret isn't on the host yet, "updated" if its content, owner or permissions differ,
+	// or else "unchanged"
+	Status string
+	// SHA-256 of the content on the host, if it could be read, and of the content to upload
+	OldHash string
+	NewHash string
+}
+
+const (
+	Created   = "created"
+	Updated   = "updated"
+	Unchanged = "unchanged"
+)
+
+// Short form of the hashes, e.g. "1a2b3c4d -> 5e6f7a8b", for showing whether a rotation took effect
+func (c Change) Hashes() string {
+	short := func(hash string) string {
+		if hash == "" {
+			return "?"
+		}
+		if len(hash) > 8 {
+			return hash[:8]
+		}
+		return hash
+	}
+	if c.Status != Updated {
+		return short(c.NewHash)
+	}
+	if c.OldHash == c.NewHash {
+		return short(c.NewHash) + ", owner or permissions"
+	}
+	return short(c.OldHash) + " -> " + short(c.NewHash)
+}
+
+// Compare the secret with the file on the host; an unchanged secret (same content, owner and permissions)
+// doesn't need to be uploaded. A remote file which can't be read counts as updated.
+func Compare(ctx ssh.Context, host ssh.Host, secret Secret, deploymentWD string) (Change, error) {
+	hash, _, err := hashSecret(secret, deploymentWD)
 	if err != nil {
-		return wrap(err)
+		return Change{}, err
 	}
+	change := Change{Status: Updated, NewHash: hash}
 
-	err = ctx.SetOwner(host, secret.Destination, secret.Owner.User, secret.Owner.Group)
+	var stdout bytes.Buffer
+	destination := utils.ShellQuote(secret.Destination)
+	err = ctx.Run(host, nil, &stdout, nil, "sudo", "sh", "-c",
+		utils.ShellQuote(fmt.Sprintf("[ -e %[1]s ] || exit 0; sha256sum < %[1]s && stat -c '%%U %%G %%a' %[1]s", destination)))
 	if err != nil {
-		partialErr = wrapNonFatal(err)
+		return change, nil
 	}
 
-	err = ctx.SetPermissions(host, secret.Destination, secret.Permissions)
+	fields := strings.Fields(stdout.String())
+	if len(fields) == 0 {
+		change.Status = Created
+		return change, nil
+	}
+	// hash, "-", user, group, permissions
+	if len(fields) != 5 {
+		return change, nil
+	}
+	change.OldHash = fields[0]
+	if fields[0] != hash || fields[2] != secret.Owner.User || fields[3] != secret.Owner.Group {
+		return change, nil
+	}
+	remotePermissions, err := strconv.ParseUint(fields[4], 8, 32)
 	if err != nil {
-		partialErr = wrapNonFatal(err)
+		return change, nil
+	}
+	permissions, err := strconv.ParseUint(secret.Permissions, 8, 32)
+	if err != nil {
+		return change, nil
 	}
 
-	return partialErr
+	if remotePermissions == permissions {
+		change.Status = Unchanged
+	}
+	return change, nil
 }
@@ -0,0 +1,188 @@
+package secrets
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/dbcdk/morph/logging"
+	"github.com/dbcdk/morph/utils"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Directory holding decrypted secrets until they are uploaded, only accessible by the current user
+var plaintextDir string
+
+// Check that the secret has at most one source set; having none is reported once it is uploaded
+func CheckSources(secret Secret) error {
+	var set []string
+	for _, source := range []struct {
+		name string
+		set  bool
+	}{
+		{"source", secret.Source != ""},
+		{"sopsFile", secret.SopsFile != ""},
+		{"vaultPath", secret.VaultPath != ""},
+		{"fromEnv", secret.FromEnv != ""},
+		{"fromCommand", len(secret.FromCommand) > 0},
+	} {
+		if source.set {
+			set = append(set, source.name)
+		}
+	}
+
+	if len(set) > 1 {
+		return errors.New(fmt.Sprintf("Secret for %s has more than one source set (%s); set exactly one of source, sopsFile, vaultPath, fromEnv and fromCommand",
+			secret.Destination, strings.Join(set, ", ")))
+	}
+	return nil
+}
+
+// Get a local file with the content of a secret, decrypting it if necessary.
+// The cleanup function removes any plaintext written for it.
+func ResolveSource(secret Secret, deploymentWD string) (path string, cleanup func(), err error) {
+	switch {
+	case secret.VaultPath != "" || len(secret.FromCommand) > 0:
+		// streamed from memory by UploadSecret
+		return "", func() {}, nil
+	case secret.SopsFile != "":
+		return decryptSops(secret, deploymentWD)
+	case secret.FromEnv != "":
+		return fromEnv(secret)
+	case secret.Source != "":
+		return utils.GetAbsPathRelativeTo(secret.Source, deploymentWD), func() {}, nil
+	default:
+		return "", nil, errors.New(fmt.Sprintf("Secret for %s has none of source, sopsFile, vaultPath, fromEnv and fromCommand set", secret.Destination))
+	}
+}
+
+// Get the plaintext of secrets which are only kept in memory (age-encrypted, read from Vault or output by a command);
+// ok is false for secrets read from a local file
+func inMemoryPlaintext(secret Secret, deploymentWD string) (plaintext []byte, ok bool, err error) {
+	switch {
+	case secret.VaultPath != "":
+		plaintext, err = fetchVault(secret)
+		return plaintext, true, err
+	case len(secret.FromCommand) > 0:
+		plaintext, err = runSourceCommand(secret, deploymentWD)
+		return plaintext, true, err
+	case secret.AgeIdentity != "":
+		plaintext, err = decryptAge(secret, deploymentWD)
+		return plaintext, true, err
+	default:
+		return nil, false, nil
+	}
+}
+
+// Write the value of an environment variable (e.g. injected by CI) to a plaintext file, redacting it in the log
+func fromEnv(secret Secret) (path string, cleanup func(), err error) {
+	value, ok := os.LookupEnv(secret.FromEnv)
+	if !ok {
+		return "", nil, errors.New(fmt.Sprintf("Environment variable %s for the secret for %s is not set", secret.FromEnv, secret.Destination))
+	}
+	logging.Redact(value)
+
+	file, err := newPlaintextFile()
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup = func() {
+		os.Remove(file.Name())
+	}
+
+	_, err = file.WriteString(value)
+	file.Close()
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	return file.Name(), cleanup, nil
+}
+
+func decryptSops(secret Secret, deploymentWD string) (path string, cleanup func(), err error) {
+	if _, err := exec.LookPath("sops"); err != nil {
+		return "", nil, errors.New("Decrypting secrets with sops requires the sops binary on $PATH")
+	}
+
+	args := []string{"--decrypt"}
+	if secret.SopsExtract != "" {
+		args = append(args, "--extract", secret.SopsExtract)
+	}
+	args = append(args, utils.GetAbsPathRelativeTo(secret.SopsFile, deploymentWD))
+
+	file, err := newPlaintextFile()
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup = func() {
+		os.Remove(file.Name())
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("sops", args...)
+	cmd.Stdout = file
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	file.Close()
+	if err != nil {
+		cleanup()
+		return "", nil, errors.New(fmt.Sprintf("Decrypting %s with sops failed: %s", secret.SopsFile, strings.TrimSpace(stderr.String())))
+	}
+
+	return file.Name(), cleanup, nil
+}
+
+// Output of the commands of secrets, kept in memory only, so each command is run once per run
+var (
+	commandOutputs      = make(map[string][]byte)
+	commandOutputsMutex sync.Mutex
+)
+
+// Run the command of a secret in the deployment directory, its output being the content of the secret
+func runSourceCommand(secret Secret, deploymentWD string) ([]byte, error) {
+	commandOutputsMutex.Lock()
+	defer commandOutputsMutex.Unlock()
+
+	key := strings.Join(secret.FromCommand, "\x00")
+	if output, ok := commandOutputs[key]; ok {
+		return output, nil
+	}
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	cmd := exec.Command(secret.FromCommand[0], secret.FromCommand[1:]...)
+	cmd.Dir = deploymentWD
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, errors.New(fmt.Sprintf("Command for the secret for %s (%s) failed: %s: %s",
+			secret.Destination, secret.FromCommand[0], err.Error(), strings.TrimSpace(stderr.String())))
+	}
+
+	commandOutputs[key] = stdout.Bytes()
+	return stdout.Bytes(), nil
+}
+
+// Create a file for decrypted secret content, preferring memory-backed storage so plaintext never hits the disk
+func newPlaintextFile() (*os.File, error) {
+	if plaintextDir == "" {
+		parent := ""
+		if stat, err := os.Stat("/dev/shm"); err == nil && stat.IsDir() {
+			parent = "/dev/shm"
+		}
+		dir, err := ioutil.TempDir(parent, "morph-secrets")
+		if err != nil {
+			return nil, err
+		}
+		plaintextDir = dir
+		utils.AddFinalizer(func() {
+			os.RemoveAll(dir)
+		})
+	}
+
+	return ioutil.TempFile(plaintextDir, "secret")
+}
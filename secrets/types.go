@@ -5,11 +5,18 @@ import "strings"
 
 type Secret struct {
 	Source      string
+	SopsFile    string
+	SopsExtract string
+	AgeIdentity string
+	VaultPath   string
+	FromEnv     string
+	FromCommand []string
 	Destination string
 	Owner       Owner
 	Permissions string
 	Action      []string
 	MkDirs      bool
+	Ephemeral   bool
 }
 
 type Owner struct {
@@ -23,6 +30,33 @@ func (s *Secret) String() string {
 	fmt.Fprintf(&string_repr, "`%s` -> `%s`, with:\n\tPermissions: %s:%s, %s\n\tCreate remote directories: %t",
 		s.Source, s.Destination, s.Owner.User, s.Owner.Group, s.Permissions, s.MkDirs)
 
+	if s.SopsFile != "" {
+		fmt.Fprintf(&string_repr, "\n\tDecrypted with sops from: `%s`", s.SopsFile)
+		if s.SopsExtract != "" {
+			fmt.Fprintf(&string_repr, " (%s)", s.SopsExtract)
+		}
+	}
+
+	if s.AgeIdentity != "" {
+		fmt.Fprintf(&string_repr, "\n\tDecrypted with age using identity: `%s`", s.AgeIdentity)
+	}
+
+	if s.VaultPath != "" {
+		fmt.Fprintf(&string_repr, "\n\tRead from Vault: `%s`", s.VaultPath)
+	}
+
+	if s.FromEnv != "" {
+		fmt.Fprintf(&string_repr, "\n\tFrom environment variable: `%s`", s.FromEnv)
+	}
+
+	if len(s.FromCommand) > 0 {
+		fmt.Fprintf(&string_repr, "\n\tOutput of command: `%s`", strings.Join(s.FromCommand, " "))
+	}
+
+	if s.Ephemeral {
+		fmt.Fprintf(&string_repr, "\n\tEphemeral: %t", s.Ephemeral)
+	}
+
 	if len(s.Action) > 0 {
 		fmt.Fprintf(&string_repr, "\n\tAction: `%s`", strings.Join(s.Action, " "))
 	}
@@ -0,0 +1,131 @@
+package secrets
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Values read from Vault, kept in memory only, so each path is read once per run
+var (
+	vaultValues      = make(map[string][]byte)
+	vaultValuesMutex sync.Mutex
+)
+
+// Read the value of a secret from Vault, given as "path#field", e.g. "kv/data/foo#password".
+// Without a field the whole secret is uploaded as JSON.
+// The server and token are taken from $VAULT_ADDR and $VAULT_TOKEN (or ~/.vault-token), like the vault CLI does.
+func fetchVault(secret Secret) ([]byte, error) {
+	vaultValuesMutex.Lock()
+	defer vaultValuesMutex.Unlock()
+
+	if value, ok := vaultValues[secret.VaultPath]; ok {
+		return value, nil
+	}
+
+	path, field := secret.VaultPath, ""
+	if index := strings.LastIndex(path, "#"); index >= 0 {
+		path, field = path[:index], path[index+1:]
+	}
+	path = strings.Trim(path, "/")
+
+	data, err := vaultRead(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Reading %s from Vault failed: %s", secret.VaultPath, err.Error()))
+	}
+
+	var value []byte
+	if field == "" {
+		value, err = json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		fieldValue, ok := data[field]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Vault secret %s has no field %s", path, field))
+		}
+		if str, ok := fieldValue.(string); ok {
+			value = []byte(str)
+		} else if value, err = json.Marshal(fieldValue); err != nil {
+			return nil, err
+		}
+	}
+
+	vaultValues[secret.VaultPath] = value
+	return value, nil
+}
+
+// Read the data of a secret through the HTTP API of Vault, unwrapping the versioned data of KV version 2 engines
+func vaultRead(path string) (map[string]interface{}, error) {
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return nil, errors.New("$VAULT_ADDR is not set")
+	}
+	token, err := vaultToken()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimSuffix(addr, "/")+"/v1/"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var response struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(resp.Body).Decode(&response)
+		if len(response.Errors) > 0 {
+			return nil, errors.New(fmt.Sprintf("%s: %s", resp.Status, strings.Join(response.Errors, ", ")))
+		}
+		return nil, errors.New(resp.Status)
+	}
+
+	var response struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+
+	// KV version 2 returns {"data": {"data": {...}, "metadata": {...}}}
+	if inner, ok := response.Data["data"].(map[string]interface{}); ok {
+		if _, ok := response.Data["metadata"]; ok {
+			return inner, nil
+		}
+	}
+
+	return response.Data, nil
+}
+
+func vaultToken() (string, error) {
+	if token := os.Getenv("VAULT_TOKEN"); token != "" {
+		return token, nil
+	}
+
+	token, err := ioutil.ReadFile(os.Getenv("HOME") + "/.vault-token")
+	if err != nil {
+		return "", errors.New("Neither $VAULT_TOKEN nor ~/.vault-token is set")
+	}
+
+	return strings.TrimSpace(string(token)), nil
+}
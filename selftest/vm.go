@@ -0,0 +1,177 @@
+package selftest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/dbcdk/morph/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A throwaway NixOS VM running in QEMU, reachable over SSH on a forwarded local port
+type VM struct {
+	Dir           string
+	Port          int
+	IdentityFile  string
+	AuthorizedKey string
+
+	process *exec.Cmd
+	exited  chan struct{}
+}
+
+// The VM as seen by the ssh package, for waiting until it has booted
+type vmHost struct {
+	port int
+}
+
+func (h *vmHost) GetName() string       { return "self-test-vm" }
+func (h *vmHost) GetTargetHost() string { return "127.0.0.1" }
+func (h *vmHost) GetTargetUser() string { return "root" }
+func (h *vmHost) GetTargetPort() int    { return h.port }
+
+// Prepare a VM in dir: generate the SSH key used to access it, and pick a free port for SSH
+func New(dir string) (vm *VM, err error) {
+	vm = &VM{Dir: dir}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	vm.IdentityFile = filepath.Join(dir, "id_ecdsa")
+	err = ioutil.WriteFile(vm.IdentityFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := gossh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	vm.AuthorizedKey = strings.TrimSpace(string(gossh.MarshalAuthorizedKey(publicKey)))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	vm.Port = listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	return vm, nil
+}
+
+// Build the VM from the expression in vmExpr, which takes the public key allowed to log in as root
+func (vm *VM) Build(vmExpr string, nixArgs ...string) error {
+	args := []string{vmExpr,
+		"--argstr", "authorizedKey", vm.AuthorizedKey,
+		"--out-link", filepath.Join(vm.Dir, "vm")}
+	args = append(args, nixArgs...)
+
+	cmd := exec.Command("nix-build", args...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error while building the self-test VM: %s", err.Error()))
+	}
+
+	return nil
+}
+
+// Boot the VM in the background, with its console written to vm.log in the directory of the VM
+func (vm *VM) Start() error {
+	scripts, err := filepath.Glob(filepath.Join(vm.Dir, "vm", "bin", "run-*-vm"))
+	if err != nil || len(scripts) == 0 {
+		return errors.New("The self-test VM has no run script")
+	}
+
+	logFile, err := os.Create(filepath.Join(vm.Dir, "vm.log"))
+	if err != nil {
+		return err
+	}
+
+	vm.process = exec.Command(scripts[0])
+	vm.process.Dir = vm.Dir
+	vm.process.Env = append(os.Environ(),
+		"NIX_DISK_IMAGE="+filepath.Join(vm.Dir, "disk.qcow2"),
+		"QEMU_NET_OPTS=hostfwd=tcp:127.0.0.1:"+strconv.Itoa(vm.Port)+"-:22",
+		"QEMU_OPTS=-nographic",
+		"TMPDIR="+vm.Dir)
+	vm.process.Stdout = logFile
+	vm.process.Stderr = logFile
+
+	err = vm.process.Start()
+	if err != nil {
+		return err
+	}
+
+	vm.exited = make(chan struct{})
+	go func() {
+		_ = vm.process.Wait()
+		logFile.Close()
+		close(vm.exited)
+	}()
+
+	return nil
+}
+
+// Wait until the VM accepts SSH connections
+func (vm *VM) WaitForSSH(ctx *ssh.SSHContext, timeout time.Duration) error {
+	host := &vmHost{port: vm.Port}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		err := ctx.Run(host, nil, ioutil.Discard, ioutil.Discard, "true")
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-vm.exited:
+			return errors.New(fmt.Sprintf("The self-test VM exited, see %s", filepath.Join(vm.Dir, "vm.log")))
+		default:
+		}
+		if time.Now().After(deadline) {
+			return errors.New(fmt.Sprintf("Gave up waiting for the self-test VM to accept SSH connections: %s", err.Error()))
+		}
+
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func (vm *VM) Stop() {
+	if vm.exited != nil {
+		_ = vm.process.Process.Signal(syscall.SIGTERM)
+		<-vm.exited
+	}
+}
+
+// Write the deployment to run against the VM, returning its path
+func (vm *VM) WriteDeployment(deploymentExpr string) (string, error) {
+	secret := filepath.Join(vm.Dir, "secret")
+	err := ioutil.WriteFile(secret, []byte("morph self-test secret\n"), 0600)
+	if err != nil {
+		return "", err
+	}
+
+	deployment := filepath.Join(vm.Dir, "deployment.nix")
+	expr := fmt.Sprintf("import %s { authorizedKey = %s; port = %d; secret = %s; }\n",
+		deploymentExpr, strconv.Quote(vm.AuthorizedKey), vm.Port, strconv.Quote(secret))
+
+	return deployment, ioutil.WriteFile(deployment, []byte(expr), 0644)
+}
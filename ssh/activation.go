@@ -0,0 +1,134 @@
+package ssh
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Unit changes reported by `switch-to-configuration dry-activate`
+type UnitChanges struct {
+	Stop           []string
+	Restart        []string
+	Start          []string
+	Reload         []string
+	NotStopped     []string
+	RestartSystemd bool
+}
+
+var dryActivateUnitsRegexp = regexp.MustCompile(`^would (stop|NOT stop|restart|start|reload) the following (?:changed )?units: (.*)$`)
+
+func ParseDryActivation(output string) (changes UnitChanges) {
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "would restart systemd" {
+			changes.RestartSystemd = true
+			continue
+		}
+
+		match := dryActivateUnitsRegexp.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+
+		units := strings.Split(match[2], ", ")
+		switch match[1] {
+		case "stop":
+			changes.Stop = append(changes.Stop, units...)
+		case "NOT stop":
+			changes.NotStopped = append(changes.NotStopped, units...)
+		case "restart":
+			changes.Restart = append(changes.Restart, units...)
+		case "start":
+			changes.Start = append(changes.Start, units...)
+		case "reload":
+			changes.Reload = append(changes.Reload, units...)
+		}
+	}
+
+	return
+}
+
+func (changes UnitChanges) IsEmpty() bool {
+	return !changes.RestartSystemd && len(changes.Stop)+len(changes.Restart)+len(changes.Start)+len(changes.Reload)+len(changes.NotStopped) == 0
+}
+
+func (changes UnitChanges) String() string {
+	if changes.IsEmpty() {
+		return "\tno unit changes\n"
+	}
+
+	var s strings.Builder
+	if changes.RestartSystemd {
+		fmt.Fprintln(&s, "\tsystemd: restart")
+	}
+	for _, group := range []struct {
+		verb  string
+		units []string
+	}{
+		{"stop", changes.Stop},
+		{"restart", changes.Restart},
+		{"reload", changes.Reload},
+		{"start", changes.Start},
+		{"not stopped", changes.NotStopped},
+	} {
+		if len(group.units) > 0 {
+			fmt.Fprintf(&s, "\t%s (%d): %s\n", group.verb, len(group.units), strings.Join(group.units, ", "))
+		}
+	}
+
+	return s.String()
+}
+
+// Run `switch-to-configuration dry-activate` for configuration, showing its output as usual,
+// and return the unit changes it reports.
+func (ctx *SSHContext) DryActivate(host Host, configuration string) (changes UnitChanges, err error) {
+	var output bytes.Buffer
+	err = ctx.switchToConfiguration(host, configuration, "dry-activate", io.MultiWriter(os.Stderr, &output))
+	if err != nil {
+		return changes, err
+	}
+
+	return ParseDryActivation(output.String()), nil
+}
+
+// Restrictions on which units an activation is allowed to touch
+type ActivationPolicy struct {
+	NeverRestart []string
+	NeverStop    []string
+	OnViolation  string
+}
+
+func (policy ActivationPolicy) IsEmpty() bool {
+	return len(policy.NeverRestart)+len(policy.NeverStop) == 0
+}
+
+// List the unit changes forbidden by the policy
+func (policy ActivationPolicy) Violations(changes UnitChanges) (violations []string) {
+	for _, unit := range policy.NeverRestart {
+		if contains(changes.Restart, unit) {
+			violations = append(violations, unit+" would be restarted")
+		} else if contains(changes.Stop, unit) {
+			violations = append(violations, unit+" would be stopped")
+		}
+	}
+	for _, unit := range policy.NeverStop {
+		if contains(changes.Stop, unit) && !contains(policy.NeverRestart, unit) {
+			violations = append(violations, unit+" would be stopped")
+		}
+	}
+
+	return
+}
+
+func contains(list []string, item string) bool {
+	for _, element := range list {
+		if element == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package ssh
+
+import (
+	"strings"
+)
+
+// Hosts only to be connected to over IPv4 or IPv6 (deployment.addressFamily), like the AddressFamily option of ssh
+type AddressFamilyHost interface {
+	GetAddressFamily() string
+}
+
+const (
+	AddressFamilyAny   = "any"
+	AddressFamilyInet  = "inet"
+	AddressFamilyInet6 = "inet6"
+)
+
+func AddressFamily(host Host) string {
+	if familyHost, ok := host.(AddressFamilyHost); ok && familyHost.GetAddressFamily() != "" {
+		return familyHost.GetAddressFamily()
+	}
+	return AddressFamilyAny
+}
+
+// The target host without the brackets IPv6 literals may be given in, e.g. 2001:db8::1 for [2001:db8::1]
+func TargetAddress(host Host) string {
+	target := host.GetTargetHost()
+	if strings.HasPrefix(target, "[") && strings.HasSuffix(target, "]") {
+		return target[1 : len(target)-1]
+	}
+	return target
+}
+
+// The target host as the host part of a URL or scp destination, where IPv6 literals have to be bracketed
+func BracketedAddress(host Host) string {
+	address := TargetAddress(host)
+	if strings.Contains(address, ":") {
+		return "[" + address + "]"
+	}
+	return address
+}
+
+// The network for dialing the host with the built-in client
+func network(host Host) string {
+	switch AddressFamily(host) {
+	case AddressFamilyInet:
+		return "tcp4"
+	case AddressFamilyInet6:
+		return "tcp6"
+	}
+	return "tcp"
+}
+
+// Options for the ssh binary connecting to the host over its address family only
+func AddressOptions(host Host) []string {
+	if family := AddressFamily(host); family != AddressFamilyAny {
+		return []string{"-o", "AddressFamily=" + family}
+	}
+	return nil
+}
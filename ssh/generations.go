@@ -0,0 +1,76 @@
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/dbcdk/morph/utils"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A generation of the system profile of a host
+type Generation struct {
+	Number     int       `json:"number"`
+	Date       time.Time `json:"date"`
+	SystemPath string    `json:"systemPath"`
+	Version    string    `json:"nixosVersion,omitempty"`
+	Current    bool      `json:"current"`
+}
+
+// Like `nix-env --list-generations`, a generation's date is the modification time of its link
+const listGenerationsScript = `cd /nix/var/nix/profiles || exit 1
+for link in system-*-link; do
+  [ -e "$link" ] || continue
+  echo "$link $(stat -c %Y "$link") $(readlink "$link") $(cat "$link/nixos-version" 2>/dev/null)"
+done
+echo "current $(readlink system)"`
+
+// The generations of the system profile of the host, oldest first
+func (ctx *SSHContext) ListGenerations(host Host) ([]Generation, error) {
+	var stdout bytes.Buffer
+	err := ctx.Run(host, nil, &stdout, os.Stderr, "sh", "-c", utils.ShellQuote(listGenerationsScript))
+	if err != nil {
+		return nil, err
+	}
+	return parseGenerations(stdout.String())
+}
+
+func parseGenerations(output string) ([]Generation, error) {
+	generations := make([]Generation, 0)
+	current := ""
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "current" {
+			current = fields[1]
+			continue
+		}
+		if len(fields) < 3 {
+			continue
+		}
+
+		number, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(fields[0], "system-"), "-link"))
+		if err != nil {
+			continue
+		}
+		timestamp, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Unexpected output listing the generations: %s\n", line))
+		}
+		generation := Generation{Number: number, Date: time.Unix(timestamp, 0), SystemPath: fields[2]}
+		if len(fields) > 3 {
+			generation.Version = fields[3]
+		}
+		generations = append(generations, generation)
+	}
+
+	for i := range generations {
+		generations[i].Current = fmt.Sprintf("system-%d-link", generations[i].Number) == current
+	}
+
+	sort.Slice(generations, func(i, j int) bool { return generations[i].Number < generations[j].Number })
+	return generations, nil
+}
@@ -0,0 +1,221 @@
+package ssh
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	morphagent "github.com/dbcdk/morph/agent"
+	"github.com/dbcdk/morph/logging"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Hosts running the morph agent, which commands are sent to instead of running each of them in an SSH session
+type AgentHost interface {
+	// The socket of the agent, or "" if the host doesn't run one
+	GetAgentSocket() string
+}
+
+// Connections to the agents of hosts, through the SSH connection of the built-in client
+type agentClients struct {
+	mutex       sync.Mutex
+	clients     map[string]*agentClient
+	unavailable map[string]bool
+}
+
+type agentClient struct {
+	mutex   sync.Mutex
+	conn    net.Conn
+	scanner *bufio.Scanner
+	encoder *json.Encoder
+	// whether the agent runs commands as root for the user morph connected as
+	sudo bool
+}
+
+// A command run by the agent exited with a non-zero code
+type agentExitError struct {
+	code int
+}
+
+func (e *agentExitError) Error() string {
+	return fmt.Sprintf("Process exited with status %d", e.code)
+}
+
+// Get the connection to the agent of the host, connecting if needed. Returns nil if the host doesn't run an agent,
+// or it can't be reached, in which case commands are run over SSH.
+func (sshCtx *SSHContext) hostAgent(host Host) *agentClient {
+	agentHost, ok := host.(AgentHost)
+	if !ok || agentHost.GetAgentSocket() == "" || !sshCtx.UsesNativeBackend(host) || sshCtx.IsLocal(host) {
+		return nil
+	}
+
+	agents := &sshCtx.agents
+	agents.mutex.Lock()
+	if client, ok := agents.clients[host.GetName()]; ok {
+		agents.mutex.Unlock()
+		return client
+	}
+	if agents.unavailable[host.GetName()] {
+		agents.mutex.Unlock()
+		return nil
+	}
+	agents.mutex.Unlock()
+
+	// connecting may take a while, which mustn't hold up the other hosts
+	client, err := sshCtx.dialAgent(host, agentHost.GetAgentSocket())
+
+	agents.mutex.Lock()
+	defer agents.mutex.Unlock()
+	if err != nil {
+		if agents.unavailable == nil {
+			agents.unavailable = make(map[string]bool)
+		}
+		if !agents.unavailable[host.GetName()] {
+			agents.unavailable[host.GetName()] = true
+			logging.WithHost(host.GetName()).Warnf("The morph agent on %s can't be used, running commands over SSH: %s\n", host.GetName(), err.Error())
+		}
+		return nil
+	}
+
+	// another command of the host may have connected in the meantime
+	if existing, ok := agents.clients[host.GetName()]; ok {
+		client.conn.Close()
+		return existing
+	}
+	if agents.clients == nil {
+		agents.clients = make(map[string]*agentClient)
+	}
+	agents.clients[host.GetName()] = client
+	return client
+}
+
+func (sshCtx *SSHContext) dialAgent(host Host, socket string) (*agentClient, error) {
+	sshClient, err := sshCtx.nativeClient(host)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := sshClient.Dial("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	client := &agentClient{conn: conn, scanner: scanner, encoder: json.NewEncoder(conn)}
+
+	// the agent tells right away if it won't serve the target user
+	response, err := client.request(context.TODO(), morphagent.Request{Command: "ping"}, nil, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	client.sudo = response.SudoAllowed
+
+	logging.WithHost(host.GetName()).Verbosef("Connected to the morph agent on %s\n", host.GetName())
+	return client, nil
+}
+
+// Forget a connection which was lost or interrupted; the next command connects again
+func (sshCtx *SSHContext) dropAgent(host Host, client *agentClient) {
+	agents := &sshCtx.agents
+
+	agents.mutex.Lock()
+	defer agents.mutex.Unlock()
+
+	if agents.clients[host.GetName()] == client {
+		delete(agents.clients, host.GetName())
+	}
+	client.conn.Close()
+}
+
+// Run a command through the agent, as root if it starts with "sudo" (which the agent has to allow)
+func (sshCtx *SSHContext) runAgent(ctx context.Context, host Host, client *agentClient, stdout io.Writer, stderr io.Writer, parts []string) error {
+	request := morphagent.Request{Command: "run", Args: parts}
+	if parts[0] == "sudo" {
+		request.Sudo = true
+		request.Args = parts[1:]
+	}
+
+	logging.WithHost(host.GetName()).Debugf("Running (agent): %s\n", strings.Join(parts, " "))
+	_, err := client.request(ctx, request, stdout, stderr)
+	if _, ok := err.(*agentExitError); !ok && err != nil {
+		sshCtx.dropAgent(host, client)
+	}
+	return err
+}
+
+// The state of the host reported by its agent
+func (sshCtx *SSHContext) AgentStatus(host Host) (*morphagent.Status, error) {
+	if err := sshCtx.PreConnect(host); err != nil {
+		return nil, err
+	}
+	client := sshCtx.hostAgent(host)
+	if client == nil {
+		return nil, errors.New(fmt.Sprintf("%s doesn't run a reachable morph agent (which also requires the built-in SSH client)", host.GetName()))
+	}
+
+	response, err := client.request(context.TODO(), morphagent.Request{Command: "status"}, nil, nil)
+	if err != nil {
+		sshCtx.dropAgent(host, client)
+		return nil, err
+	}
+	return response.Status, nil
+}
+
+// Send a request and wait for it to be done, writing the output of the command as it arrives.
+// Only one request is in flight per connection.
+func (client *agentClient) request(ctx context.Context, request morphagent.Request, stdout io.Writer, stderr io.Writer) (*morphagent.Response, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	// closing the connection makes the agent stop the command
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			client.conn.Close()
+		case <-done:
+		}
+	}()
+
+	if err := client.encoder.Encode(request); err != nil {
+		return nil, err
+	}
+
+	for client.scanner.Scan() {
+		var response morphagent.Response
+		if err := json.Unmarshal(client.scanner.Bytes(), &response); err != nil {
+			return nil, err
+		}
+		if stdout != nil && len(response.Stdout) > 0 {
+			stdout.Write(response.Stdout)
+		}
+		if stderr != nil && len(response.Stderr) > 0 {
+			stderr.Write(response.Stderr)
+		}
+		if !response.Done {
+			continue
+		}
+		if response.Error != "" {
+			return nil, errors.New(response.Error)
+		}
+		if response.ExitCode != 0 {
+			return nil, &agentExitError{code: response.ExitCode}
+		}
+		return &response, nil
+	}
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err := client.scanner.Err(); err != nil {
+		return nil, err
+	}
+	// like a dropped SSH connection
+	return nil, io.EOF
+}
@@ -0,0 +1,127 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dbcdk/morph/logging"
+	"github.com/dbcdk/morph/utils"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// Hosts whose identity is declared in the deployment, by deployment.hostKey or deployment.knownHostsFile
+type HostKeyHost interface {
+	GetHostKey() string
+	GetKnownHostsFile() string
+}
+
+// The hostKeys of hosts, written to known_hosts files of their own
+type hostKeyFiles struct {
+	mutex sync.Mutex
+	dir   string
+	files map[string]string
+}
+
+func declaresHostKey(host Host) bool {
+	if keyHost, ok := host.(HostKeyHost); ok {
+		return keyHost.GetHostKey() != "" || keyHost.GetKnownHostsFile() != ""
+	}
+	return false
+}
+
+// Every host has to declare its identity with --strict-host-keys, instead of relying on the known_hosts of the user
+func (sshCtx *SSHContext) CheckHostKeys(hosts ...Host) error {
+	for _, host := range hosts {
+		if sshCtx.StrictHostKeys && !declaresHostKey(host) && !sshCtx.IsLocal(host) {
+			return errors.New(fmt.Sprintf("%s declares neither deployment.hostKey nor deployment.knownHostsFile, which --strict-host-keys requires\n", host.GetName()))
+		}
+		if keyHost, ok := host.(HostKeyHost); ok && keyHost.GetHostKey() != "" {
+			if _, _, _, _, err := gossh.ParseAuthorizedKey([]byte(keyHost.GetHostKey())); err != nil {
+				return errors.New(fmt.Sprintf("The hostKey of %s isn't a public key like \"ssh-ed25519 AAAA...\": %s\n", host.GetName(), err.Error()))
+			}
+		}
+	}
+	return nil
+}
+
+// The known_hosts file the deployment declares for the host, if any
+func (sshCtx *SSHContext) declaredKnownHostsFile(host Host) (string, error) {
+	keyHost, ok := host.(HostKeyHost)
+	if !ok {
+		return "", nil
+	}
+	if keyHost.GetHostKey() == "" {
+		return keyHost.GetKnownHostsFile(), nil
+	}
+
+	state := &sshCtx.hostKeys
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	if path, ok := state.files[host.GetName()]; ok {
+		return path, nil
+	}
+
+	key, _, _, _, err := gossh.ParseAuthorizedKey([]byte(keyHost.GetHostKey()))
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("The hostKey of %s isn't a public key: %s", host.GetName(), err.Error()))
+	}
+
+	if state.dir == "" {
+		dir, err := ioutil.TempDir("", "morph-known-hosts-")
+		if err != nil {
+			return "", err
+		}
+		utils.AddFinalizer(func() {
+			os.RemoveAll(dir)
+		})
+		state.dir = dir
+		state.files = make(map[string]string)
+	}
+
+	port := 22
+	if host.GetTargetPort() != 0 {
+		port = host.GetTargetPort()
+	}
+	address := knownhosts.Normalize(net.JoinHostPort(TargetAddress(host), strconv.Itoa(port)))
+
+	path := filepath.Join(state.dir, host.GetName())
+	if err := ioutil.WriteFile(path, []byte(knownhosts.Line([]string{address}, key)+"\n"), 0600); err != nil {
+		return "", err
+	}
+	state.files[host.GetName()] = path
+
+	return path, nil
+}
+
+// Options for the ssh binary verifying the host with its declared identity only, or not at all with
+// $SSH_SKIP_HOST_KEY_CHECK. Other hosts are verified with the known_hosts of the user, as usual.
+func (sshCtx *SSHContext) HostKeyOptions(host Host) []string {
+	if declaresHostKey(host) {
+		path, err := sshCtx.declaredKnownHostsFile(host)
+		if err != nil {
+			// verifying against nothing fails the connection, rather than falling back to weaker checks
+			logging.WithHost(host.GetName()).Errorf("%s\n", err.Error())
+			path = "/dev/null"
+		}
+		return []string{
+			"-o", "UserKnownHostsFile=" + path,
+			"-o", "GlobalKnownHostsFile=/dev/null",
+			"-o", "StrictHostKeyChecking=yes"}
+	}
+	if sshCtx.SkipHostKeyCheck {
+		return []string{
+			"-o", "StrictHostKeyChecking=No",
+			"-o", "UserKnownHostsFile=/dev/null"}
+	}
+	if sshCtx.StrictHostKeys {
+		return []string{"-o", "StrictHostKeyChecking=yes"}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package ssh
+
+import (
+	"bytes"
+	"github.com/dbcdk/morph/logging"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"io/ioutil"
+	"os"
+)
+
+// Hosts pinning the key to authenticate with (deployment.identityFile), or getting the ssh-agent of the deploying
+// user forwarded (deployment.agentForwarding)
+type IdentityHost interface {
+	GetIdentityFile() string
+	GetAgentForwarding() bool
+}
+
+// The key to authenticate to the host with: its own, or the one given by $SSH_IDENTITY_FILE. Only the host's own key
+// is pinned, excluding the other keys of the user.
+func (sshCtx *SSHContext) identityFile(host Host) (path string, pinned bool) {
+	if identityHost, ok := host.(IdentityHost); ok && identityHost.GetIdentityFile() != "" {
+		return identityHost.GetIdentityFile(), true
+	}
+	return sshCtx.IdentityFile, false
+}
+
+func (sshCtx *SSHContext) HostIdentityFile(host Host) string {
+	path, _ := sshCtx.identityFile(host)
+	return path
+}
+
+func forwardsAgent(host Host) bool {
+	if identityHost, ok := host.(IdentityHost); ok {
+		return identityHost.GetAgentForwarding()
+	}
+	return false
+}
+
+// Options for the ssh binary using only the pinned key of the host, and forwarding the agent; the key itself is
+// passed with -i (or ?ssh-key= for nix copy)
+func (sshCtx *SSHContext) IdentityOptions(host Host) []string {
+	options := make([]string, 0)
+	if _, pinned := sshCtx.identityFile(host); pinned {
+		options = append(options, "-o", "IdentitiesOnly=yes")
+	}
+	if forwardsAgent(host) {
+		options = append(options, "-o", "ForwardAgent=yes")
+	}
+	return options
+}
+
+// Authenticate with the pinned key only. A passphrase protected key is used through the ssh-agent instead,
+// found by its public key in path.pub.
+func (sshCtx *SSHContext) pinnedAuthMethods(path string) []gossh.AuthMethod {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		logging.Warnf("Unable to read the identity file %s: %s\n", path, err.Error())
+		return nil
+	}
+	if signer, err := gossh.ParsePrivateKey(data); err == nil {
+		return []gossh.AuthMethod{gossh.PublicKeys(signer)}
+	}
+
+	publicData, err := ioutil.ReadFile(path + ".pub")
+	if err != nil {
+		return nil
+	}
+	public, _, _, _, err := gossh.ParseAuthorizedKey(publicData)
+	if err != nil || sshCtx.agentSigners() == nil {
+		return nil
+	}
+	signers := sshCtx.agentSigners()
+	return []gossh.AuthMethod{gossh.PublicKeysCallback(func() ([]gossh.Signer, error) {
+		all, err := signers()
+		if err != nil {
+			return nil, err
+		}
+		for _, signer := range all {
+			if bytes.Equal(signer.PublicKey().Marshal(), public.Marshal()) {
+				return []gossh.Signer{signer}, nil
+			}
+		}
+		return nil, nil
+	})}
+}
+
+// Let the host use the ssh-agent of the deploying user, for the sessions requesting it
+func forwardAgent(host Host, client *gossh.Client) error {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if !forwardsAgent(host) || socket == "" {
+		return nil
+	}
+	return agent.ForwardToRemote(client, socket)
+}
+
+func requestAgentForwarding(host Host, session *gossh.Session) error {
+	if !forwardsAgent(host) || os.Getenv("SSH_AUTH_SOCK") == "" {
+		return nil
+	}
+	return agent.RequestAgentForwarding(session)
+}
@@ -0,0 +1,46 @@
+package ssh
+
+import (
+	"sync"
+)
+
+// Limits of concurrent sessions through jump hosts, so shared bastions don't reject
+// connections (e.g. because of MaxStartups in sshd_config)
+type sessionLimits struct {
+	mutex      sync.Mutex
+	semaphores map[string]chan struct{}
+}
+
+// Wait for a free session slot through the jump host of the host, if it has a limit.
+// The returned function gives the slot back.
+func (ctx *SSHContext) acquireSession(host Host) (release func()) {
+	jumpHost := GetJumpHost(host)
+	limit, ok := ctx.JumpHostSessions[jumpHost]
+	if jumpHost == "" || !ok || limit <= 0 {
+		return func() {}
+	}
+
+	ctx.limits.mutex.Lock()
+	if ctx.limits.semaphores == nil {
+		ctx.limits.semaphores = make(map[string]chan struct{})
+	}
+	semaphore, ok := ctx.limits.semaphores[jumpHost]
+	if !ok {
+		semaphore = make(chan struct{}, limit)
+		ctx.limits.semaphores[jumpHost] = semaphore
+	}
+	ctx.limits.mutex.Unlock()
+
+	semaphore <- struct{}{}
+	return func() {
+		<-semaphore
+	}
+}
+
+// Run f while holding a session slot for the host, e.g. for commands connecting to the host by themselves
+func (ctx *SSHContext) WithSession(host Host, f func() error) error {
+	release := ctx.acquireSession(host)
+	defer release()
+
+	return f()
+}
@@ -0,0 +1,22 @@
+package ssh
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+)
+
+// Whether the host is the machine morph runs on, so commands are run directly instead of over SSH: with --local, or
+// for hosts deployed to as "localhost" (without a port, jump host or SSH options pointing elsewhere)
+func (sshCtx *SSHContext) IsLocal(host Host) bool {
+	if sshCtx.Local {
+		return true
+	}
+	return host.GetTargetHost() == "localhost" && host.GetTargetPort() == 0 && GetJumpHost(host) == "" &&
+		len(SshOptions(host)) == 0
+}
+
+// Like the remote shell of an SSH connection, the shell interprets the joined command
+func localCommand(ctx context.Context, parts []string) *exec.Cmd {
+	return exec.CommandContext(ctx, "sh", "-c", strings.Join(parts, " "))
+}
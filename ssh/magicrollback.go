@@ -0,0 +1,99 @@
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/dbcdk/morph/utils"
+	gossh "golang.org/x/crypto/ssh"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// With magic rollback, a timer is armed on the host before activating, which switches back to the previous system
+// unless morph confirms the activation over a new connection in time - so a configuration breaking sshd or the
+// network reverts by itself. The timer runs as a transient systemd unit, outliving the SSH session.
+type RollbackTimer struct {
+	Unit    string
+	Timeout int
+	Armed   time.Time
+	// Created by whichever comes first: morph confirming, or the timer rolling back, which also leaves a marker
+	// in it - so confirming may be retried after losing the connection
+	decided string
+}
+
+// The host expired the timer and is rolling back
+type RolledBackError struct {
+	Host    string
+	Timeout int
+}
+
+func (e *RolledBackError) Error() string {
+	return fmt.Sprintf("The activation on %s wasn't confirmed within %ds, the host is rolling back to the previous system", e.Host, e.Timeout)
+}
+
+// Arm the timer for switching the host to configuration with action (switch or test)
+func (ctx *SSHContext) ArmRollback(host Host, action string, timeout int) (*RollbackTimer, error) {
+	var stdout bytes.Buffer
+	err := ctx.Run(host, nil, &stdout, os.Stderr, "readlink", "-f", "/run/current-system")
+	if err != nil {
+		return nil, err
+	}
+	previous := strings.TrimSpace(stdout.String())
+
+	// switch also reverts the profile - to the system running now, as the activation may not have got to setting
+	// the profile before the connection was lost; test leaves the profile alone
+	revert := fmt.Sprintf("%s/bin/switch-to-configuration test", utils.ShellQuote(previous))
+	if action == "switch" {
+		revert = fmt.Sprintf("nix-env --profile %s --set %[2]s && %[2]s/bin/switch-to-configuration switch", systemProfile, utils.ShellQuote(previous))
+	}
+
+	timer := &RollbackTimer{
+		Unit:    fmt.Sprintf("morph-rollback-%d", time.Now().UnixNano()),
+		Timeout: timeout,
+	}
+	timer.decided = "/run/" + timer.Unit + ".decided"
+	script := fmt.Sprintf("sleep %d; mkdir %[2]s || exit 0; touch %[2]s/rolled-back; echo 'morph: activation not confirmed within %[3]ds, rolling back'; %[4]s",
+		timeout, timer.decided, timeout, revert)
+
+	err = ctx.Run(host, nil, os.Stderr, os.Stderr, "sudo", "systemd-run",
+		"--unit="+timer.Unit, "--description="+utils.ShellQuote("morph magic rollback"),
+		"--setenv=PATH=/run/current-system/sw/bin", "--quiet",
+		"/bin/sh", "-c", utils.ShellQuote(script))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Couldn't arm the rollback timer on %s: %s", host.GetName(), err.Error()))
+	}
+	timer.Armed = time.Now()
+
+	return timer, nil
+}
+
+// Confirm the activation over a new connection - the one activating may have survived a broken sshd - and disarm
+// the timer. Fails with a RolledBackError if the timer expired first.
+func (ctx *SSHContext) ConfirmRollback(host Host, timer *RollbackTimer) error {
+	ctx.Reconnect(host)
+
+	// the directory may already be there from an earlier attempt, which lost the connection afterwards
+	script := fmt.Sprintf("mkdir %[1]s 2>/dev/null; if [ -e %[1]s/rolled-back ]; then exit 3; fi; systemctl stop %[2]s.service; if systemctl is-active --quiet %[2]s.service; then exit 1; fi; if [ -e %[1]s/rolled-back ]; then exit 3; fi",
+		timer.decided, timer.Unit)
+	err := ctx.Run(host, nil, os.Stderr, os.Stderr, "sudo", "/bin/sh", "-c", utils.ShellQuote(script))
+	if exitStatus(err) == 3 {
+		return &RolledBackError{Host: host.GetName(), Timeout: timer.Timeout}
+	}
+	return err
+}
+
+// The exit code of a failed remote command, or -1 if it didn't exit by itself
+func exitStatus(err error) int {
+	switch e := err.(type) {
+	case *exec.ExitError:
+		return e.ExitCode()
+	case *gossh.ExitError:
+		return e.ExitStatus()
+	case *agentExitError:
+		return e.code
+	}
+	return -1
+}
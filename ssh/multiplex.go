@@ -0,0 +1,178 @@
+package ssh
+
+import (
+	"github.com/dbcdk/morph/utils"
+	gossh "golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+)
+
+// A single deployment runs many commands per host. Instead of connecting for each of them,
+// the built-in client keeps one connection per host open, and the ssh binary is told to share
+// a master connection per host (ControlMaster). Connections are closed when morph exits.
+type connectionCache struct {
+	mutex   sync.Mutex
+	clients map[string]*gossh.Client
+
+	controlOnce sync.Once
+	controlDir  string
+	controlled  map[string]Host
+}
+
+// Get the cached connection to the host, connecting if there is none
+func (sshCtx *SSHContext) nativeClient(host Host) (*gossh.Client, error) {
+	cache := &sshCtx.connections
+
+	cache.mutex.Lock()
+	if client, ok := cache.clients[host.GetName()]; ok {
+		cache.mutex.Unlock()
+		return client, nil
+	}
+	cache.mutex.Unlock()
+
+	// connecting may take a while, which mustn't hold up the other hosts
+	client, err := sshCtx.dialNative(host)
+	if err != nil {
+		return nil, err
+	}
+	if err := forwardAgent(host, client); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	// another command of the host may have connected in the meantime
+	if existing, ok := cache.clients[host.GetName()]; ok {
+		client.Close()
+		return existing, nil
+	}
+	if cache.clients == nil {
+		cache.clients = make(map[string]*gossh.Client)
+		utils.AddFinalizer(sshCtx.closeConnections)
+	}
+	cache.clients[host.GetName()] = client
+
+	return client, nil
+}
+
+// Open a session on the cached connection to the host. Connections lost in the meantime
+// (e.g. because the host rebooted) are replaced by a new one.
+func (sshCtx *SSHContext) nativeSession(host Host) (*gossh.Session, error) {
+	client, err := sshCtx.nativeClient(host)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		sshCtx.dropNativeClient(host, client)
+		client, err = sshCtx.nativeClient(host)
+		if err != nil {
+			return nil, err
+		}
+		session, err = client.NewSession()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := requestAgentForwarding(host, session); err != nil {
+		session.Close()
+		return nil, err
+	}
+	return session, nil
+}
+
+func (sshCtx *SSHContext) dropNativeClient(host Host, client *gossh.Client) {
+	cache := &sshCtx.connections
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if cache.clients[host.GetName()] == client {
+		delete(cache.clients, host.GetName())
+	}
+	client.Close()
+}
+
+// Close the connections to the host (and its agent), so the next command connects anew
+func (sshCtx *SSHContext) Reconnect(host Host) {
+	cache := &sshCtx.connections
+
+	cache.mutex.Lock()
+	client, connected := cache.clients[host.GetName()]
+	delete(cache.clients, host.GetName())
+	_, controlled := cache.controlled[host.GetName()]
+	cache.mutex.Unlock()
+
+	sshCtx.agents.mutex.Lock()
+	if agent, ok := sshCtx.agents.clients[host.GetName()]; ok {
+		delete(sshCtx.agents.clients, host.GetName())
+		agent.conn.Close()
+	}
+	sshCtx.agents.mutex.Unlock()
+
+	if connected {
+		client.Close()
+	}
+	if controlled {
+		cmd, args := sshCtx.sshArgs(host, nil)
+		_ = exec.Command(cmd, append([]string{"-O", "exit"}, args...)...).Run()
+	}
+}
+
+// Options making the ssh binary share a master connection per host
+func (sshCtx *SSHContext) controlOptions(host Host) []string {
+	cache := &sshCtx.connections
+
+	cache.controlOnce.Do(func() {
+		dir, err := ioutil.TempDir("", "morph-ssh-")
+		if err != nil {
+			return
+		}
+		cache.controlDir = dir
+		cache.controlled = make(map[string]Host)
+		utils.AddFinalizer(sshCtx.closeConnections)
+	})
+	if cache.controlDir == "" {
+		return []string{}
+	}
+
+	cache.mutex.Lock()
+	cache.controlled[host.GetName()] = host
+	cache.mutex.Unlock()
+
+	return []string{
+		"-o", "ControlMaster=auto",
+		"-o", "ControlPath=" + filepath.Join(cache.controlDir, "%C"),
+		"-o", "ControlPersist=60",
+	}
+}
+
+func (sshCtx *SSHContext) closeConnections() {
+	cache := &sshCtx.connections
+
+	cache.mutex.Lock()
+	clients := cache.clients
+	controlled := cache.controlled
+	cache.clients = make(map[string]*gossh.Client)
+	cache.controlled = make(map[string]Host)
+	cache.mutex.Unlock()
+
+	for _, client := range clients {
+		client.Close()
+	}
+
+	for _, host := range controlled {
+		cmd, args := sshCtx.sshArgs(host, nil)
+		_ = exec.Command(cmd, append([]string{"-O", "exit"}, args...)...).Run()
+	}
+	if cache.controlDir != "" {
+		os.RemoveAll(cache.controlDir)
+	}
+}
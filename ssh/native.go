@@ -0,0 +1,329 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dbcdk/morph/utils"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The built-in SSH client, used unless the ssh and scp binaries are requested
+
+type agentConnection struct {
+	once    sync.Once
+	signers func() ([]gossh.Signer, error)
+}
+
+var defaultIdentityFiles = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+var defaultKnownHostsFiles = []string{"~/.ssh/known_hosts", "/etc/ssh/ssh_known_hosts"}
+
+func (sshCtx *SSHContext) nativeUsername(host Host) (string, error) {
+	if host.GetTargetUser() != "" {
+		return host.GetTargetUser(), nil
+	} else if sshCtx.DefaultUsername != "" {
+		return sshCtx.DefaultUsername, nil
+	}
+
+	currentUser, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return currentUser.Username, nil
+}
+
+// The keys held by a running ssh-agent, nil if there is none
+func (sshCtx *SSHContext) agentSigners() func() ([]gossh.Signer, error) {
+	sshCtx.agent.once.Do(func() {
+		socket := os.Getenv("SSH_AUTH_SOCK")
+		if socket == "" {
+			return
+		}
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return
+		}
+		sshCtx.agent.signers = agent.NewClient(conn).Signers
+	})
+	return sshCtx.agent.signers
+}
+
+// Authentication methods for the host, or for a jump host if host is nil
+func (sshCtx *SSHContext) authMethods(host Host) (methods []gossh.AuthMethod) {
+	identityFile, pinned := sshCtx.identityFile(host)
+	if pinned {
+		return sshCtx.pinnedAuthMethods(identityFile)
+	}
+
+	// keys held by a running ssh-agent
+	if signers := sshCtx.agentSigners(); signers != nil {
+		methods = append(methods, gossh.PublicKeysCallback(signers))
+	}
+
+	// unencrypted private keys on disk
+	identityFiles := []string{identityFile}
+	if identityFile == "" {
+		identityFiles = []string{}
+		if home, err := os.UserHomeDir(); err == nil {
+			for _, name := range defaultIdentityFiles {
+				identityFiles = append(identityFiles, filepath.Join(home, ".ssh", name))
+			}
+		}
+	}
+
+	signers := make([]gossh.Signer, 0)
+	for _, identityFile := range identityFiles {
+		data, err := ioutil.ReadFile(identityFile)
+		if err != nil {
+			continue
+		}
+		signer, err := gossh.ParsePrivateKey(data)
+		if err != nil {
+			// most likely a passphrase protected key, which has to be loaded into ssh-agent instead
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		methods = append(methods, gossh.PublicKeys(signers...))
+	}
+
+	return
+}
+
+// Verify the host with its declared identity, or else with the known_hosts files of the user
+func (sshCtx *SSHContext) hostKeyCallback(host Host) (gossh.HostKeyCallback, error) {
+	if !declaresHostKey(host) {
+		if sshCtx.StrictHostKeys {
+			return nil, errors.New(fmt.Sprintf("%s declares neither deployment.hostKey nor deployment.knownHostsFile, which --strict-host-keys requires", host.GetName()))
+		}
+		return sshCtx.knownHostsCallback(host)
+	}
+
+	path, err := sshCtx.declaredKnownHostsFile(host)
+	if err != nil {
+		return nil, err
+	}
+	callback, err := knownhosts.New(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		if _, ok := err.(*knownhosts.KeyError); ok {
+			return errors.New(fmt.Sprintf("Host key of %s (%s) does not match the key declared in the deployment (%s), it has been given %s %s. The host may have been reinstalled - or someone is intercepting the connection!",
+				host.GetName(), hostname, declaredKeySource(host), key.Type(), gossh.FingerprintSHA256(key)))
+		}
+		return err
+	}, nil
+}
+
+func declaredKeySource(host Host) string {
+	if keyHost, ok := host.(HostKeyHost); ok && keyHost.GetHostKey() == "" {
+		return keyHost.GetKnownHostsFile()
+	}
+	return "deployment.hostKey"
+}
+
+// Verify the host with the known_hosts files of the user (and the system), like the ssh binary
+func (sshCtx *SSHContext) knownHostsCallback(host Host) (gossh.HostKeyCallback, error) {
+	if sshCtx.SkipHostKeyCheck {
+		return gossh.InsecureIgnoreHostKey(), nil
+	}
+
+	files := make([]string, 0)
+	for _, file := range defaultKnownHostsFiles {
+		if strings.HasPrefix(file, "~/") {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				continue
+			}
+			file = filepath.Join(home, file[2:])
+		}
+		if _, err := os.Stat(file); err == nil {
+			files = append(files, file)
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New("No known_hosts file found; unable to verify the host key of " + host.GetTargetHost())
+	}
+
+	callback, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		if keyErr, ok := err.(*knownhosts.KeyError); ok {
+			if len(keyErr.Want) == 0 {
+				return errors.New(fmt.Sprintf("Host key of %s is unknown. Add it to your known_hosts file (e.g. by connecting with ssh once) or use --system-ssh.", hostname))
+			}
+			return errors.New(fmt.Sprintf("Host key of %s does not match the key in %s:%d. The host may have been reinstalled - or someone is intercepting the connection!", hostname, keyErr.Want[0].Filename, keyErr.Want[0].Line))
+		}
+		return err
+	}, nil
+}
+
+func (sshCtx *SSHContext) dialNative(host Host) (*gossh.Client, error) {
+	username, err := sshCtx.nativeUsername(host)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeyCallback, err := sshCtx.hostKeyCallback(host)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &gossh.ClientConfig{
+		User:            username,
+		Auth:            append(sshCtx.authMethods(host), sshCtx.passwordAuthMethods(host)...),
+		HostKeyCallback: hostKeyCallback,
+	}
+
+	port := 22
+	if host.GetTargetPort() != 0 {
+		port = host.GetTargetPort()
+	}
+	address := net.JoinHostPort(TargetAddress(host), strconv.Itoa(port))
+
+	jumpHost := GetJumpHost(host)
+	if jumpHost == "" {
+		client, err := sshCtx.dialTimeout(host, network(host), address, config)
+		if err != nil {
+			return nil, &connectError{fmt.Sprintf("Couldn't connect to %s (%s): %s", host.GetName(), host.GetTargetHost(), err.Error())}
+		}
+		return client, nil
+	}
+
+	bastion, err := sshCtx.dialJumpHost(host, jumpHost)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := bastion.Dial(network(host), address)
+	if err != nil {
+		bastion.Close()
+		return nil, &connectError{fmt.Sprintf("Couldn't connect to %s (%s) via %s: %s", host.GetName(), host.GetTargetHost(), jumpHost, err.Error())}
+	}
+	client, err := sshCtx.clientConn(host, conn, address, config)
+	if err != nil {
+		bastion.Close()
+		return nil, &connectError{fmt.Sprintf("Couldn't connect to %s (%s) via %s: %s", host.GetName(), host.GetTargetHost(), jumpHost, err.Error())}
+	}
+
+	// the connection to the bastion lives as long as the connection tunneled through it
+	go func() {
+		client.Wait()
+		bastion.Close()
+	}()
+
+	return client, nil
+}
+
+// Connect to a jump host given as [user@]host[:port], like the -J option of ssh
+func (sshCtx *SSHContext) dialJumpHost(host Host, jumpHost string) (*gossh.Client, error) {
+	address := jumpHost
+	username := ""
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		username, address = address[:i], address[i+1:]
+	}
+	if username == "" {
+		username = sshCtx.DefaultUsername
+	}
+	if username == "" {
+		currentUser, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		username = currentUser.Username
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(strings.Trim(address, "[]"), "22")
+	}
+
+	// the host keys declared for a host are its own, not those of its jump host
+	hostKeyCallback, err := sshCtx.knownHostsCallback(host)
+	if err != nil {
+		return nil, err
+	}
+
+	// the address family of the host only applies to the host itself, which the bastion may reach differently
+	bastion, err := sshCtx.dialTimeout(host, "tcp", address, &gossh.ClientConfig{
+		User:            username,
+		Auth:            sshCtx.authMethods(nil),
+		HostKeyCallback: hostKeyCallback,
+	})
+	if err != nil {
+		return nil, &connectError{fmt.Sprintf("Couldn't connect to jump host %s of %s: %s", jumpHost, host.GetName(), err.Error())}
+	}
+
+	return bastion, nil
+}
+
+func (sshCtx *SSHContext) runNative(ctx context.Context, host Host, stdin io.Reader, stdout io.Writer, stderr io.Writer, parts []string) error {
+	session, err := sshCtx.nativeSession(host)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	// like the ssh binary, join the command for the remote shell to interpret
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Run(strings.Join(parts, " "))
+	}()
+
+	select {
+	case err = <-done:
+		return err
+	case <-ctx.Done():
+		_ = session.Signal(gossh.SIGTERM)
+		session.Close()
+		return ctx.Err()
+	}
+}
+
+func (sshCtx *SSHContext) uploadFileNative(host Host, source string, destination string) ([]byte, error) {
+	file, err := os.Open(source)
+	if err != nil {
+		return []byte(err.Error()), err
+	}
+	defer file.Close()
+
+	return sshCtx.combinedOutputWithInput(host, file, "cat", ">", utils.ShellQuote(destination))
+}
+
+// Failure to connect to a host with the built-in client
+type connectError struct {
+	message string
+}
+
+func (e *connectError) Error() string {
+	return e.message
+}
+
+func isNativeDisconnect(err error) bool {
+	if _, ok := err.(*gossh.ExitMissingError); ok {
+		return true
+	}
+
+	return err == io.EOF
+}
@@ -0,0 +1,86 @@
+package ssh
+
+import (
+	"github.com/dbcdk/morph/utils"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Hosts with extra options for the ssh binary (deployment.sshOptions), e.g. a ProxyCommand. They are only
+// understood by the ssh binary, which is thus used for these hosts instead of the built-in client.
+type SshOptionsHost interface {
+	GetSshOptions() []string
+}
+
+func SshOptions(host Host) []string {
+	if optionsHost, ok := host.(SshOptionsHost); ok {
+		return optionsHost.GetSshOptions()
+	}
+	return nil
+}
+
+type sshWrapper struct {
+	mutex sync.Mutex
+	dir   string
+}
+
+// Environment variables making the ssh binary run by nix copy use the options of the host. NIX_SSHOPTS is
+// split on whitespace, so the options are passed by a wrapper script found on $PATH first instead.
+func (sshCtx *SSHContext) SshOptionsEnv(host Host) ([]string, error) {
+	options := SshOptions(host)
+	if len(options) == 0 {
+		return nil, nil
+	}
+
+	binary, err := exec.LookPath("ssh")
+	if err != nil {
+		return nil, err
+	}
+	dir, err := sshCtx.sshWrapperDir()
+	if err != nil {
+		return nil, err
+	}
+
+	quoted := make([]string, 0, len(options))
+	for _, option := range options {
+		quoted = append(quoted, utils.ShellQuote(option))
+	}
+	return []string{
+		"PATH=" + dir + string(filepath.ListSeparator) + os.Getenv("PATH"),
+		"MORPH_SSH=" + binary,
+		"MORPH_SSH_OPTIONS=" + strings.Join(quoted, " "),
+	}, nil
+}
+
+// Write the wrapper script, which runs ssh with the options passed (shell quoted) in its environment
+func (sshCtx *SSHContext) sshWrapperDir() (string, error) {
+	state := &sshCtx.wrapper
+
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	if state.dir != "" {
+		return state.dir, nil
+	}
+
+	dir, err := ioutil.TempDir("", "morph-ssh-")
+	if err != nil {
+		return "", err
+	}
+	utils.AddFinalizer(func() {
+		os.RemoveAll(dir)
+	})
+
+	script := "#!/bin/sh\neval \"exec \\\"\\$MORPH_SSH\\\" $MORPH_SSH_OPTIONS \\\"\\$@\\\"\"\n"
+	err = ioutil.WriteFile(filepath.Join(dir, "ssh"), []byte(script), 0700)
+	if err != nil {
+		return "", err
+	}
+	state.dir = dir
+
+	return dir, nil
+}
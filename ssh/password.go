@@ -0,0 +1,172 @@
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/dbcdk/morph/utils"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Hosts accepting password authentication, e.g. freshly imaged appliances which don't have any keys installed yet
+type PasswordAuthHost interface {
+	GetSshPasswordAuth() bool
+}
+
+func UsesPasswordAuth(host Host) bool {
+	if passwordHost, ok := host.(PasswordAuthHost); ok {
+		return passwordHost.GetSshPasswordAuth()
+	}
+	return false
+}
+
+// The SSH password is asked for once, and used for all hosts with password authentication
+type passwordState struct {
+	mutex    sync.Mutex
+	password string
+	askpass  string
+}
+
+// Get the SSH password, asking for it the first time - using the $SSH_ASKPASS program if set, or else on the terminal
+func (sshCtx *SSHContext) sshPassword(host Host) (string, error) {
+	state := &sshCtx.password
+
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	if state.password != "" {
+		return state.password, nil
+	}
+
+	prompt := "Please enter SSH password: "
+	if askpass := os.Getenv("SSH_ASKPASS"); askpass != "" {
+		var stdout bytes.Buffer
+		cmd := exec.Command(askpass, prompt)
+		cmd.Stdout = &stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return "", errors.New(fmt.Sprintf("Asking for the SSH password of %s with %s failed: %s", host.GetName(), askpass, err.Error()))
+		}
+		state.password = strings.TrimRight(stdout.String(), "\r\n")
+	} else {
+		if err := utils.CheckInteractive(fmt.Sprintf("the SSH password of %s", host.GetName())); err != nil {
+			return "", err
+		}
+		stdin := int(syscall.Stdin)
+		if !terminal.IsTerminal(stdin) {
+			return "", errors.New(fmt.Sprintf("%s uses SSH password authentication, which requires a terminal or $SSH_ASKPASS", host.GetName()))
+		}
+		fmt.Fprint(os.Stderr, prompt)
+		password, err := terminal.ReadPassword(stdin)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		state.password = string(password)
+	}
+
+	return state.password, nil
+}
+
+// Password based authentication methods for the built-in client, tried after the keys
+func (sshCtx *SSHContext) passwordAuthMethods(host Host) []gossh.AuthMethod {
+	if !UsesPasswordAuth(host) {
+		return nil
+	}
+
+	password := func() (string, error) {
+		return sshCtx.sshPassword(host)
+	}
+	keyboardInteractive := func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i := range questions {
+			answer, err := password()
+			if err != nil {
+				return nil, err
+			}
+			answers[i] = answer
+		}
+		return answers, nil
+	}
+
+	return []gossh.AuthMethod{
+		gossh.PasswordCallback(password),
+		gossh.KeyboardInteractive(keyboardInteractive),
+	}
+}
+
+// Environment variables making the ssh binary (also when run by nix copy) read the password of the host
+// from an askpass helper, so it's only asked for once
+func (sshCtx *SSHContext) PasswordAuthEnv(host Host) ([]string, error) {
+	if !UsesPasswordAuth(host) {
+		return nil, nil
+	}
+
+	password, err := sshCtx.sshPassword(host)
+	if err != nil {
+		return nil, err
+	}
+	askpass, err := sshCtx.askpassHelper()
+	if err != nil {
+		return nil, err
+	}
+
+	display := os.Getenv("DISPLAY")
+	if display == "" {
+		// older versions of ssh only use SSH_ASKPASS if DISPLAY is set
+		display = "morph"
+	}
+
+	return []string{
+		"SSH_ASKPASS=" + askpass,
+		"SSH_ASKPASS_REQUIRE=force",
+		"DISPLAY=" + display,
+		"MORPH_SSH_PASSWORD=" + password,
+	}, nil
+}
+
+// Environment for running the ssh or scp binary for the host, nil meaning the environment of morph
+func (sshCtx *SSHContext) commandEnv(host Host) ([]string, error) {
+	env, err := sshCtx.PasswordAuthEnv(host)
+	if err != nil || env == nil {
+		return nil, err
+	}
+	return append(os.Environ(), env...), nil
+}
+
+// Write the askpass helper, which prints the password passed in its environment
+func (sshCtx *SSHContext) askpassHelper() (string, error) {
+	state := &sshCtx.password
+
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	if state.askpass != "" {
+		return state.askpass, nil
+	}
+
+	dir, err := ioutil.TempDir("", "morph-askpass-")
+	if err != nil {
+		return "", err
+	}
+	utils.AddFinalizer(func() {
+		os.RemoveAll(dir)
+	})
+
+	path := filepath.Join(dir, "askpass")
+	err = ioutil.WriteFile(path, []byte("#!/bin/sh\nprintf '%s\\n' \"$MORPH_SSH_PASSWORD\"\n"), 0700)
+	if err != nil {
+		return "", err
+	}
+	state.askpass = path
+
+	return path, nil
+}
@@ -0,0 +1,58 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dbcdk/morph/logging"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Hosts only reachable after preparing the network path to them (port knocking, adding a VPN route, opening a firewall, ..)
+type PreConnectHost interface {
+	GetPreConnectCommand() []string
+}
+
+type preConnectState struct {
+	mutex sync.Mutex
+	done  map[string]error
+}
+
+// Run the pre-connect command of the host on the local machine, unless that has been done already.
+// The command is run at most once per host, and its result is remembered for later connections.
+func (ctx *SSHContext) PreConnect(host Host) error {
+	preConnectHost, ok := host.(PreConnectHost)
+	if !ok || len(preConnectHost.GetPreConnectCommand()) == 0 || ctx.IsLocal(host) {
+		return nil
+	}
+
+	ctx.preConnect.mutex.Lock()
+	defer ctx.preConnect.mutex.Unlock()
+
+	if ctx.preConnect.done == nil {
+		ctx.preConnect.done = make(map[string]error)
+	}
+	if err, done := ctx.preConnect.done[host.GetName()]; done {
+		return err
+	}
+
+	parts := preConnectHost.GetPreConnectCommand()
+	logging.WithHost(host.GetName()).Infof("Running pre-connect command: %s\n", strings.Join(parts, " "))
+
+	cmd := exec.Command(parts[0], parts[1:]...)
+	cmd.Env = append(os.Environ(),
+		"MORPH_HOST="+host.GetName(),
+		"MORPH_TARGET_HOST="+host.GetTargetHost())
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if err != nil {
+		err = errors.New(fmt.Sprintf("Pre-connect command for %s failed: %s\n", host.GetName(), err.Error()))
+	}
+	ctx.preConnect.done[host.GetName()] = err
+
+	return err
+}
@@ -5,12 +5,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/dbcdk/morph/logging"
 	"github.com/dbcdk/morph/utils"
 	"golang.org/x/crypto/ssh/terminal"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -18,15 +20,19 @@ import (
 
 type Context interface {
 	ActivateConfiguration(host Host, configuration string, action string) error
+	ArmRollback(host Host, action string, timeout int) (*RollbackTimer, error)
+	ConfirmRollback(host Host, timer *RollbackTimer) error
+	DryActivate(host Host, configuration string) (UnitChanges, error)
 	MakeTempFile(host Host) (path string, err error)
 	UploadFile(host Host, source string, destination string) error
 	SetOwner(host Host, path string, user string, group string) error
 	SetPermissions(host Host, path string, permissions string) error
 	MoveFile(host Host, source string, destination string) error
 	MakeDirs(host Host, path string, parents bool, mode os.FileMode) error
+	InstallFile(host Host, source string, destination string, user string, group string, permissions string) (installed bool, err error)
 
-	Cmd(host Host, parts ...string) (*exec.Cmd, error)
-	SudoCmd(host Host, parts ...string) (*exec.Cmd, error)
+	Run(host Host, stdin io.Reader, stdout io.Writer, stderr io.Writer, parts ...string) error
+	RunContext(ctx context.Context, host Host, stdin io.Reader, stdout io.Writer, stderr io.Writer, parts ...string) error
 	CmdInteractive(host Host, timeout int, parts ...string)
 }
 
@@ -34,6 +40,19 @@ type Host interface {
 	GetName() string
 	GetTargetHost() string
 	GetTargetUser() string
+	GetTargetPort() int
+}
+
+// Hosts only reachable through a bastion, given as [user@]host[:port]
+type JumpHost interface {
+	GetJumpHost() string
+}
+
+func GetJumpHost(host Host) string {
+	if jumpHost, ok := host.(JumpHost); ok {
+		return jumpHost.GetJumpHost()
+	}
+	return ""
 }
 
 type SSHContext struct {
@@ -43,6 +62,33 @@ type SSHContext struct {
 	IdentityFile       string
 	ConfigFile         string
 	SkipHostKeyCheck   bool
+	UseSystemSSH       bool
+	// Only connect to hosts declaring their host key in the deployment
+	StrictHostKeys bool
+	// Run the commands for all hosts on this machine, instead of over SSH
+	Local bool
+	// Seconds to wait for connecting to a host, and for a command on a host to finish; 0 waits forever
+	ConnectTimeout int
+	CommandTimeout int
+	// Maximum number of concurrent sessions through a jump host, keyed like the jumpHost of hosts
+	JumpHostSessions map[string]int
+	// Ask for the sudo password again when sudo rejects it
+	RepromptSudoPassword bool
+	// Read the sudo password from this file or environment variable instead of asking for it, e.g. in CI
+	SudoPasswordFile string
+	SudoPasswordEnv  string
+	// JSON file with the sudo passwords of individual hosts, by host name
+	SudoCredentialsFile string
+
+	agent       agentConnection
+	preConnect  preConnectState
+	connections connectionCache
+	limits      sessionLimits
+	password    passwordState
+	credentials sudoCredentials
+	agents      agentClients
+	hostKeys    hostKeyFiles
+	wrapper     sshWrapper
 }
 
 type FileTransfer struct {
@@ -61,14 +107,25 @@ func (sshCtx *SSHContext) CmdContext(ctx context.Context, host Host, parts ...st
 		return nil, err
 	}
 
+	if err = sshCtx.PreConnect(host); err != nil {
+		return nil, err
+	}
+
 	if parts[0] == "sudo" {
 		return sshCtx.SudoCmdContext(ctx, host, parts...)
 	}
 
+	if sshCtx.IsLocal(host) {
+		return localCommand(ctx, parts), nil
+	}
+
 	cmd, cmdArgs := sshCtx.sshArgs(host, nil)
 	cmdArgs = append(cmdArgs, parts...)
 
 	command := exec.CommandContext(ctx, cmd, cmdArgs...)
+	if command.Env, err = sshCtx.commandEnv(host); err != nil {
+		return nil, err
+	}
 	return command, nil
 }
 
@@ -80,22 +137,40 @@ func (ctx *SSHContext) sshArgs(host Host, transfer *FileTransfer) (cmd string, a
 	}
 	utils.ValidateEnvironment(cmd)
 
-	if ctx.SkipHostKeyCheck {
-		args = append(args,
-			"-o", "StrictHostKeyChecking=No",
-			"-o", "UserKnownHostsFile=/dev/null")
-	}
-	if ctx.IdentityFile != "" {
+	// ssh uses the first value given for an option, so the options of the host take precedence over those below
+	args = append(args, SshOptions(host)...)
+	args = append(args, ctx.HostKeyOptions(host)...)
+	if identityFile := ctx.HostIdentityFile(host); identityFile != "" {
 		args = append(args, "-i")
-		args = append(args, ctx.IdentityFile)
+		args = append(args, identityFile)
 	}
+	args = append(args, ctx.IdentityOptions(host)...)
+	args = append(args, ctx.TimeoutOptions(host)...)
+	args = append(args, AddressOptions(host)...)
 	if ctx.ConfigFile != "" {
 		args = append(args, "-F", ctx.ConfigFile)
 	}
-	var hostAndDestination = host.GetTargetHost()
+	args = append(args, ctx.controlOptions(host)...)
+	if jumpHost := GetJumpHost(host); jumpHost != "" {
+		args = append(args, "-o", "ProxyJump="+jumpHost)
+	}
+	if UsesPasswordAuth(host) {
+		// the password is supplied by an askpass helper, don't loop when it's wrong
+		args = append(args, "-o", "NumberOfPasswordPrompts=1")
+	}
+	args = append(args, ctx.NonInteractiveOptions(host)...)
+	if host.GetTargetPort() != 0 {
+		// scp uses -p for preserving file modes
+		if transfer != nil {
+			args = append(args, "-P", strconv.Itoa(host.GetTargetPort()))
+		} else {
+			args = append(args, "-p", strconv.Itoa(host.GetTargetPort()))
+		}
+	}
+	var hostAndDestination = TargetAddress(host)
 	if transfer != nil {
 		args = append(args, transfer.Source)
-		hostAndDestination += ":" + transfer.Destination
+		hostAndDestination = BracketedAddress(host) + ":" + transfer.Destination
 	}
 	if host.GetTargetUser() != "" {
 		hostAndDestination = host.GetTargetUser() + "@" + hostAndDestination
@@ -107,6 +182,22 @@ func (ctx *SSHContext) sshArgs(host Host, transfer *FileTransfer) (cmd string, a
 	return
 }
 
+// Options keeping the ssh binary from prompting with --non-interactive, e.g. to confirm an unknown host key.
+// Password authentication uses an askpass helper, which batch mode would disable.
+func (ctx *SSHContext) NonInteractiveOptions(host Host) []string {
+	if !utils.NonInteractive {
+		return nil
+	}
+	options := make([]string, 0)
+	if !ctx.SkipHostKeyCheck || declaresHostKey(host) {
+		options = append(options, "-o", "StrictHostKeyChecking=yes")
+	}
+	if !UsesPasswordAuth(host) {
+		options = append(options, "-o", "BatchMode=yes")
+	}
+	return options
+}
+
 func (sshCtx *SSHContext) SudoCmd(host Host, parts ...string) (*exec.Cmd, error) {
 	return sshCtx.SudoCmdContext(context.TODO(), host, parts...)
 }
@@ -117,40 +208,202 @@ func (sshCtx *SSHContext) SudoCmdContext(ctx context.Context, host Host, parts .
 		return nil, err
 	}
 
-	// ask for password if not done already
-	if sshCtx.AskForSudoPassword && sshCtx.sudoPassword == "" {
-		sshCtx.sudoPassword, err = askForSudoPassword()
+	if err = sshCtx.PreConnect(host); err != nil {
+		return nil, err
+	}
+
+	sudoParts, password, err := sshCtx.sudoCommand(host, parts)
+	if err != nil {
+		return nil, err
+	}
+
+	var command *exec.Cmd
+	if sshCtx.IsLocal(host) {
+		command = localCommand(ctx, sudoParts)
+	} else {
+		cmd, cmdArgs := sshCtx.sshArgs(host, nil)
+		cmdArgs = append(cmdArgs, sudoParts...)
+
+		command = exec.CommandContext(ctx, cmd, cmdArgs...)
+		if command.Env, err = sshCtx.commandEnv(host); err != nil {
+			return nil, err
+		}
+	}
+	if password != "" {
+		err := writeSudoPassword(command, password)
 		if err != nil {
 			return nil, err
 		}
 	}
+	return command, nil
+}
 
-	cmd, cmdArgs := sshCtx.sshArgs(host, nil)
+// Ask for the sudo password now if it will be needed, instead of when running the first sudo command
+func (sshCtx *SSHContext) EnsureSudoPassword() error {
+	_, err := sshCtx.sharedSudoPassword()
+	return err
+}
 
+// Wrap a command in sudo (or the privilege escalation of the host), returning the sudo password to write to its
+// stdin, if any. The password is asked for first if needed.
+func (sshCtx *SSHContext) sudoCommand(host Host, parts []string) (sudoParts []string, password string, err error) {
 	// normalize sudo
 	if parts[0] == "sudo" {
 		parts = parts[1:]
 	}
-	cmdArgs = append(cmdArgs, "sudo")
 
-	if sshCtx.sudoPassword != "" {
-		cmdArgs = append(cmdArgs, "-S")
+	switch escalation := PrivilegeEscalation(host); escalation {
+	case "sudo":
+	case "doas":
+		// doas can't read a password from stdin, so it has to be permitted without one
+		return append([]string{"doas", "-n", "--"}, parts...), "", nil
+	case "none":
+		return parts, "", nil
+	default:
+		return nil, "", errors.New(fmt.Sprintf("Unknown privilege escalation for %s: %s", host.GetName(), escalation))
+	}
+
+	password, err = sshCtx.hostSudoPassword(host)
+	if err != nil {
+		return nil, "", err
+	}
+
+	sudoParts = append(sudoParts, "sudo")
+
+	if password != "" {
+		sudoParts = append(sudoParts, "-S")
 	} else {
 		// no password supplied; request non-interactive sudo, which will fail with an error if a password was required
-		cmdArgs = append(cmdArgs, "-n")
+		sudoParts = append(sudoParts, "-n")
 	}
 
-	cmdArgs = append(cmdArgs, "-p", "''", "-k", "--")
+	sudoParts = append(sudoParts, "-p", "''", "-k", "--")
+	sudoParts = append(sudoParts, parts...)
+
+	return sudoParts, password, nil
+}
+
+// Like RunContext, stopping the command after the command timeout of the host
+func (sshCtx *SSHContext) Run(host Host, stdin io.Reader, stdout io.Writer, stderr io.Writer, parts ...string) error {
+	ctx, cancel := sshCtx.CommandContext(host)
+	defer cancel()
+	return sshCtx.TimeoutErr(ctx, host, parts, sshCtx.RunContext(ctx, host, stdin, stdout, stderr, parts...))
+}
+
+// Run a command on the host using the configured SSH backend, connecting the given (optional) stdin, stdout and stderr.
+// Like Cmd, commands starting with "sudo" are executed using sudo - supplying the sudo password if necessary -
+// or the privilege escalation configured for the host.
+func (sshCtx *SSHContext) RunContext(ctx context.Context, host Host, stdin io.Reader, stdout io.Writer, stderr io.Writer, parts ...string) error {
+	var err error
+	if parts, err = valCommand(parts); err != nil {
+		return err
+	}
+
+	if err = sshCtx.PreConnect(host); err != nil {
+		return err
+	}
+
+	// the agent runs as root, so it doesn't need sudo if it allows the user to use it as root; otherwise, and for
+	// commands with input, the usual sudo handling over SSH applies
+	if stdin == nil {
+		if client := sshCtx.hostAgent(host); client != nil && (parts[0] != "sudo" || client.sudo) {
+			return sshCtx.runAgent(ctx, host, client, stdout, stderr, parts)
+		}
+	}
+
+	if parts[0] != "sudo" {
+		return sshCtx.runCommand(ctx, host, stdin, stdout, stderr, parts)
+	}
+
+	// sudo's own errors are detected on stderr, and a rejected password may be asked for again,
+	// unless stdin was already (partially) consumed
+	for attempt := 1; ; attempt++ {
+		sudoParts, password, err := sshCtx.sudoCommand(host, parts)
+		if err != nil {
+			return err
+		}
+		sudoStdin := stdin
+		if password != "" {
+			passwordReader := strings.NewReader(password + "\n")
+			if stdin != nil {
+				sudoStdin = io.MultiReader(passwordReader, stdin)
+			} else {
+				sudoStdin = passwordReader
+			}
+		}
+
+		capture := &sudoStderr{out: stderr}
+		err = capture.classify(host, sshCtx.runCommand(ctx, host, sudoStdin, stdout, capture, sudoParts))
+		if sudoErr, ok := err.(*SudoError); ok && sudoErr.NeedsPassword && stdin == nil && sshCtx.repromptSudoPassword(host, password, attempt) {
+			continue
+		}
+		return err
+	}
+}
+
+func (sshCtx *SSHContext) runCommand(ctx context.Context, host Host, stdin io.Reader, stdout io.Writer, stderr io.Writer, parts []string) error {
+	release := sshCtx.acquireSession(host)
+	defer release()
+
+	if sshCtx.IsLocal(host) {
+		logging.WithHost(host.GetName()).Debugf("Running locally: %s\n", strings.Join(parts, " "))
+		command := localCommand(ctx, parts)
+		command.Stdin = stdin
+		command.Stdout = stdout
+		command.Stderr = stderr
+		return command.Run()
+	}
+
+	if sshCtx.UsesNativeBackend(host) {
+		logging.WithHost(host.GetName()).Debugf("Running (built-in ssh): %s\n", strings.Join(parts, " "))
+		return sshCtx.runNative(ctx, host, stdin, stdout, stderr, parts)
+	}
+
+	cmd, cmdArgs := sshCtx.sshArgs(host, nil)
 	cmdArgs = append(cmdArgs, parts...)
+	logging.WithHost(host.GetName()).Debugf("Running: %s %s\n", cmd, strings.Join(cmdArgs, " "))
+
+	env, err := sshCtx.commandEnv(host)
+	if err != nil {
+		return err
+	}
 
 	command := exec.CommandContext(ctx, cmd, cmdArgs...)
-	if sshCtx.sudoPassword != "" {
-		err := writeSudoPassword(command, sshCtx.sudoPassword)
-		if err != nil {
-			return nil, err
+	command.Env = env
+	command.Stdin = stdin
+	command.Stdout = stdout
+	command.Stderr = stderr
+	return command.Run()
+}
+
+// Whether commands for the host run on the built-in SSH client rather than the ssh and scp binaries.
+// An explicit SSH config file, and the extra options of a host, are only understood by the ssh binary.
+func (sshCtx *SSHContext) UsesNativeBackend(host Host) bool {
+	return !sshCtx.UseSystemSSH && sshCtx.ConfigFile == "" && len(SshOptions(host)) == 0
+}
+
+// Whether an error from running a remote command means that the connection was lost, rather than the command failing
+func IsDisconnected(err error) bool {
+	if activationErr, ok := err.(*ActivationError); ok {
+		err = activationErr.cause
+	}
+
+	// exit code 255 means "SSH connection got disconnected" for the ssh binary
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() == 255 {
+			return true
 		}
 	}
-	return command, nil
+
+	return isNativeDisconnect(err)
+}
+
+// Whether an error means that the host couldn't be reached or the connection was lost, i.e. trying again may help
+func IsConnectionFailure(err error) bool {
+	if _, ok := err.(*connectError); ok {
+		return true
+	}
+	return IsDisconnected(err)
 }
 
 func valCommand(parts []string) ([]string, error) {
@@ -163,29 +416,49 @@ func valCommand(parts []string) ([]string, error) {
 }
 
 func (sshCtx *SSHContext) CmdInteractive(host Host, timeout int, parts ...string) {
+	err := sshCtx.CmdStreamed(host, timeout, os.Stderr, os.Stderr, parts...)
+	if err != nil {
+		logging.WithHost(host.GetName()).Errorf("%s\n", err.Error())
+	}
+}
+
+// Run a command on the host, streaming its output to stdout and stderr
+func (sshCtx *SSHContext) CmdStreamed(host Host, timeout int, stdout io.Writer, stderr io.Writer, parts ...string) error {
 	ctx, cancel := utils.ContextWithConditionalTimeout(context.TODO(), timeout)
 	defer cancel()
 
-	cmd, err := sshCtx.CmdContext(ctx, host, parts...)
-	if err == nil {
-		cmd.Stdout = os.Stderr
-		cmd.Stderr = os.Stderr
-		err = cmd.Run()
-	}
+	err := sshCtx.RunContext(ctx, host, nil, stdout, stderr, parts...)
 
 	// context was cancelled
 	if ctx.Err() != nil {
-		fmt.Fprintf(os.Stderr, "Exec of cmd: %s timed out\n", parts)
-		return
+		return errors.New(fmt.Sprintf("Exec of cmd: %s timed out", parts))
 	}
 
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Exec of cmd: %s failed with err: '%s'\n", parts, err.Error())
+		return errors.New(fmt.Sprintf("Exec of cmd: %s failed with err: '%s'", parts, err.Error()))
 	}
+
+	return nil
 }
 
+// Ask for the sudo password using the $SUDO_ASKPASS program if set, or else on the terminal
 func askForSudoPassword() (string, error) {
-	fmt.Fprint(os.Stderr, "Please enter remote sudo password: ")
+	prompt := "Please enter remote sudo password: "
+	if askpass := os.Getenv("SUDO_ASKPASS"); askpass != "" {
+		var stdout bytes.Buffer
+		cmd := exec.Command(askpass, prompt)
+		cmd.Stdout = &stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return "", errors.New(fmt.Sprintf("Asking for the remote sudo password with %s failed: %s", askpass, err.Error()))
+		}
+		return strings.TrimRight(stdout.String(), "\r\n"), nil
+	}
+
+	if err := utils.CheckInteractive("the remote sudo password"); err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, prompt)
 	stdin := int(syscall.Stdin)
 	state, err := terminal.GetState(stdin)
 	if err != nil {
@@ -213,56 +486,67 @@ func writeSudoPassword(cmd *exec.Cmd, sudoPasswd string) (err error) {
 	return nil
 }
 
+const systemProfile = "/nix/var/nix/profiles/system"
+
 func (ctx *SSHContext) ActivateConfiguration(host Host, configuration string, action string) error {
 
 	if action == "switch" || action == "boot" {
-		cmd, err := ctx.SudoCmd(host, "nix-env", "--profile", "/nix/var/nix/profiles/system", "--set", configuration)
-		if err != nil {
-			return err
-		}
-
-		cmd.Stdout = os.Stderr
-		cmd.Stderr = os.Stderr
-		err = cmd.Run()
+		err := ctx.Run(host, nil, os.Stderr, os.Stderr, "sudo", "nix-env", "--profile", systemProfile, "--set", configuration)
 		if err != nil {
 			return err
 		}
 	}
 
-	args := []string{filepath.Join(configuration, "bin/switch-to-configuration"), action}
+	return ctx.switchToConfiguration(host, configuration, action, os.Stderr)
+}
 
-	var (
-		cmd *exec.Cmd
-		err error
-	)
-	cmd, err = ctx.SudoCmd(host, args...)
+// Switch to the previous generation of the system profile, like `nixos-rebuild switch --rollback`,
+// returning the system activated
+func (ctx *SSHContext) Rollback(host Host) (configuration string, err error) {
+	err = ctx.Run(host, nil, os.Stderr, os.Stderr, "sudo", "nix-env", "--profile", systemProfile, "--rollback")
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	cmd.Stdout = os.Stderr
-	cmd.Stderr = os.Stderr
-	err = cmd.Run()
+	var stdout bytes.Buffer
+	err = ctx.Run(host, nil, &stdout, os.Stderr, "readlink", "-f", systemProfile)
+	if err != nil {
+		return "", err
+	}
+	configuration = strings.TrimSpace(stdout.String())
+
+	return configuration, ctx.switchToConfiguration(host, configuration, "switch", os.Stderr)
+}
+
+func (ctx *SSHContext) switchToConfiguration(host Host, configuration string, action string, output io.Writer) error {
+	err := ctx.Run(host, nil, output, output, "sudo", filepath.Join(configuration, "bin/switch-to-configuration"), action)
 	if err != nil {
-		return errors.New("Error while activating new configuration.")
+		return &ActivationError{cause: err}
 	}
 
 	return nil
 }
 
+// The activation script failed, or the connection to the host was lost while running it
+type ActivationError struct {
+	cause error
+}
+
+func (e *ActivationError) Error() string {
+	if sudoErr, ok := e.cause.(*SudoError); ok {
+		return sudoErr.Error()
+	}
+	if timeoutErr, ok := e.cause.(*TimeoutError); ok {
+		return timeoutErr.Error()
+	}
+	return "Error while activating new configuration."
+}
+
 func (sshCtx *SSHContext) GetBootID(host Host) (string, error) {
 	ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
 	defer cancel()
-	cmd, err := sshCtx.CmdContext(ctx, host, "cat", "/proc/sys/kernel/random/boot_id")
-	if err != nil {
-		return "", err
-	}
-
 	var stdout bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = os.Stderr
-
-	err = cmd.Run()
+	err := sshCtx.RunContext(ctx, host, nil, &stdout, os.Stderr, "cat", "/proc/sys/kernel/random/boot_id")
 	if err != nil {
 		return "", err
 	}
@@ -271,14 +555,10 @@ func (sshCtx *SSHContext) GetBootID(host Host) (string, error) {
 }
 
 func (ctx *SSHContext) MakeTempFile(host Host) (path string, err error) {
-	cmd, _ := ctx.Cmd(host, "mktemp")
-
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
 
-	err = cmd.Run()
+	err = ctx.Run(host, nil, &stdout, &stderr, "mktemp")
 	if err != nil {
 		errorMessage := fmt.Sprintf(
 			"Error on remote host %s (%s):\nCouldn't create temporary file using mktemp\n\nOriginal error:\n%s",
@@ -293,13 +573,35 @@ func (ctx *SSHContext) MakeTempFile(host Host) (path string, err error) {
 }
 
 func (ctx *SSHContext) UploadFile(host Host, source string, destination string) (err error) {
-	c, parts := ctx.sshArgs(host, &FileTransfer{
-		Source:      source,
-		Destination: destination,
-	})
-	cmd := exec.Command(c, parts...)
+	if err = ctx.PreConnect(host); err != nil {
+		return err
+	}
+
+	var data []byte
+	if ctx.UsesNativeBackend(host) || ctx.IsLocal(host) {
+		// runs a command, which takes a session slot by itself
+		data, err = ctx.uploadFileNative(host, source, destination)
+	} else {
+		release := ctx.acquireSession(host)
+		defer release()
+
+		c, parts := ctx.sshArgs(host, &FileTransfer{
+			Source:      source,
+			Destination: destination,
+		})
+		timeoutCtx, cancel := ctx.CommandContext(host)
+		defer cancel()
+		cmd := exec.CommandContext(timeoutCtx, c, parts...)
+		if cmd.Env, err = ctx.commandEnv(host); err != nil {
+			return err
+		}
 
-	data, err := cmd.CombinedOutput()
+		data, err = cmd.CombinedOutput()
+		err = ctx.TimeoutErr(timeoutCtx, host, []string{c, source}, err)
+	}
+	if _, ok := err.(*TimeoutError); ok {
+		return err
+	}
 	if err != nil {
 		errorMessage := fmt.Sprintf(
 			"Error on remote host %s (%s):\nCouldn't upload file: %s -> %s\n\nOriginal error:\n%s",
@@ -322,12 +624,10 @@ func (ctx *SSHContext) MakeDirs(host Host, path string, parents bool, mode os.Fi
 	parts = append(parts, fmt.Sprintf("%o", mode.Perm()))
 	parts = append(parts, path)
 
-	cmd, err := ctx.SudoCmd(host, parts...)
-	if err != nil {
+	data, err := ctx.combinedOutput(host, append([]string{"sudo"}, parts...)...)
+	if _, ok := err.(*SudoError); ok {
 		return err
 	}
-
-	data, err := cmd.CombinedOutput()
 	if err != nil {
 		errorMessage := fmt.Sprintf(
 			"\tCouldn't make directories: %s, on remote host. Error: %s", path, string(data),
@@ -339,12 +639,10 @@ func (ctx *SSHContext) MakeDirs(host Host, path string, parents bool, mode os.Fi
 }
 
 func (ctx *SSHContext) MoveFile(host Host, source string, destination string) (err error) {
-	cmd, err := ctx.SudoCmd(host, "mv", source, destination)
-	if err != nil {
+	data, err := ctx.combinedOutput(host, "sudo", "mv", source, destination)
+	if _, ok := err.(*SudoError); ok {
 		return err
 	}
-
-	data, err := cmd.CombinedOutput()
 	if err != nil {
 		errorMessage := fmt.Sprintf(
 			"\tCouldn't move file: %s -> %s:\n\t%s", source, destination, string(data),
@@ -356,12 +654,10 @@ func (ctx *SSHContext) MoveFile(host Host, source string, destination string) (e
 }
 
 func (ctx *SSHContext) SetOwner(host Host, path string, user string, group string) (err error) {
-	cmd, err := ctx.SudoCmd(host, "chown", user+":"+group, path)
-	if err != nil {
+	data, err := ctx.combinedOutput(host, "sudo", "chown", user+":"+group, path)
+	if _, ok := err.(*SudoError); ok {
 		return err
 	}
-
-	data, err := cmd.CombinedOutput()
 	if err != nil {
 		errorMessage := fmt.Sprintf(
 			"\tCouldn't chown file: %s:\n\t%s", path, string(data),
@@ -373,12 +669,10 @@ func (ctx *SSHContext) SetOwner(host Host, path string, user string, group strin
 }
 
 func (ctx *SSHContext) SetPermissions(host Host, path string, permissions string) (err error) {
-	cmd, err := ctx.SudoCmd(host, "chmod", permissions, path)
-	if err != nil {
+	data, err := ctx.combinedOutput(host, "sudo", "chmod", permissions, path)
+	if _, ok := err.(*SudoError); ok {
 		return err
 	}
-
-	data, err := cmd.CombinedOutput()
 	if err != nil {
 		errorMessage := fmt.Sprintf(
 			"\tCouldn't chmod file: %s:\n\t%s", path, string(data),
@@ -388,3 +682,57 @@ func (ctx *SSHContext) SetPermissions(host Host, path string, permissions string
 
 	return nil
 }
+
+// Printed by the install script if the file was installed, but its owner or permissions couldn't be set
+const partialInstallMarker = "morph: installed with errors"
+
+// Install an uploaded file at the destination in a single sudo invocation: it's copied to a staging file next to the
+// destination (only readable by root), given its owner and permissions, and then renamed to the destination.
+// A dropped connection thus never leaves a truncated or too permissive file at the destination.
+// If only setting the owner or permissions failed, the file is installed (owned by root) and an error returned.
+// The uploaded file is removed in any case.
+func (ctx *SSHContext) InstallFile(host Host, source string, destination string, user string, group string, permissions string) (installed bool, err error) {
+	script := fmt.Sprintf(`set -e
+staging=
+trap 'rm -f -- %[1]s $staging' EXIT
+staging=$(mktemp -p "$(dirname -- %[2]s)" .morph-install.XXXXXX)
+cat -- %[1]s > "$staging"
+partial=
+chown -- %[3]s "$staging" || partial=1
+chmod -- %[4]s "$staging" || partial=1
+mv -f -- "$staging" %[2]s
+if [ -n "$partial" ]; then echo %[5]s; fi`,
+		utils.ShellQuote(source), utils.ShellQuote(destination), utils.ShellQuote(user+":"+group),
+		utils.ShellQuote(permissions), utils.ShellQuote(partialInstallMarker))
+
+	data, err := ctx.combinedOutput(host, "sudo", "sh", "-c", utils.ShellQuote(script))
+	if _, ok := err.(*SudoError); ok {
+		return false, err
+	}
+	if err != nil {
+		errorMessage := fmt.Sprintf(
+			"\tCouldn't install file: %s -> %s:\n\t%s", source, destination, string(data),
+		)
+		return false, errors.New(errorMessage)
+	}
+	if output := string(data); strings.Contains(output, partialInstallMarker) {
+		errorMessage := fmt.Sprintf(
+			"\tCouldn't set owner or permissions of %s:\n\t%s", destination, strings.TrimSpace(strings.Replace(output, partialInstallMarker, "", 1)),
+		)
+		return true, errors.New(errorMessage)
+	}
+
+	return true, nil
+}
+
+func (ctx *SSHContext) combinedOutput(host Host, parts ...string) ([]byte, error) {
+	return ctx.combinedOutputWithInput(host, nil, parts...)
+}
+
+func (ctx *SSHContext) combinedOutputWithInput(host Host, stdin io.Reader, parts ...string) ([]byte, error) {
+	var output bytes.Buffer
+	// the built-in client copies stdout and stderr concurrently
+	writer := utils.NewLockedWriter(&output)
+	err := ctx.Run(host, stdin, writer, writer, parts...)
+	return output.Bytes(), err
+}
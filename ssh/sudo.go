@@ -0,0 +1,281 @@
+package ssh
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dbcdk/morph/utils"
+	"golang.org/x/crypto/ssh/terminal"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Hosts gaining root privileges with something other than sudo, e.g. doas on OpenBSD-style setups
+type PrivilegeEscalationHost interface {
+	GetPrivilegeEscalation() string
+}
+
+// How commands starting with "sudo" are run as root on the host: "sudo" (the default), "doas",
+// or "none" when the target user is root already
+func PrivilegeEscalation(host Host) string {
+	if escalationHost, ok := host.(PrivilegeEscalationHost); ok && escalationHost.GetPrivilegeEscalation() != "" {
+		return escalationHost.GetPrivilegeEscalation()
+	}
+	return "sudo"
+}
+
+// Times a rejected sudo password is asked for again before giving up
+const sudoPasswordAttempts = 3
+
+// Messages printed by sudo on stderr when it can't run the command, and what they mean for the user
+var sudoFailures = []struct {
+	message string
+	reason  string
+	// whether (another) password may get sudo to run the command
+	needsPassword bool
+}{
+	{"a password is required", "sudo requires a password; pass --passwd to be asked for it (or --passwd-file/--passwd-env)", true},
+	{"a terminal is required to read the password", "sudo requires a password; pass --passwd to be asked for it (or --passwd-file/--passwd-env)", true},
+	{"incorrect password attempt", "the sudo password was rejected", true},
+	{"Sorry, try again", "the sudo password was rejected", true},
+	{"We trust you have received the usual lecture", "sudo unexpectedly asked for a password (and showed its lecture)", true},
+	{"you must have a tty to run sudo", "sudo is configured with requiretty, which has to be disabled for the target user", false},
+	{"is not in the sudoers file", "the target user isn't allowed to use sudo", false},
+	{"is not allowed to execute", "the target user isn't allowed to run this command with sudo", false},
+	// doas only reads passwords from a terminal
+	{"doas: Authorization required", "doas requires a password; permit the target user with nopass in doas.conf", false},
+	{"doas: Operation not permitted", "the target user isn't permitted to run this command with doas", false},
+}
+
+// sudo refused to run a remote command, e.g. because of a missing or wrong password
+type SudoError struct {
+	Host   string
+	Reason string
+	// whether asking for the password (again) may help
+	NeedsPassword bool
+	cause         error
+}
+
+func (e *SudoError) Error() string {
+	return fmt.Sprintf("sudo failed on %s: %s", e.Host, e.Reason)
+}
+
+// Keeps the beginning of the stderr of a sudo command, where sudo prints its own errors,
+// passing all other lines on to out
+type sudoStderr struct {
+	out     io.Writer
+	buffer  bytes.Buffer
+	line    []byte
+	lecture bool
+}
+
+func (s *sudoStderr) Write(p []byte) (int, error) {
+	if s.buffer.Len() < 4096 {
+		s.buffer.Write(p)
+	}
+
+	s.line = append(s.line, p...)
+	for {
+		end := bytes.IndexByte(s.line, '\n')
+		if end < 0 {
+			break
+		}
+		line := s.line[:end+1]
+		s.line = s.line[end+1:]
+		if err := s.writeLine(line); err != nil {
+			return len(p), err
+		}
+	}
+
+	return len(p), nil
+}
+
+func (s *sudoStderr) writeLine(line []byte) error {
+	text := string(line)
+	switch {
+	case strings.Contains(text, "We trust you have received the usual lecture"):
+		s.lecture = true
+		return nil
+	case s.lecture:
+		s.lecture = !strings.Contains(text, "great responsibility")
+		return nil
+	case strings.HasPrefix(text, "sudo: ") || strings.HasPrefix(text, "doas: ") || strings.HasPrefix(text, "Sorry, try again"):
+		return nil
+	case s.out == nil:
+		return nil
+	}
+	_, err := s.out.Write(line)
+	return err
+}
+
+// Write a remaining incomplete line
+func (s *sudoStderr) flush() {
+	if len(s.line) > 0 {
+		s.writeLine(s.line)
+		s.line = nil
+	}
+}
+
+// Turn the failure of a sudo command into a SudoError, if it was sudo itself which failed
+func (s *sudoStderr) classify(host Host, err error) error {
+	s.flush()
+	if err == nil {
+		return nil
+	}
+	stderr := s.buffer.String()
+	for _, failure := range sudoFailures {
+		if strings.Contains(stderr, failure.message) {
+			return &SudoError{
+				Host:          host.GetName(),
+				Reason:        failure.reason,
+				NeedsPassword: failure.needsPassword,
+				cause:         err,
+			}
+		}
+	}
+	return err
+}
+
+// Hosts with their own sudo password, read from a file on the deploying machine
+type SudoPasswordHost interface {
+	GetSudoPasswordFile() string
+}
+
+// Sudo passwords of individual hosts, read from their password files and the credentials file
+type sudoCredentials struct {
+	mutex     sync.Mutex
+	loaded    bool
+	passwords map[string]string
+}
+
+// The sudo password to use for the host: its own password if it has one, or else the shared password given
+// by --passwd, --passwd-file or --passwd-env, which is only asked for when a host needs it
+func (sshCtx *SSHContext) hostSudoPassword(host Host) (string, error) {
+	password, ok, err := sshCtx.ownSudoPassword(host)
+	if err != nil || ok {
+		return password, err
+	}
+
+	return sshCtx.sharedSudoPassword()
+}
+
+// The password given by --passwd, --passwd-file or --passwd-env, reading it the first time it is needed.
+// Hosts are deployed to in parallel, so it is only asked for once.
+func (sshCtx *SSHContext) sharedSudoPassword() (password string, err error) {
+	sudoPasswordMutex.Lock()
+	defer sudoPasswordMutex.Unlock()
+
+	if sshCtx.usesSudoPassword() && sshCtx.sudoPassword == "" {
+		sshCtx.sudoPassword, err = sshCtx.readSudoPassword()
+		if err != nil {
+			return "", err
+		}
+	}
+	return sshCtx.sudoPassword, nil
+}
+
+// The password of the host from its sudoPasswordFile or the credentials file, if any
+func (sshCtx *SSHContext) ownSudoPassword(host Host) (password string, ok bool, err error) {
+	credentials := &sshCtx.credentials
+
+	credentials.mutex.Lock()
+	defer credentials.mutex.Unlock()
+
+	if !credentials.loaded {
+		credentials.passwords = make(map[string]string)
+		if sshCtx.SudoCredentialsFile != "" {
+			data, err := ioutil.ReadFile(sshCtx.SudoCredentialsFile)
+			if err != nil {
+				return "", false, errors.New(fmt.Sprintf("Reading the sudo credentials from %s failed: %s", sshCtx.SudoCredentialsFile, err.Error()))
+			}
+			if err := json.Unmarshal(data, &credentials.passwords); err != nil {
+				return "", false, errors.New(fmt.Sprintf("Parsing the sudo credentials in %s failed (expected an object of host names and passwords): %s", sshCtx.SudoCredentialsFile, err.Error()))
+			}
+		}
+		credentials.loaded = true
+	}
+
+	if password, ok := credentials.passwords[host.GetName()]; ok {
+		return password, true, nil
+	}
+
+	if passwordHost, ok := host.(SudoPasswordHost); ok && passwordHost.GetSudoPasswordFile() != "" {
+		path := passwordHost.GetSudoPasswordFile()
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", false, errors.New(fmt.Sprintf("Reading the sudo password of %s from %s failed: %s", host.GetName(), path, err.Error()))
+		}
+		password := strings.TrimRight(string(data), "\r\n")
+		credentials.passwords[host.GetName()] = password
+		return password, true, nil
+	}
+
+	return "", false, nil
+}
+
+// Whether a sudo password is to be supplied, rather than relying on passwordless sudo
+func (sshCtx *SSHContext) usesSudoPassword() bool {
+	return sshCtx.AskForSudoPassword || sshCtx.SudoPasswordFile != "" || sshCtx.SudoPasswordEnv != ""
+}
+
+// Get the sudo password from the configured file or environment variable, or else by asking for it
+func (sshCtx *SSHContext) readSudoPassword() (string, error) {
+	switch {
+	case sshCtx.SudoPasswordFile != "":
+		data, err := ioutil.ReadFile(sshCtx.SudoPasswordFile)
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("Reading the remote sudo password from %s failed: %s", sshCtx.SudoPasswordFile, err.Error()))
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case sshCtx.SudoPasswordEnv != "":
+		password := os.Getenv(sshCtx.SudoPasswordEnv)
+		if password == "" {
+			return "", errors.New(fmt.Sprintf("The remote sudo password should be in $%s, which is not set", sshCtx.SudoPasswordEnv))
+		}
+		return password, nil
+	default:
+		return askForSudoPassword()
+	}
+}
+
+// Serializes reading and asking for the sudo password, as hosts are deployed to in parallel
+var sudoPasswordMutex sync.Mutex
+
+// Ask for the sudo password again after it was missing or rejected, unless another host already did so.
+// Returns false if the password shouldn't be tried again.
+func (sshCtx *SSHContext) repromptSudoPassword(host Host, rejected string, attempt int) bool {
+	if !sshCtx.RepromptSudoPassword || attempt >= sudoPasswordAttempts || utils.NonInteractive {
+		return false
+	}
+	// the password of the host itself is wrong; the shared one may not be
+	if _, ok, _ := sshCtx.ownSudoPassword(host); ok {
+		return false
+	}
+	// a password from a file or the environment would just be rejected again
+	if sshCtx.SudoPasswordFile != "" || sshCtx.SudoPasswordEnv != "" {
+		return false
+	}
+	if !terminal.IsTerminal(int(syscall.Stdin)) && os.Getenv("SUDO_ASKPASS") == "" {
+		return false
+	}
+
+	sudoPasswordMutex.Lock()
+	defer sudoPasswordMutex.Unlock()
+
+	if sshCtx.sudoPassword != rejected {
+		return true
+	}
+
+	fmt.Fprintln(os.Stderr, "The remote sudo password was missing or rejected.")
+	password, err := askForSudoPassword()
+	if err != nil {
+		return false
+	}
+	sshCtx.sudoPassword = password
+	return true
+}
@@ -0,0 +1,103 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dbcdk/morph/utils"
+	gossh "golang.org/x/crypto/ssh"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Hosts overriding the connect and command timeouts of the deployment (deployment.connectTimeout and
+// deployment.commandTimeout), in seconds
+type TimeoutHost interface {
+	GetConnectTimeout() int
+	GetCommandTimeout() int
+}
+
+func (sshCtx *SSHContext) connectTimeout(host Host) int {
+	if timeoutHost, ok := host.(TimeoutHost); ok && timeoutHost.GetConnectTimeout() > 0 {
+		return timeoutHost.GetConnectTimeout()
+	}
+	return sshCtx.ConnectTimeout
+}
+
+func (sshCtx *SSHContext) commandTimeout(host Host) int {
+	if timeoutHost, ok := host.(TimeoutHost); ok && timeoutHost.GetCommandTimeout() > 0 {
+		return timeoutHost.GetCommandTimeout()
+	}
+	return sshCtx.CommandTimeout
+}
+
+// Options for the ssh binary giving up on connecting to the host after its connect timeout
+func (sshCtx *SSHContext) TimeoutOptions(host Host) []string {
+	if timeout := sshCtx.connectTimeout(host); timeout > 0 {
+		return []string{"-o", "ConnectTimeout=" + strconv.Itoa(timeout)}
+	}
+	return nil
+}
+
+// A context ending when a command on the host has run for longer than its command timeout
+func (sshCtx *SSHContext) CommandContext(host Host) (context.Context, context.CancelFunc) {
+	return utils.ContextWithConditionalTimeout(context.TODO(), sshCtx.commandTimeout(host))
+}
+
+// A command on the host was stopped by its command timeout
+type TimeoutError struct {
+	Host    string
+	Command string
+	Timeout int
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s: `%s` timed out after %ds", e.Host, e.Command, e.Timeout)
+}
+
+// The error of a command run with CommandContext: a TimeoutError if it was stopped by the timeout
+func (sshCtx *SSHContext) TimeoutErr(ctx context.Context, host Host, parts []string, err error) error {
+	if err == nil || ctx.Err() != context.DeadlineExceeded {
+		return err
+	}
+	command := strings.Join(parts, " ")
+	if len(command) > 60 {
+		command = command[:57] + "..."
+	}
+	return &TimeoutError{Host: host.GetName(), Command: command, Timeout: sshCtx.commandTimeout(host)}
+}
+
+// Dial address over network with the built-in client, giving up after the connect timeout of the host - including
+// the handshake, as a wedged host may accept connections without ever answering them
+func (sshCtx *SSHContext) dialTimeout(host Host, network string, address string, config *gossh.ClientConfig) (*gossh.Client, error) {
+	timeout := time.Duration(sshCtx.connectTimeout(host)) * time.Second
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return sshCtx.clientConn(host, conn, address, config)
+}
+
+// Set up an SSH connection on conn, closing it if the connect timeout of the host passes first
+func (sshCtx *SSHContext) clientConn(host Host, conn net.Conn, address string, config *gossh.ClientConfig) (*gossh.Client, error) {
+	timeout := sshCtx.connectTimeout(host)
+	var timer *time.Timer
+	if timeout > 0 {
+		timer = time.AfterFunc(time.Duration(timeout)*time.Second, func() { conn.Close() })
+	}
+
+	clientConn, chans, reqs, err := gossh.NewClientConn(conn, address, config)
+	if timer != nil && !timer.Stop() {
+		if err == nil {
+			clientConn.Close()
+		}
+		return nil, errors.New(fmt.Sprintf("timed out after %ds", timeout))
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return gossh.NewClient(clientConn, chans, reqs), nil
+}
@@ -0,0 +1,84 @@
+package utils
+
+import "fmt"
+
+// Line-based diff of a and b in unified format (without file headers), showing context unchanged lines around changes
+func UnifiedDiff(a []string, b []string, context int) (lines []string) {
+	// longest common subsequence of lines, lcs[i][j] being its length for a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	type edit struct {
+		op   byte
+		line string
+		// line numbers (1-based) in a and b before this edit
+		aLine, bLine int
+	}
+	edits := make([]edit, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			edits = append(edits, edit{' ', a[i], i, j})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, edit{'-', a[i], i, j})
+			i++
+		default:
+			edits = append(edits, edit{'+', b[j], i, j})
+			j++
+		}
+	}
+
+	changes := make([]int, 0)
+	for index, e := range edits {
+		if e.op != ' ' {
+			changes = append(changes, index)
+		}
+	}
+
+	// group changes less than 2*context lines apart into hunks, with context lines around them
+	for c := 0; c < len(changes); {
+		first, last := changes[c], changes[c]
+		for c++; c < len(changes) && changes[c]-last-1 <= 2*context; c++ {
+			last = changes[c]
+		}
+		from, to := first-context, last+context+1
+		if from < 0 {
+			from = 0
+		}
+		if to > len(edits) {
+			to = len(edits)
+		}
+
+		aCount, bCount := 0, 0
+		for _, e := range edits[from:to] {
+			if e.op != '+' {
+				aCount++
+			}
+			if e.op != '-' {
+				bCount++
+			}
+		}
+		lines = append(lines, fmt.Sprintf("@@ -%d,%d +%d,%d @@", edits[from].aLine+1, aCount, edits[from].bLine+1, bCount))
+		for _, e := range edits[from:to] {
+			lines = append(lines, string(e.op)+e.line)
+		}
+	}
+
+	return lines
+}
@@ -0,0 +1,23 @@
+package utils
+
+import (
+	"io"
+	"sync"
+)
+
+// A writer safe for concurrent use, e.g. as both stdout and stderr of a command run by the built-in SSH client,
+// which copies them concurrently
+type LockedWriter struct {
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+func NewLockedWriter(writer io.Writer) *LockedWriter {
+	return &LockedWriter{writer: writer}
+}
+
+func (w *LockedWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.writer.Write(p)
+}
@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+)
+
+// A writer prefixing every line written to it, e.g. with the name of the host the output came from.
+// Output is buffered until a complete line is available; use Flush to write a trailing partial line.
+type PrefixWriter struct {
+	out    io.Writer
+	prefix string
+	buf    bytes.Buffer
+}
+
+func NewPrefixWriter(out io.Writer, prefix string) *PrefixWriter {
+	return &PrefixWriter{
+		out:    out,
+		prefix: prefix,
+	}
+}
+
+func (w *PrefixWriter) Write(p []byte) (n int, err error) {
+	w.buf.Write(p)
+
+	for {
+		line, err := w.buf.ReadBytes('\n')
+		if err != nil {
+			// incomplete line, keep it for later
+			w.buf.Reset()
+			w.buf.Write(line)
+			break
+		}
+		if _, err := io.WriteString(w.out, w.prefix+string(line)); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+func (w *PrefixWriter) Flush() error {
+	if w.buf.Len() == 0 {
+		return nil
+	}
+
+	_, err := io.WriteString(w.out, w.prefix+w.buf.String()+"\n")
+	w.buf.Reset()
+	return err
+}
@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Set by --non-interactive: fail instead of prompting, e.g. in CI jobs
+var NonInteractive bool
+
+// An error if morph must not prompt for the given thing
+func CheckInteractive(prompt string) error {
+	if NonInteractive {
+		return errors.New(fmt.Sprintf("Would have to prompt for %s, but --non-interactive was given\n", prompt))
+	}
+	return nil
+}
+
+// Hosts may be deployed to in parallel, so only one question is asked at a time
+var confirmMutex sync.Mutex
+
+// Shared by all questions, as a reader of its own would read ahead answers piped in for the following ones
+var stdin = bufio.NewReader(os.Stdin)
+
+// Ask a yes/no question on the terminal. Anything but an explicit yes is a no.
+func Confirm(question string) (bool, error) {
+	if err := CheckInteractive(fmt.Sprintf("confirmation (%s)", question)); err != nil {
+		return false, err
+	}
+
+	confirmMutex.Lock()
+	defer confirmMutex.Unlock()
+
+	fmt.Fprintf(os.Stderr, "%s [y/N]: ", question)
+
+	answer, err := stdin.ReadString('\n')
+	if err != nil {
+		return false, err
+	}
+
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	default:
+		return false, nil
+	}
+}
@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"time"
+)
+
+// How often to attempt an operation failing for transient reasons, e.g. a dropped connection.
+// The delay between attempts doubles after every attempt, up to MaxDelay.
+type RetryPolicy struct {
+	Retries      int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
+// Run f until it succeeds, fails with an error that isn't retryable, or the retries are used up.
+// onRetry is called before waiting for the next attempt.
+func Retry(policy RetryPolicy, retryable func(error) bool, onRetry func(err error, delay time.Duration), f func() error) error {
+	delay := policy.InitialDelay
+
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= policy.Retries || !retryable(err) {
+			return err
+		}
+
+		if onRetry != nil {
+			onRetry(err, delay)
+		}
+		time.Sleep(delay)
+
+		delay *= 2
+		if policy.MaxDelay > 0 && delay > policy.MaxDelay {
+			delay = policy.MaxDelay
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dbcdk/morph/logging"
+	"time"
+)
+
+var scheduleLayouts = []string{time.RFC3339, "2006-01-02 15:04", "15:04"}
+
+// Compute the point in time a scheduled action should happen; either at a given time (the next occurrence,
+// if only the time of day is given; a date and time mustn't be in the past) or after a delay from now
+func ScheduledTime(at string, delay time.Duration, now time.Time) (time.Time, error) {
+	if at != "" && delay != 0 {
+		return now, errors.New("Only one of a time and a delay can be given")
+	}
+	if delay < 0 {
+		return now, errors.New("The delay mustn't be negative")
+	}
+	if at == "" {
+		return now.Add(delay), nil
+	}
+
+	for _, layout := range scheduleLayouts {
+		t, err := time.ParseInLocation(layout, at, now.Location())
+		if err != nil {
+			continue
+		}
+
+		if layout == "15:04" {
+			t = time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+			if !t.After(now) {
+				t = t.AddDate(0, 0, 1)
+			}
+		} else if !t.After(now) {
+			return now, errors.New(fmt.Sprintf("The time '%s' is in the past", at))
+		}
+		return t, nil
+	}
+
+	return now, errors.New(fmt.Sprintf("Couldn't parse time '%s'; use HH:MM, YYYY-MM-DD HH:MM or RFC3339", at))
+}
+
+func WaitUntil(t time.Time) {
+	delay := time.Until(t)
+	if delay <= 0 {
+		return
+	}
+
+	logging.Infof("Waiting until %s (%s from now) ...\n", t.Format("2006-01-02 15:04:05"), delay.Round(time.Second))
+	time.Sleep(delay)
+}
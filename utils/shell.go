@@ -0,0 +1,8 @@
+package utils
+
+import "strings"
+
+// Quote a string for use as a single word in a POSIX shell command line
+func ShellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,15 @@
+package utils
+
+import "fmt"
+
+// Format a number of bytes for humans, e.g. "1.5 MiB"
+func FormatBytes(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}